@@ -0,0 +1,57 @@
+package es
+
+import (
+	"context"
+	"sort"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// AliasAction is an action of UpdateAliases.
+type AliasAction map[string]interface{}
+
+// AddAlias adds the alias to the index.
+func AddAlias(index, alias string) AliasAction {
+	return AliasAction{"add": map[string]interface{}{"index": index, "alias": alias}}
+}
+
+// AddWriteAlias adds the alias to the index as its write index, the writes
+// to an alias of several indices go to its write index.
+func AddWriteAlias(index, alias string) AliasAction {
+	return AliasAction{"add": map[string]interface{}{"index": index, "alias": alias, "is_write_index": true}}
+}
+
+// RemoveAlias removes the alias from the index.
+func RemoveAlias(index, alias string) AliasAction {
+	return AliasAction{"remove": map[string]interface{}{"index": index, "alias": alias}}
+}
+
+// UpdateAliases applies the actions atomically, the searches see the
+// aliases either before or after all of them.
+func (e *ElasticClient) UpdateAliases(c context.Context, actions ...AliasAction) (err error) {
+	if len(actions) == 0 {
+		return
+	}
+	r, err := reader(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return
+	}
+	return e.do(c, esapi.IndicesUpdateAliasesRequest{Body: r}, nil)
+}
+
+// AliasIndices returns the sorted indices of the alias, none when it
+// doesn't exist.
+func (e *ElasticClient) AliasIndices(c context.Context, alias string) (indices []string, err error) {
+	var res map[string]interface{}
+	if err = e.do(c, esapi.IndicesGetAliasRequest{Name: []string{alias}}, &res); err != nil {
+		if IsNotFound(err) {
+			err = nil
+		}
+		return
+	}
+	for index := range res {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return
+}
@@ -0,0 +1,431 @@
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/backoff"
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+// The actions of a BulkItem.
+const (
+	ActionIndex  = "index"
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+const (
+	_bulkFlushBytes    = 5 << 20
+	_bulkFlushItems    = 1000
+	_bulkFlushInterval = time.Second
+	_bulkMaxRetries    = 3
+	_bulkBackoff       = 100 * time.Millisecond
+)
+
+// ErrBulkClosed is returned by Add after Close.
+var ErrBulkClosed = errors.New("es: bulk indexer closed")
+
+// BulkConfig is the config of a BulkIndexer.
+type BulkConfig struct {
+	Index   string // default index of the items.
+	Workers int    // number of concurrent flushes, the number of CPUs by default.
+	// A worker flushes its items once they reach FlushBytes or FlushItems,
+	// and every FlushInterval. 5MB, 1000 and 1s by default.
+	FlushBytes    int
+	FlushItems    int
+	FlushInterval xtime.Duration
+	Refresh       string         // refresh parameter of the bulk requests.
+	Timeout       xtime.Duration // timeout of a bulk request, none by default.
+	// MaxRetries is the number of retries of the items, or of the whole
+	// request, rejected with 429, 3 by default. Backoff is the first retry
+	// interval, 100ms by default, doubled on every retry.
+	MaxRetries int
+	Backoff    xtime.Duration
+}
+
+// BulkItem is an item of a bulk request.
+type BulkItem struct {
+	Action     string // ActionIndex by default.
+	Index      string // BulkConfig.Index by default.
+	DocumentID string
+	Routing    string
+	// RetryOnConflict is the number of retries of an update on version
+	// conflict, none by default.
+	RetryOnConflict int
+	// Body is the document of an index or a create, and the body of an
+	// update such as {"doc": {...}}. Strings, bytes and json.RawMessage
+	// hold json, the other values are encoded in json.
+	Body interface{}
+
+	// OnSuccess and OnFailure are called with the context of Add once the
+	// item is written or failed. err is an *Error for the item rejected by
+	// elasticsearch and the error of the request otherwise. They run on the
+	// worker which flushed the item, before it takes new items, so they must
+	// be quick and must not call Add, which may wait for that worker.
+	OnSuccess func(c context.Context, item *BulkItem, res *BulkItemResponse)
+	OnFailure func(c context.Context, item *BulkItem, res *BulkItemResponse, err error)
+}
+
+// BulkItemResponse is the response of an item of a bulk request.
+type BulkItemResponse struct {
+	Index   string `json:"_index"`
+	ID      string `json:"_id"`
+	Version int64  `json:"_version"`
+	Result  string `json:"result"`
+	Status  int    `json:"status"`
+	Error   *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// BulkStats are the counters of a BulkIndexer since its creation.
+type BulkStats struct {
+	Added    uint64 // items added.
+	Flushed  uint64 // items sent, retries included.
+	Indexed  uint64 // items indexed, created, updated or deleted.
+	Failed   uint64 // items failed, after the retries.
+	Retried  uint64 // items retried.
+	Requests uint64 // bulk requests.
+	Bytes    uint64 // bytes of the bulk requests.
+}
+
+// BulkIndexer writes items with bulk requests from concurrent workers. Add
+// blocks while every worker is busy flushing, so that a producer faster
+// than elasticsearch slows down instead of buffering without limit.
+type BulkIndexer struct {
+	client  *ElasticClient
+	conf    *BulkConfig
+	backoff backoff.Backoff
+
+	items  chan *bulkItem
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{} // closed by Close, the workers flush and exit.
+	wg     sync.WaitGroup
+	// ctx is canceled when the context of Close is done, it aborts the
+	// requests and the waits between the retries.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	added, flushed, indexed, failed, retried, requests, bytes uint64
+}
+
+// bulkItem is an item added with its context and encoded lines.
+type bulkItem struct {
+	*BulkItem
+	c    context.Context
+	data []byte
+}
+
+// NewBulkIndexer returns a bulk indexer with its workers started, Close it
+// to flush the remaining items.
+func (e *ElasticClient) NewBulkIndexer(c *BulkConfig) *BulkIndexer {
+	if c == nil {
+		c = &BulkConfig{}
+	}
+	if c.Workers <= 0 {
+		c.Workers = runtime.NumCPU()
+	}
+	if c.FlushBytes <= 0 {
+		c.FlushBytes = _bulkFlushBytes
+	}
+	if c.FlushItems <= 0 {
+		c.FlushItems = _bulkFlushItems
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = xtime.Duration(_bulkFlushInterval)
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = _bulkMaxRetries
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = xtime.Duration(_bulkBackoff)
+	}
+	b := &BulkIndexer{
+		client:  e,
+		conf:    c,
+		backoff: backoff.NewConstantBackoff(c.Backoff / 2), // doubled from the first retry.
+		items:   make(chan *bulkItem),
+		done:    make(chan struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.wg.Add(c.Workers)
+	for i := 0; i < c.Workers; i++ {
+		go b.worker()
+	}
+	return b
+}
+
+// SetBackoff sets the backoff between the retries.
+func (b *BulkIndexer) SetBackoff(bo backoff.Backoff) {
+	b.backoff = bo
+}
+
+// Add queues the item, it returns once a worker took it, when c is done or
+// when the indexer is closed meanwhile.
+func (b *BulkIndexer) Add(c context.Context, item *BulkItem) (err error) {
+	it := &bulkItem{BulkItem: item, c: c}
+	if it.data, err = b.encode(item); err != nil {
+		return
+	}
+	b.mu.RLock()
+	closed := b.closed
+	b.mu.RUnlock()
+	if closed {
+		return ErrBulkClosed
+	}
+	select {
+	case b.items <- it:
+		atomic.AddUint64(&b.added, 1)
+		return nil
+	case <-c.Done():
+		return c.Err()
+	case <-b.done:
+		return ErrBulkClosed
+	}
+}
+
+// Close flushes the remaining items, retries included, and stops the
+// workers. When c is done first it aborts the requests in flight and the
+// retries, their items fail with the error of c, and returns early.
+func (b *BulkIndexer) Close(c context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+	b.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		b.cancel()
+		return nil
+	case <-c.Done():
+		b.cancel()
+		return c.Err()
+	}
+}
+
+// Stats returns the counters of the indexer.
+func (b *BulkIndexer) Stats() BulkStats {
+	return BulkStats{
+		Added:    atomic.LoadUint64(&b.added),
+		Flushed:  atomic.LoadUint64(&b.flushed),
+		Indexed:  atomic.LoadUint64(&b.indexed),
+		Failed:   atomic.LoadUint64(&b.failed),
+		Retried:  atomic.LoadUint64(&b.retried),
+		Requests: atomic.LoadUint64(&b.requests),
+		Bytes:    atomic.LoadUint64(&b.bytes),
+	}
+}
+
+// encode returns the action line and the body line of the item.
+func (b *BulkIndexer) encode(item *BulkItem) (data []byte, err error) {
+	action := item.Action
+	if action == "" {
+		action = ActionIndex
+	}
+	switch action {
+	case ActionIndex, ActionCreate, ActionUpdate, ActionDelete:
+	default:
+		return nil, errors.Errorf("es: unknown bulk action %q", action)
+	}
+	meta := map[string]interface{}{}
+	if index := item.Index; index != "" {
+		meta["_index"] = index
+	} else if b.conf.Index != "" {
+		meta["_index"] = b.conf.Index
+	} else {
+		return nil, errors.New("es: bulk item without index")
+	}
+	if item.DocumentID != "" {
+		meta["_id"] = item.DocumentID
+	} else if action != ActionIndex && action != ActionCreate {
+		return nil, errors.Errorf("es: bulk %s without document id", action)
+	}
+	if item.Routing != "" {
+		meta["routing"] = item.Routing
+	}
+	if item.RetryOnConflict > 0 {
+		meta["retry_on_conflict"] = item.RetryOnConflict
+	}
+	line, err := json.Marshal(map[string]interface{}{action: meta})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	buf := bytes.NewBuffer(append(line, '\n'))
+	if action == ActionDelete {
+		return buf.Bytes(), nil
+	}
+	// the body of a bulk request is newline delimited json, the raw bodies
+	// are compacted onto one line.
+	switch v := item.Body.(type) {
+	case string:
+		err = json.Compact(buf, []byte(v))
+	case []byte:
+		err = json.Compact(buf, v)
+	case json.RawMessage:
+		err = json.Compact(buf, v)
+	default:
+		var body []byte
+		if body, err = json.Marshal(v); err == nil {
+			buf.Write(body)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "es: encode bulk item")
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (b *BulkIndexer) worker() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(time.Duration(b.conf.FlushInterval))
+	defer ticker.Stop()
+	var (
+		items []*bulkItem
+		size  int
+	)
+	flush := func() {
+		if len(items) > 0 {
+			b.flush(items)
+			items, size = nil, 0
+		}
+	}
+	for {
+		select {
+		case it := <-b.items:
+			if size+len(it.data) > b.conf.FlushBytes {
+				flush()
+			}
+			items = append(items, it)
+			size += len(it.data)
+			if len(items) >= b.conf.FlushItems {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-b.done:
+			// the items taken are flushed, the senders left get ErrBulkClosed.
+			flush()
+			return
+		}
+	}
+}
+
+// flush sends the items and retries the ones rejected with 429, and the
+// whole request when it is rejected with 429.
+func (b *BulkIndexer) flush(items []*bulkItem) {
+	for attempt := 0; len(items) > 0; attempt++ {
+		if attempt > 0 {
+			atomic.AddUint64(&b.retried, uint64(len(items)))
+			if !sleep(b.ctx, b.backoff.Next(attempt)) {
+				for _, it := range items {
+					b.fail(it, nil, b.ctx.Err())
+				}
+				return
+			}
+		}
+		res, err := b.send(items)
+		if err != nil {
+			if attempt < b.conf.MaxRetries && tooManyRequests(err) {
+				log.Warnf("es bulk of %d items error(%v) retry %d", len(items), err, attempt+1)
+				continue
+			}
+			log.Errorf("es bulk of %d items error(%v)", len(items), err)
+			for _, it := range items {
+				b.fail(it, nil, err)
+			}
+			return
+		}
+		var retry []*bulkItem
+		for i, it := range items {
+			r := res[i]
+			switch {
+			case r.Error == nil && r.Status < 300:
+				atomic.AddUint64(&b.indexed, 1)
+				if it.OnSuccess != nil {
+					it.OnSuccess(it.c, it.BulkItem, r)
+				}
+			case r.Status == http.StatusTooManyRequests && attempt < b.conf.MaxRetries:
+				retry = append(retry, it)
+			default:
+				e := &Error{Status: r.Status}
+				if r.Error != nil {
+					e.Type, e.Reason = r.Error.Type, r.Error.Reason
+				}
+				b.fail(it, r, e)
+			}
+		}
+		items = retry
+	}
+}
+
+func (b *BulkIndexer) fail(it *bulkItem, res *BulkItemResponse, err error) {
+	atomic.AddUint64(&b.failed, 1)
+	if it.OnFailure != nil {
+		it.OnFailure(it.c, it.BulkItem, res, err)
+	}
+}
+
+// send performs a bulk request of the items and returns the responses of
+// the items in order.
+func (b *BulkIndexer) send(items []*bulkItem) (res []*BulkItemResponse, err error) {
+	var buf bytes.Buffer
+	for _, it := range items {
+		buf.Write(it.data)
+	}
+	atomic.AddUint64(&b.requests, 1)
+	atomic.AddUint64(&b.flushed, uint64(len(items)))
+	atomic.AddUint64(&b.bytes, uint64(buf.Len()))
+	c := b.ctx
+	if b.conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, time.Duration(b.conf.Timeout))
+		defer cancel()
+	}
+	var resp struct {
+		Items []map[string]*BulkItemResponse `json:"items"`
+	}
+	if err = b.client.do(c, esapi.BulkRequest{Body: &buf, Refresh: b.conf.Refresh}, &resp); err != nil {
+		return
+	}
+	if len(resp.Items) != len(items) {
+		return nil, errors.Errorf("es: bulk of %d items got %d responses", len(items), len(resp.Items))
+	}
+	res = make([]*BulkItemResponse, len(items))
+	for i, m := range resp.Items {
+		for _, r := range m {
+			res[i] = r
+		}
+		if res[i] == nil {
+			return nil, errors.Errorf("es: bulk response of item %d is empty", i)
+		}
+	}
+	return
+}
+
+// tooManyRequests reports whether err is a rejection of elasticsearch
+// under load, the request may be sent again later.
+func tooManyRequests(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusTooManyRequests
+}
@@ -0,0 +1,219 @@
+package es
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quan-xie/tuba/backoff"
+	"github.com/quan-xie/tuba/ecode"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+func TestBulkEncode(t *testing.T) {
+	b := &BulkIndexer{conf: &BulkConfig{Index: "docs"}}
+	for _, c := range []struct {
+		item *BulkItem
+		want string
+	}{
+		{&BulkItem{DocumentID: "1", Body: map[string]int{"n": 1}}, `{"index":{"_id":"1","_index":"docs"}}` + "\n" + `{"n":1}` + "\n"},
+		{&BulkItem{Action: ActionCreate, Index: "other", Body: "{\n  \"n\": 1\n}\n"}, `{"create":{"_index":"other"}}` + "\n" + `{"n":1}` + "\n"},
+		{&BulkItem{Action: ActionUpdate, DocumentID: "1", RetryOnConflict: 3, Routing: "u1", Body: json.RawMessage(`{"doc":{"n":2}}`)}, `{"update":{"_id":"1","_index":"docs","retry_on_conflict":3,"routing":"u1"}}` + "\n" + `{"doc":{"n":2}}` + "\n"},
+		{&BulkItem{Action: ActionDelete, DocumentID: "1"}, `{"delete":{"_id":"1","_index":"docs"}}` + "\n"},
+	} {
+		data, err := b.encode(c.item)
+		if err != nil || string(data) != c.want {
+			t.Errorf("encode(%+v) = %q, %v, want %q", c.item, data, err, c.want)
+		}
+	}
+	for _, item := range []*BulkItem{
+		{Action: "upsert", DocumentID: "1"},
+		{Action: ActionDelete},
+		{DocumentID: "1", Body: "{not json"},
+	} {
+		if _, err := b.encode(item); err == nil {
+			t.Errorf("encode(%+v) should fail", item)
+		}
+	}
+	if _, err := (&BulkIndexer{conf: &BulkConfig{}}).encode(&BulkItem{DocumentID: "1", Body: "{}"}); err == nil {
+		t.Error("encode() without index should fail")
+	}
+}
+
+// bulkServer answers the bulk requests with reply(id, attempt of the id).
+func bulkServer(t *testing.T, reply func(id string, attempt int) string) *ElasticClient {
+	var (
+		mu       sync.Mutex
+		attempts = map[string]int{}
+	)
+	return newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		var items []string
+		s := bufio.NewScanner(r.Body)
+		for s.Scan() {
+			var meta map[string]struct {
+				ID string `json:"_id"`
+			}
+			json.Unmarshal(s.Bytes(), &meta)
+			for action, m := range meta {
+				mu.Lock()
+				attempts[m.ID]++
+				items = append(items, fmt.Sprintf(`{%q:%s}`, action, reply(m.ID, attempts[m.ID])))
+				mu.Unlock()
+				if action != ActionDelete {
+					s.Scan()
+				}
+			}
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+	})
+}
+
+func TestBulkIndexer(t *testing.T) {
+	e := bulkServer(t, func(id string, attempt int) string {
+		switch {
+		case id == "2" && attempt == 1:
+			return `{"_id":"2","status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}`
+		case id == "3":
+			return `{"_id":"3","status":409,"error":{"type":"version_conflict_engine_exception","reason":"document already exists"}}`
+		}
+		return fmt.Sprintf(`{"_index":"docs","_id":%q,"_version":1,"result":"created","status":201}`, id)
+	})
+	b := e.NewBulkIndexer(&BulkConfig{Index: "docs", Workers: 2, FlushItems: 2, FlushInterval: xtime.Duration(time.Hour)})
+	b.SetBackoff(backoff.NewConstantBackoff(xtime.Duration(time.Millisecond)))
+
+	var (
+		mu      sync.Mutex
+		success []string
+		failure = map[string]error{}
+	)
+	c := context.Background()
+	for i := 1; i <= 5; i++ {
+		err := b.Add(c, &BulkItem{
+			Action:     ActionCreate,
+			DocumentID: fmt.Sprint(i),
+			Body:       map[string]int{"n": i},
+			OnSuccess: func(c context.Context, item *BulkItem, res *BulkItemResponse) {
+				mu.Lock()
+				success = append(success, res.ID)
+				mu.Unlock()
+			},
+			OnFailure: func(c context.Context, item *BulkItem, res *BulkItemResponse, err error) {
+				mu.Lock()
+				failure[item.DocumentID] = err
+				mu.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(success) != 4 {
+		t.Errorf("success = %v, want 4 items", success)
+	}
+	if err := failure["3"]; len(failure) != 1 || !IsConflict(err) {
+		t.Errorf("failure = %v, want a conflict of 3", failure)
+	}
+	st := b.Stats()
+	if st.Added != 5 || st.Flushed != 6 || st.Indexed != 4 || st.Failed != 1 || st.Retried != 1 || st.Requests < 3 {
+		t.Errorf("Stats() = %+v", st)
+	}
+	if err := b.Add(c, &BulkItem{DocumentID: "6", Body: "{}"}); err != ErrBulkClosed {
+		t.Errorf("Add() after Close() = %v, want ErrBulkClosed", err)
+	}
+}
+
+func TestBulkIndexerRetries(t *testing.T) {
+	e := bulkServer(t, func(id string, attempt int) string {
+		return `{"_id":"1","status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}`
+	})
+	b := e.NewBulkIndexer(&BulkConfig{Index: "docs", Workers: 1, MaxRetries: 2, FlushInterval: xtime.Duration(10 * time.Millisecond)})
+	b.SetBackoff(backoff.NewConstantBackoff(xtime.Duration(time.Millisecond)))
+	failed := make(chan error, 1)
+	b.Add(context.Background(), &BulkItem{Action: ActionDelete, DocumentID: "1", OnFailure: func(c context.Context, item *BulkItem, res *BulkItemResponse, err error) {
+		failed <- err
+	}})
+	select {
+	case err := <-failed:
+		if Ecode(err) != ecode.LimitExceed {
+			t.Errorf("failure = %v, want a 429", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the item wasn't flushed by the interval")
+	}
+	b.Close(context.Background())
+	if st := b.Stats(); st.Requests != 3 || st.Retried != 2 || st.Failed != 1 {
+		t.Errorf("Stats() = %+v", st)
+	}
+}
+
+func TestBulkIndexerCloseDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	e := bulkServer(t, func(id string, attempt int) string {
+		<-release
+		return fmt.Sprintf(`{"_id":%q,"status":201}`, id)
+	})
+	b := e.NewBulkIndexer(&BulkConfig{Index: "docs", Workers: 1, FlushItems: 1})
+	c := context.Background()
+	// the only worker is stuck flushing 1, so adding 2 blocks.
+	if err := b.Add(c, &BulkItem{DocumentID: "1", Body: "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	added := make(chan error, 1)
+	go func() {
+		added <- b.Add(c, &BulkItem{DocumentID: "2", Body: "{}"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cc, cancel := context.WithTimeout(c, 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.Close(cc); err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Errorf("Close() = %v after %v, want the deadline", err, time.Since(start))
+	}
+	select {
+	case err := <-added:
+		if err != ErrBulkClosed {
+			t.Errorf("blocked Add() = %v, want ErrBulkClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Add() still blocked after Close()")
+	}
+}
+
+func TestBulkIndexerCloseDuringRetry(t *testing.T) {
+	e := bulkServer(t, func(id string, attempt int) string {
+		return `{"_id":"1","status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}`
+	})
+	b := e.NewBulkIndexer(&BulkConfig{Index: "docs", Workers: 1, FlushItems: 1, MaxRetries: 5, Backoff: xtime.Duration(time.Hour)})
+	failed := make(chan error, 1)
+	b.Add(context.Background(), &BulkItem{Action: ActionDelete, DocumentID: "1", OnFailure: func(c context.Context, item *BulkItem, res *BulkItemResponse, err error) {
+		failed <- err
+	}})
+	time.Sleep(10 * time.Millisecond)
+	c, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.Close(c); err != context.DeadlineExceeded {
+		t.Errorf("Close() = %v, want the deadline", err)
+	}
+	select {
+	case err := <-failed:
+		if err != context.Canceled {
+			t.Errorf("failure = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the retry wait wasn't interrupted by Close")
+	}
+}
@@ -4,12 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
+	"io"
 	"strings"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
-	"github.com/quan-xie/tuba/log"
+	"github.com/pkg/errors"
 )
 
 // TODO more config to add .
@@ -22,146 +22,197 @@ type ElasticClient struct {
 	client *elasticsearch.Client
 }
 
-func NewElasticsearch(c *Config) *ElasticClient {
-	var (
-		err error
-		es  *elasticsearch.Client
-	)
-	cfg := elasticsearch.Config{
+// NewElasticsearch returns a client of the cluster, it doesn't connect yet.
+func NewElasticsearch(c *Config) (*ElasticClient, error) {
+	es, err := elasticsearch.NewClient(elasticsearch.Config{
 		Addresses: c.Addresses,
-	}
-	es, err = elasticsearch.NewClient(cfg)
+	})
 	if err != nil {
-		log.Fatalf("Error creating the client: %s", err)
+		return nil, errors.Wrap(err, "es: new client")
 	}
 	return &ElasticClient{
 		conf:   c,
 		client: es,
-	}
+	}, nil
 }
 
-func (e *ElasticClient) CreateIndex(index, body string) (res *esapi.Response, err error) {
-	// IndicesCreate
-	req := esapi.IndicesCreateRequest{
-		Index: index,
-		Body:  strings.NewReader(body),
-	}
-	res, err = req.Do(context.Background(), e.client)
+// Client returns the underlying client for the APIs not wrapped here.
+func (e *ElasticClient) Client() *elasticsearch.Client {
+	return e.client
+}
+
+// DocumentResponse is the response of a write of a document.
+type DocumentResponse struct {
+	Index       string `json:"_index"`
+	ID          string `json:"_id"`
+	Version     int64  `json:"_version"`
+	Result      string `json:"result"` // created, updated, deleted or noop.
+	SeqNo       int64  `json:"_seq_no"`
+	PrimaryTerm int64  `json:"_primary_term"`
+}
+
+// ByQueryResponse is the response of an update or a delete by query.
+type ByQueryResponse struct {
+	Took             int64             `json:"took"`
+	TimedOut         bool              `json:"timed_out"`
+	Total            int64             `json:"total"`
+	Updated          int64             `json:"updated"`
+	Deleted          int64             `json:"deleted"`
+	Batches          int64             `json:"batches"`
+	VersionConflicts int64             `json:"version_conflicts"`
+	Noops            int64             `json:"noops"`
+	Failures         []json.RawMessage `json:"failures"`
+	// Task is the id of the task when wait_for_completion is false.
+	Task string `json:"task"`
+}
+
+// do performs req, decodes the response into v when it isn't nil and
+// returns an *Error for the error responses.
+func (e *ElasticClient) do(c context.Context, req esapi.Request, v interface{}) (err error) {
+	res, err := req.Do(c, e.client)
 	if err != nil {
-		log.Errorf("CreateIndex error %v", err)
-		return
+		return errors.WithStack(err)
 	}
 	defer res.Body.Close()
-	return
+	if res.IsError() {
+		return errors.WithStack(parseError(res))
+	}
+	if v == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+		return errors.WithStack(err)
+	}
+	return errors.Wrap(json.NewDecoder(res.Body).Decode(v), "es: decode response")
+}
+
+// reader returns the request body of v: strings, bytes and readers are sent
+// as is and the other values are encoded in json.
+func reader(v interface{}) (r io.Reader, err error) {
+	switch b := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.NewReader(b), nil
+	case []byte:
+		return bytes.NewReader(b), nil
+	case io.Reader:
+		return b, nil
+	}
+	buf := new(bytes.Buffer)
+	if err = json.NewEncoder(buf).Encode(v); err != nil {
+		return nil, errors.Wrap(err, "es: encode body")
+	}
+	return buf, nil
 }
 
-func (e *ElasticClient) DeleteIndex(index []string) (res *esapi.Response, err error) {
-	req := esapi.IndicesDeleteRequest{Index: index}
-	res, err = req.Do(context.Background(), e.client)
+// CreateIndex creates the index with body holding its settings and mappings.
+func (e *ElasticClient) CreateIndex(c context.Context, index string, body interface{}) (err error) {
+	r, err := reader(body)
 	if err != nil {
-		log.Errorf("DeleteIndex error %v", err)
 		return
 	}
-	defer res.Body.Close()
-	fmt.Println(res.String())
-	return
+	return e.do(c, esapi.IndicesCreateRequest{Index: index, Body: r}, nil)
 }
 
-func (e *ElasticClient) CreateDocument(index, docID, body string) (err error) {
-	req := esapi.IndexRequest{
-		Index:      index,
-		DocumentID: docID,
-		Body:       strings.NewReader(body),
-		Refresh:    "true",
-	}
+// DeleteIndex deletes the indices.
+func (e *ElasticClient) DeleteIndex(c context.Context, index ...string) (err error) {
+	return e.do(c, esapi.IndicesDeleteRequest{Index: index}, nil)
+}
 
-	// Perform the request with the client.
-	res, err := req.Do(context.Background(), e.client)
+// CreateDocument indexes doc with the id and refreshes the index, an empty
+// id lets elasticsearch generate one.
+func (e *ElasticClient) CreateDocument(c context.Context, index, docID string, doc interface{}) (res *DocumentResponse, err error) {
+	r, err := reader(doc)
 	if err != nil {
-		log.Errorf("Error getting response: %s", err)
+		return
 	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		log.Errorf("[%s] Error indexing document ID=%s", res.Status(), docID)
-	} else {
-		// Deserialize the response into a map.
-		var r map[string]interface{}
-		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-			log.Infof("Error parsing the response body: %s", err)
-		} else {
-			// Print the response status and indexed document version.
-			log.Infof("[%s] %s; version=%d", res.Status(), r["result"], int(r["_version"].(float64)))
-		}
+	res = new(DocumentResponse)
+	if err = e.do(c, esapi.IndexRequest{Index: index, DocumentID: docID, Body: r, Refresh: "true"}, res); err != nil {
+		return nil, err
 	}
 	return
 }
 
-func (e *ElasticClient) UpdateDocumentByID(index, docID, body string) (err error) {
-	req := esapi.UpdateRequest{Index: index, DocumentID: docID, Body: strings.NewReader(body)}
-	res, err := req.Do(context.Background(), e.client)
+// UpdateDocumentByID updates the document with body, such as
+// {"doc": {...}} or {"script": {...}}.
+func (e *ElasticClient) UpdateDocumentByID(c context.Context, index, docID string, body interface{}) (res *DocumentResponse, err error) {
+	r, err := reader(body)
 	if err != nil {
-		log.Errorf("UpdateDocumentByID error %v", err)
 		return
 	}
-	defer res.Body.Close()
-	log.Infof("UpdateDocumentByID response %v ", res.String())
+	res = new(DocumentResponse)
+	if err = e.do(c, esapi.UpdateRequest{Index: index, DocumentID: docID, Body: r}, res); err != nil {
+		return nil, err
+	}
 	return
 }
 
-func (e *ElasticClient) UpdateDocumentByQurey(body string) (err error) {
-	req := esapi.DeleteByQueryRequest{Index: []string{"test_index"}, Body: strings.NewReader(body)}
-	res, err := req.Do(context.Background(), e.client)
+// GetDocument decodes the source of the document into doc, the error
+// satisfies IsNotFound when there is none.
+func (e *ElasticClient) GetDocument(c context.Context, index, docID string, doc interface{}) (err error) {
+	res := struct {
+		Source interface{} `json:"_source"`
+	}{Source: doc}
+	return e.do(c, esapi.GetRequest{Index: index, DocumentID: docID}, &res)
+}
+
+// UpdateByQuery updates the documents of the indices matching the query of
+// body with its script. o sets the other parameters of the request, such as
+// Conflicts or WaitForCompletion.
+func (e *ElasticClient) UpdateByQuery(c context.Context, index []string, body interface{}, o ...func(*esapi.UpdateByQueryRequest)) (res *ByQueryResponse, err error) {
+	r, err := reader(body)
 	if err != nil {
-		log.Errorf("UpdateDocumentByQurey error %v", err)
 		return
 	}
-	defer res.Body.Close()
-	log.Infof("UpdateDocumentByQurey response %v ", res.String())
+	req := esapi.UpdateByQueryRequest{Index: index, Body: r}
+	for _, f := range o {
+		f(&req)
+	}
+	res = new(ByQueryResponse)
+	if err = e.do(c, req, res); err != nil {
+		return nil, err
+	}
 	return
 }
 
-// Qurey query from es .
-func (e *ElasticClient) Qurey(index string, query map[string]interface{}, res interface{}) (err error) {
-	var (
-		buf  bytes.Buffer
-		resp *esapi.Response
-	)
-	if err = json.NewEncoder(&buf).Encode(query); err != nil {
-		log.Errorf("Error encoding query: %v", err)
+// DeleteByQuery deletes the documents of the indices matching the query of
+// body. o sets the other parameters of the request.
+func (e *ElasticClient) DeleteByQuery(c context.Context, index []string, body interface{}, o ...func(*esapi.DeleteByQueryRequest)) (res *ByQueryResponse, err error) {
+	r, err := reader(body)
+	if err != nil {
 		return
 	}
+	req := esapi.DeleteByQueryRequest{Index: index, Body: r}
+	for _, f := range o {
+		f(&req)
+	}
+	res = new(ByQueryResponse)
+	if err = e.do(c, req, res); err != nil {
+		return nil, err
+	}
+	return
+}
 
-	// Perform the search request.
-	resp, err = e.client.Search(
-		e.client.Search.WithContext(context.Background()),
-		e.client.Search.WithIndex(index),
-		e.client.Search.WithBody(&buf),
-		e.client.Search.WithTrackTotalHits(true),
-		e.client.Search.WithPretty(),
-	)
+// Query searches the index with query and decodes the response into res.
+func (e *ElasticClient) Query(c context.Context, index string, query interface{}, res interface{}) (err error) {
+	r, err := reader(query)
 	if err != nil {
-		log.Errorf("Error getting response: %v", err)
 		return
 	}
-	defer resp.Body.Close()
+	return e.do(c, esapi.SearchRequest{Index: []string{index}, Body: r, TrackTotalHits: true}, res)
+}
 
-	if resp.IsError() {
-		var tmpMap map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&tmpMap); err != nil {
-			log.Errorf("Error parsing the response body: %s", err)
-		} else {
-			// Print the response status and error information.
-			log.Errorf("[%s] %s: %s",
-				resp.Status(),
-				tmpMap["error"].(map[string]interface{})["type"],
-				tmpMap["error"].(map[string]interface{})["reason"],
-			)
-		}
-	}
+// Qurey query from es .
+//
+// Deprecated: use Query, which takes a context.
+func (e *ElasticClient) Qurey(index string, query map[string]interface{}, res interface{}) (err error) {
+	return e.Query(context.Background(), index, query, res)
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		log.Errorf("Error parsing the response body: %s", err)
-	}
+// UpdateDocumentByQurey deletes, despite its name, the documents of
+// test_index matching the query of body.
+//
+// Deprecated: use UpdateByQuery or DeleteByQuery, which take the indices.
+func (e *ElasticClient) UpdateDocumentByQurey(body string) (err error) {
+	_, err = e.DeleteByQuery(context.Background(), []string{"test_index"}, body)
 	return
 }
@@ -0,0 +1,113 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/ecode"
+)
+
+// Error is an error response of elasticsearch.
+type Error struct {
+	Status int    // http status of the response.
+	Type   string // error type, such as index_not_found_exception.
+	Reason string
+	// RootCause is the type of the first root cause when it differs from Type.
+	RootCause string
+}
+
+func (e *Error) Error() string {
+	if e.RootCause != "" {
+		return fmt.Sprintf("es: [%d] %s: %s (root cause %s)", e.Status, e.Type, e.Reason, e.RootCause)
+	}
+	return fmt.Sprintf("es: [%d] %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// parseError reads the error of res, the body is either an error object or,
+// such as for a missing document, any other document.
+func parseError(res *esapi.Response) *Error {
+	e := &Error{Status: res.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(b, &body) == nil && len(body.Error) > 0 {
+		var cause struct {
+			Type      string `json:"type"`
+			Reason    string `json:"reason"`
+			RootCause []struct {
+				Type string `json:"type"`
+			} `json:"root_cause"`
+		}
+		if json.Unmarshal(body.Error, &cause) == nil {
+			e.Type, e.Reason = cause.Type, cause.Reason
+			if len(cause.RootCause) > 0 && cause.RootCause[0].Type != cause.Type {
+				e.RootCause = cause.RootCause[0].Type
+			}
+			return e
+		}
+		// errors of a few endpoints are plain strings.
+		json.Unmarshal(body.Error, &e.Reason)
+		return e
+	}
+	e.Type = strings.ToLower(strings.ReplaceAll(http.StatusText(res.StatusCode), " ", "_"))
+	e.Reason = strings.TrimSpace(string(b))
+	return e
+}
+
+// _statusCodes maps the http status of the error responses to ecode.
+var _statusCodes = map[int]ecode.Code{
+	http.StatusBadRequest:            ecode.RequestErr,
+	http.StatusUnauthorized:          ecode.Unauthorized,
+	http.StatusForbidden:             ecode.AccessDenied,
+	http.StatusNotFound:              ecode.NothingFound,
+	http.StatusConflict:              ecode.Conflict,
+	http.StatusTooManyRequests:       ecode.LimitExceed,
+	http.StatusServiceUnavailable:    ecode.ServiceUnavailable,
+	http.StatusGatewayTimeout:        ecode.Deadline,
+	http.StatusRequestTimeout:        ecode.Deadline,
+	http.StatusRequestEntityTooLarge: ecode.RequestErr,
+}
+
+// Ecode maps err to an ecode: the errors of elasticsearch are mapped by
+// their http status and the others are ecode.ServerErr.
+func Ecode(err error) ecode.Codes {
+	if err == nil {
+		return ecode.OK
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ecode.Deadline
+	}
+	if errors.Is(err, context.Canceled) {
+		return ecode.Canceled
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		return ecode.ServerErr
+	}
+	if code, ok := _statusCodes[e.Status]; ok {
+		return code
+	}
+	return ecode.ServerErr
+}
+
+// IsNotFound reports whether err is a 404 response, such as a missing
+// index or document.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 response, such as a version
+// conflict or an existing document.
+func IsConflict(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusConflict
+}
@@ -1 +1,156 @@
 package es
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/ecode"
+)
+
+// newTestClient returns a client of a fake elasticsearch served by h.
+func newTestClient(t *testing.T, h http.HandlerFunc) *ElasticClient {
+	t.Helper()
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	e, err := NewElasticsearch(&Config{Addresses: []string{s.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestError(t *testing.T) {
+	e := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error":{"root_cause":[{"type":"index_not_found_exception","reason":"no such index [missing]"}],"type":"index_not_found_exception","reason":"no such index [missing]"},"status":404}`)
+		case "/docs/_doc/1":
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"_index":"docs","_id":"1","found":false}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":{"root_cause":[{"type":"parsing_exception","reason":"unknown query"}],"type":"search_phase_execution_exception","reason":"all shards failed"},"status":400}`)
+		}
+	})
+	c := context.Background()
+
+	err := e.DeleteIndex(c, "missing")
+	var ee *Error
+	if !errors.As(err, &ee) || ee.Status != 404 || ee.Type != "index_not_found_exception" || ee.Reason != "no such index [missing]" || ee.RootCause != "" {
+		t.Errorf("DeleteIndex() error = %#v", ee)
+	}
+	if !IsNotFound(err) || Ecode(err) != ecode.NothingFound {
+		t.Errorf("DeleteIndex() error %v should be not found", err)
+	}
+
+	var doc map[string]interface{}
+	if err = e.GetDocument(c, "docs", "1", &doc); !IsNotFound(err) {
+		t.Errorf("GetDocument() error = %v, want not found", err)
+	}
+
+	err = e.Query(c, "docs", map[string]interface{}{"query": map[string]interface{}{"foo": nil}}, &doc)
+	if !errors.As(err, &ee) || ee.Type != "search_phase_execution_exception" || ee.RootCause != "parsing_exception" {
+		t.Errorf("Query() error = %#v", ee)
+	}
+	if Ecode(err) != ecode.RequestErr {
+		t.Errorf("Ecode(%v) = %v, want RequestErr", err, Ecode(err))
+	}
+	if Ecode(context.Canceled) != ecode.Canceled || Ecode(errors.New("x")) != ecode.ServerErr {
+		t.Error("Ecode() of the other errors")
+	}
+}
+
+func TestDocument(t *testing.T) {
+	var body map[string]interface{}
+	e := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/docs/_doc/1":
+			if r.URL.Query().Get("refresh") != "true" {
+				t.Errorf("refresh = %q", r.URL.Query().Get("refresh"))
+			}
+			io.WriteString(w, `{"_index":"docs","_id":"1","_version":1,"result":"created","_seq_no":0,"_primary_term":1}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/docs/_update/1":
+			io.WriteString(w, `{"_index":"docs","_id":"1","_version":2,"result":"updated","_seq_no":1,"_primary_term":1}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/docs/_doc/1":
+			io.WriteString(w, `{"_index":"docs","_id":"1","found":true,"_source":{"title":"tuba"}}`)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+	})
+	c := context.Background()
+
+	res, err := e.CreateDocument(c, "docs", "1", struct {
+		Title string `json:"title"`
+	}{"tuba"})
+	if err != nil || res.Result != "created" || res.Version != 1 || body["title"] != "tuba" {
+		t.Errorf("CreateDocument() = %+v, %v, body %v", res, err, body)
+	}
+	if res, err = e.UpdateDocumentByID(c, "docs", "1", `{"doc":{"title":"horn"}}`); err != nil || res.Result != "updated" || res.SeqNo != 1 {
+		t.Errorf("UpdateDocumentByID() = %+v, %v", res, err)
+	}
+	var doc struct {
+		Title string `json:"title"`
+	}
+	if err = e.GetDocument(c, "docs", "1", &doc); err != nil || doc.Title != "tuba" {
+		t.Errorf("GetDocument() = %+v, %v", doc, err)
+	}
+}
+
+func TestByQuery(t *testing.T) {
+	e := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a,b/_update_by_query":
+			if r.URL.Query().Get("conflicts") != "proceed" {
+				t.Errorf("conflicts = %q", r.URL.Query().Get("conflicts"))
+			}
+			io.WriteString(w, `{"took":12,"timed_out":false,"total":3,"updated":2,"deleted":0,"batches":1,"version_conflicts":1,"noops":0,"failures":[]}`)
+		case "/a/_delete_by_query":
+			io.WriteString(w, `{"task":"node:42"}`)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+	})
+	c := context.Background()
+
+	res, err := e.UpdateByQuery(c, []string{"a", "b"}, `{"query":{"match_all":{}},"script":{"source":"ctx._source.n++"}}`, func(r *esapi.UpdateByQueryRequest) {
+		r.Conflicts = "proceed"
+	})
+	if err != nil || res.Total != 3 || res.Updated != 2 || res.VersionConflicts != 1 {
+		t.Errorf("UpdateByQuery() = %+v, %v", res, err)
+	}
+	res, err = e.DeleteByQuery(c, []string{"a"}, map[string]interface{}{"query": map[string]interface{}{"match_all": struct{}{}}}, func(r *esapi.DeleteByQueryRequest) {
+		wait := false
+		r.WaitForCompletion = &wait
+	})
+	if err != nil || res.Task != "node:42" {
+		t.Errorf("DeleteByQuery() = %+v, %v", res, err)
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	var paths []string
+	e := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		io.WriteString(w, `{"took":1,"total":0,"hits":{"hits":[]}}`)
+	})
+	var res map[string]interface{}
+	if err := e.Qurey("docs", map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}}, &res); err != nil || res["took"] == nil {
+		t.Errorf("Qurey() = %v, %v", res, err)
+	}
+	if err := e.UpdateDocumentByQurey(`{"query":{"match_all":{}}}`); err != nil {
+		t.Errorf("UpdateDocumentByQurey() error = %v", err)
+	}
+	want := []string{"POST /docs/_search", "POST /test_index/_delete_by_query"}
+	if len(paths) != 2 || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("requests %v, want %v", paths, want)
+	}
+}
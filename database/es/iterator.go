@@ -0,0 +1,265 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+const (
+	_iterPageSize   = 1000
+	_iterKeepAlive  = time.Minute
+	_releaseTimeout = 5 * time.Second
+)
+
+// IterConfig is the config of an Iterator.
+type IterConfig struct {
+	PageSize int // hits per request, 1000 by default.
+	// KeepAlive is how long the point in time or the scroll context is kept
+	// between two pages, 1m by default.
+	KeepAlive xtime.Duration
+	// Scroll uses a scroll instead of a point in time, for the clusters
+	// without point in time (before 7.10).
+	Scroll bool
+}
+
+// Iterator streams the hits of a search of any size through a point in time
+// and search_after, or a scroll when the point in time can't be opened. The
+// point in time or the scroll is released once the hits are exhausted, on
+// error and by Close:
+//
+//	it := es.Iterate[Doc](client, source, nil, "docs")
+//	defer it.Close()
+//	for it.Next(c) {
+//		hit := it.Hit()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type Iterator[T any] struct {
+	client *ElasticClient
+	source *SearchSource
+	index  []string
+	conf   *IterConfig
+
+	started  bool
+	scroll   bool
+	pit      string
+	scrollID string
+	total    int64
+	page     []Hit[T]
+	pos      int
+	last     bool // page is the last one.
+	closed   bool
+	err      error
+}
+
+// Iterate returns an iterator of the hits of s in the indices, the search is
+// only sent by the first Next. The from of s is ignored and the hits are in
+// index order when s has no sort.
+func Iterate[T any](e *ElasticClient, s *SearchSource, c *IterConfig, index ...string) *Iterator[T] {
+	if c == nil {
+		c = &IterConfig{}
+	}
+	if c.PageSize <= 0 {
+		c.PageSize = _iterPageSize
+	}
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = xtime.Duration(_iterKeepAlive)
+	}
+	return &Iterator[T]{client: e, source: s.clone(), index: index, conf: c, scroll: c.Scroll, pos: -1}
+}
+
+// Next moves to the next hit, it returns false once the hits are exhausted,
+// on error or when c is done.
+func (it *Iterator[T]) Next(c context.Context) bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+	if it.pos+1 < len(it.page) {
+		it.pos++
+		return true
+	}
+	if it.started && it.last {
+		return false
+	}
+	if it.err = c.Err(); it.err == nil {
+		it.err = it.fetch(c)
+	}
+	if it.err != nil {
+		it.release()
+		return false
+	}
+	if it.last {
+		// the hits of the last page are in memory.
+		it.release()
+	}
+	it.pos = -1
+	return it.Next(c)
+}
+
+// Hit returns the current hit.
+func (it *Iterator[T]) Hit() *Hit[T] {
+	return &it.page[it.pos]
+}
+
+// Total returns the total hits of the search once Next was called, counted
+// as set by TrackTotalHits of the search.
+func (it *Iterator[T]) Total() int64 {
+	return it.total
+}
+
+// Err returns the error that stopped the iteration.
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// Close stops the iteration and releases the point in time or the scroll,
+// it may be called several times.
+func (it *Iterator[T]) Close() error {
+	it.closed = true
+	return it.release()
+}
+
+// release releases the point in time or the scroll, even when the context
+// of Next is done.
+func (it *Iterator[T]) release() (err error) {
+	if it.pit == "" && it.scrollID == "" {
+		return
+	}
+	c, cancel := context.WithTimeout(context.Background(), _releaseTimeout)
+	defer cancel()
+	if it.pit != "" {
+		err = it.client.do(c, esapi.ClosePointInTimeRequest{Body: jsonBody(map[string]string{"id": it.pit})}, nil)
+	} else {
+		err = it.client.do(c, esapi.ClearScrollRequest{Body: jsonBody(map[string][]string{"scroll_id": {it.scrollID}})}, nil)
+	}
+	// a context already expired is gone anyway.
+	if IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		log.Errorf("es iterator release error(%v)", err)
+	}
+	it.pit, it.scrollID = "", ""
+	return
+}
+
+// fetch reads the next page.
+func (it *Iterator[T]) fetch(c context.Context) (err error) {
+	var (
+		raw  json.RawMessage
+		req  esapi.Request
+		size = it.conf.PageSize
+	)
+	switch {
+	case it.scroll && it.started:
+		req = esapi.ScrollRequest{Body: jsonBody(map[string]string{"scroll": it.keepAlive(), "scroll_id": it.scrollID})}
+	case it.scroll:
+		s := it.source.clone().Size(size)
+		s.from = -1
+		if len(s.sort) == 0 {
+			s.Sort("_doc", false)
+		}
+		var body io.Reader
+		if body, err = reader(s); err != nil {
+			return
+		}
+		req = esapi.SearchRequest{Index: it.index, Body: body, Scroll: time.Duration(it.conf.KeepAlive)}
+	default:
+		if !it.started {
+			if err = it.openPIT(c); err != nil {
+				if it.scroll {
+					return it.fetch(c)
+				}
+				return
+			}
+		}
+		s := it.source.clone().Size(size)
+		s.from = -1
+		s.pit = map[string]interface{}{"id": it.pit, "keep_alive": it.keepAlive()}
+		if len(s.sort) == 0 {
+			s.Sort("_shard_doc", false)
+		}
+		if it.started {
+			s.TrackTotalHits(false)
+			if len(it.page) > 0 {
+				s.SearchAfter(it.page[len(it.page)-1].Sort...)
+			}
+		}
+		var body io.Reader
+		if body, err = reader(s); err != nil {
+			return
+		}
+		req = esapi.SearchRequest{Body: body}
+	}
+	if err = it.client.do(c, req, &raw); err != nil {
+		return
+	}
+	var (
+		res = new(SearchResult[T])
+		ids struct {
+			PitID    string `json:"pit_id"`
+			ScrollID string `json:"_scroll_id"`
+		}
+	)
+	if err = json.Unmarshal(raw, res); err == nil {
+		err = json.Unmarshal(raw, &ids)
+	}
+	if err != nil {
+		return errors.Wrap(err, "es: decode response")
+	}
+	if ids.PitID != "" {
+		it.pit = ids.PitID
+	}
+	if ids.ScrollID != "" {
+		it.scrollID = ids.ScrollID
+	}
+	if !it.started {
+		it.total = res.Total
+	}
+	it.started = true
+	it.page = res.Hits
+	it.last = len(res.Hits) < size
+	return
+}
+
+// openPIT opens the point in time, it switches to a scroll when the
+// cluster doesn't support it.
+func (it *Iterator[T]) openPIT(c context.Context) (err error) {
+	var res struct {
+		ID string `json:"id"`
+	}
+	err = it.client.do(c, esapi.OpenPointInTimeRequest{Index: it.index, KeepAlive: it.keepAlive()}, &res)
+	var e *Error
+	if errors.As(err, &e) && e.Type != "index_not_found_exception" &&
+		(e.Status == http.StatusBadRequest || e.Status == http.StatusNotFound || e.Status == http.StatusMethodNotAllowed) {
+		log.Warnf("es iterator point in time unsupported error(%v), fall back to scroll", err)
+		it.scroll = true
+		return err
+	}
+	if err != nil {
+		return
+	}
+	it.pit = res.ID
+	return
+}
+
+func (it *Iterator[T]) keepAlive() string {
+	return strconv.FormatInt(time.Duration(it.conf.KeepAlive).Milliseconds(), 10) + "ms"
+}
+
+// jsonBody returns the body of a request encoding v, a map of strings
+// whose encoding can't fail.
+func jsonBody(v interface{}) io.Reader {
+	r, _ := reader(v)
+	return r
+}
@@ -0,0 +1,158 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// iterServer serves the documents 1 to n through a point in time, or a
+// scroll when pit is false, and records the released contexts.
+type iterServer struct {
+	n        int
+	pit      bool
+	mu       sync.Mutex
+	released []string
+	bodies   []map[string]interface{}
+}
+
+func (s *iterServer) page(w http.ResponseWriter, from, size int, id string) {
+	var hits []string
+	for i := from + 1; i <= from+size && i <= s.n; i++ {
+		hits = append(hits, fmt.Sprintf(`{"_id":"%d","_source":{"title":"doc%d"},"sort":[%d]}`, i, i, i))
+	}
+	fmt.Fprintf(w, `{"took":1,%s,"hits":{"total":{"value":%d,"relation":"eq"},"hits":[%s]}}`, id, s.n, strings.Join(hits, ","))
+}
+
+func (s *iterServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.URL.Path == "/docs/_pit" && s.pit:
+		if r.URL.Query().Get("keep_alive") != "60000ms" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		io.WriteString(w, `{"id":"pit0"}`)
+	case r.URL.Path == "/docs/_pit":
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":{"type":"illegal_argument_exception","reason":"request [/docs/_pit] contains unrecognized parameter: [keep_alive]"},"status":400}`)
+	case r.URL.Path == "/_search":
+		s.bodies = append(s.bodies, body)
+		from := 0
+		if after, ok := body["search_after"].([]interface{}); ok {
+			from = int(after[0].(float64))
+		}
+		pit := body["pit"].(map[string]interface{})
+		s.page(w, from, int(body["size"].(float64)), fmt.Sprintf(`"pit_id":"%s.%d"`, pit["id"], from))
+	case r.URL.Path == "/docs/_search":
+		s.bodies = append(s.bodies, body)
+		s.page(w, 0, int(body["size"].(float64)), `"_scroll_id":"scroll.0"`)
+	case r.Method == http.MethodPost && r.URL.Path == "/_search/scroll":
+		var from int
+		fmt.Sscanf(body["scroll_id"].(string), "scroll.%d", &from)
+		from += 2
+		s.page(w, from, 2, fmt.Sprintf(`"_scroll_id":"scroll.%d"`, from))
+	case r.Method == http.MethodDelete && r.URL.Path == "/_pit":
+		s.released = append(s.released, body["id"].(string))
+	case r.Method == http.MethodDelete && r.URL.Path == "/_search/scroll":
+		s.released = append(s.released, body["scroll_id"].([]interface{})[0].(string))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func iterate(t *testing.T, it *Iterator[testDoc]) (ids []string) {
+	t.Helper()
+	defer it.Close()
+	for it.Next(context.Background()) {
+		h := it.Hit()
+		if h.Source.Title != "doc"+h.ID {
+			t.Errorf("Hit() = %+v", h)
+		}
+		ids = append(ids, h.ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestIteratorPIT(t *testing.T) {
+	s := &iterServer{n: 5, pit: true}
+	e := newTestClient(t, s.ServeHTTP)
+	source := NewSearchSource().Query(MatchAll()).From(10)
+	it := Iterate[testDoc](e, source, &IterConfig{PageSize: 2}, "docs")
+	if ids := iterate(t, it); strings.Join(ids, ",") != "1,2,3,4,5" {
+		t.Errorf("ids = %v", ids)
+	}
+	if it.Total() != 5 {
+		t.Errorf("Total() = %d", it.Total())
+	}
+	if len(s.bodies) != 3 {
+		t.Fatalf("searches = %d, want 3", len(s.bodies))
+	}
+	first, last := s.bodies[0], s.bodies[2]
+	if first["from"] != nil || first["track_total_hits"] != true || first["sort"].([]interface{})[0].(map[string]interface{})["_shard_doc"] == nil {
+		t.Errorf("first search = %v", first)
+	}
+	if last["track_total_hits"] != false || last["pit"].(map[string]interface{})["id"] != "pit0.0.2" {
+		t.Errorf("last search = %v", last)
+	}
+	if strings.Join(s.released, ",") != "pit0.0.2.4" {
+		t.Errorf("released = %v, want the last pit id once", s.released)
+	}
+	if source.from != 10 || source.pit != nil {
+		t.Error("Iterate() changed the search source")
+	}
+}
+
+func TestIteratorScroll(t *testing.T) {
+	s := &iterServer{n: 3}
+	e := newTestClient(t, s.ServeHTTP)
+	it := Iterate[testDoc](e, NewSearchSource(), &IterConfig{PageSize: 2}, "docs")
+	if ids := iterate(t, it); strings.Join(ids, ",") != "1,2,3" {
+		t.Errorf("ids = %v", ids)
+	}
+	if strings.Join(s.released, ",") != "scroll.2" {
+		t.Errorf("released = %v, want the last scroll id once", s.released)
+	}
+}
+
+func TestIteratorCancel(t *testing.T) {
+	s := &iterServer{n: 5, pit: true}
+	e := newTestClient(t, s.ServeHTTP)
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it := Iterate[testDoc](e, NewSearchSource(), &IterConfig{PageSize: 2}, "docs")
+	defer it.Close()
+	n := 0
+	for it.Next(c) {
+		if n++; n == 2 {
+			cancel()
+		}
+	}
+	if n != 2 || it.Err() != context.Canceled {
+		t.Errorf("hits = %d, Err() = %v, want 2 and canceled", n, it.Err())
+	}
+	if strings.Join(s.released, ",") != "pit0.0" {
+		t.Errorf("released = %v", s.released)
+	}
+
+	// Close in the middle of a page releases the point in time too.
+	s.released = nil
+	it = Iterate[testDoc](e, NewSearchSource(), &IterConfig{PageSize: 2}, "docs")
+	if !it.Next(context.Background()) {
+		t.Fatal(it.Err())
+	}
+	it.Close()
+	if it.Next(context.Background()) || strings.Join(s.released, ",") != "pit0.0" {
+		t.Errorf("released = %v after Close()", s.released)
+	}
+}
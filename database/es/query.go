@@ -0,0 +1,470 @@
+package es
+
+import (
+	"encoding/json"
+)
+
+// Query is a clause of the query DSL.
+type Query interface {
+	Source() map[string]interface{}
+}
+
+// Raw is a clause written by hand, such as {"match_phrase": {...}}.
+type Raw map[string]interface{}
+
+// Source implements Query and Aggregation.
+func (q Raw) Source() map[string]interface{} { return q }
+
+// MatchAll matches every document.
+func MatchAll() Query { return Raw{"match_all": map[string]interface{}{}} }
+
+// Term matches the documents whose field is exactly v.
+func Term(field string, v interface{}) Query {
+	return Raw{"term": map[string]interface{}{field: v}}
+}
+
+// Terms matches the documents whose field is one of values.
+func Terms(field string, values ...interface{}) Query {
+	if values == nil {
+		values = []interface{}{}
+	}
+	return Raw{"terms": map[string]interface{}{field: values}}
+}
+
+// Exists matches the documents with a value in field.
+func Exists(field string) Query {
+	return Raw{"exists": map[string]interface{}{"field": field}}
+}
+
+// IDs matches the documents with the ids.
+func IDs(ids ...string) Query {
+	if ids == nil {
+		ids = []string{}
+	}
+	return Raw{"ids": map[string]interface{}{"values": ids}}
+}
+
+// MatchQuery is a full text query of a field.
+type MatchQuery struct {
+	field string
+	body  map[string]interface{}
+}
+
+// Match matches the documents whose analyzed field matches text.
+func Match(field, text string) *MatchQuery {
+	return &MatchQuery{field: field, body: map[string]interface{}{"query": text}}
+}
+
+// Operator is "and" to match all the terms of the text, "or" by default.
+func (q *MatchQuery) Operator(op string) *MatchQuery {
+	q.body["operator"] = op
+	return q
+}
+
+// Fuzziness allows typos in the terms, such as "AUTO".
+func (q *MatchQuery) Fuzziness(f string) *MatchQuery {
+	q.body["fuzziness"] = f
+	return q
+}
+
+// Boost multiplies the score of the clause.
+func (q *MatchQuery) Boost(b float64) *MatchQuery {
+	q.body["boost"] = b
+	return q
+}
+
+// Source implements Query.
+func (q *MatchQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"match": map[string]interface{}{q.field: q.body}}
+}
+
+// MultiMatch matches text in several fields, a field may be boosted as
+// "title^3".
+func MultiMatch(text string, fields ...string) Query {
+	return Raw{"multi_match": map[string]interface{}{"query": text, "fields": fields}}
+}
+
+// RangeQuery matches the documents whose field is within bounds.
+type RangeQuery struct {
+	field string
+	body  map[string]interface{}
+}
+
+// Range returns a range of field without bounds, add them with Gt, Gte,
+// Lt and Lte.
+func Range(field string) *RangeQuery {
+	return &RangeQuery{field: field, body: map[string]interface{}{}}
+}
+
+// Gt is field > v.
+func (q *RangeQuery) Gt(v interface{}) *RangeQuery {
+	q.body["gt"] = v
+	return q
+}
+
+// Gte is field >= v.
+func (q *RangeQuery) Gte(v interface{}) *RangeQuery {
+	q.body["gte"] = v
+	return q
+}
+
+// Lt is field < v.
+func (q *RangeQuery) Lt(v interface{}) *RangeQuery {
+	q.body["lt"] = v
+	return q
+}
+
+// Lte is field <= v.
+func (q *RangeQuery) Lte(v interface{}) *RangeQuery {
+	q.body["lte"] = v
+	return q
+}
+
+// Format is the date format of the bounds, such as "yyyy-MM-dd".
+func (q *RangeQuery) Format(f string) *RangeQuery {
+	q.body["format"] = f
+	return q
+}
+
+// Source implements Query.
+func (q *RangeQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"range": map[string]interface{}{q.field: q.body}}
+}
+
+// BoolQuery combines clauses: the documents match all of Must and Filter,
+// none of MustNot and, when there is no Must or Filter, at least one of
+// Should. Filter and MustNot don't score.
+type BoolQuery struct {
+	must, filter, should, mustNot []Query
+	opts                          map[string]interface{}
+}
+
+// Bool returns an empty bool query, it matches every document.
+func Bool() *BoolQuery { return &BoolQuery{opts: map[string]interface{}{}} }
+
+// Must adds scored clauses that must match.
+func (q *BoolQuery) Must(qs ...Query) *BoolQuery {
+	q.must = append(q.must, qs...)
+	return q
+}
+
+// Filter adds clauses that must match, without scoring.
+func (q *BoolQuery) Filter(qs ...Query) *BoolQuery {
+	q.filter = append(q.filter, qs...)
+	return q
+}
+
+// Should adds clauses that should match, they raise the score.
+func (q *BoolQuery) Should(qs ...Query) *BoolQuery {
+	q.should = append(q.should, qs...)
+	return q
+}
+
+// MustNot adds clauses that must not match.
+func (q *BoolQuery) MustNot(qs ...Query) *BoolQuery {
+	q.mustNot = append(q.mustNot, qs...)
+	return q
+}
+
+// MinimumShouldMatch is the number, or percentage such as "75%", of the
+// Should clauses that must match.
+func (q *BoolQuery) MinimumShouldMatch(v interface{}) *BoolQuery {
+	q.opts["minimum_should_match"] = v
+	return q
+}
+
+// Boost multiplies the score of the clause.
+func (q *BoolQuery) Boost(b float64) *BoolQuery {
+	q.opts["boost"] = b
+	return q
+}
+
+// Source implements Query.
+func (q *BoolQuery) Source() map[string]interface{} {
+	body := make(map[string]interface{}, len(q.opts)+4)
+	for k, v := range q.opts {
+		body[k] = v
+	}
+	for _, c := range []struct {
+		key string
+		qs  []Query
+	}{{"must", q.must}, {"filter", q.filter}, {"should", q.should}, {"must_not", q.mustNot}} {
+		if len(c.qs) > 0 {
+			body[c.key] = sources(c.qs)
+		}
+	}
+	return map[string]interface{}{"bool": body}
+}
+
+func sources(qs []Query) []map[string]interface{} {
+	s := make([]map[string]interface{}, len(qs))
+	for i, q := range qs {
+		s[i] = q.Source()
+	}
+	return s
+}
+
+// NestedQuery matches the documents having a nested object matching a query.
+type NestedQuery struct {
+	path string
+	q    Query
+	opts map[string]interface{}
+}
+
+// Nested matches the documents with an object of the nested field path
+// matching q, the fields of q are prefixed by path.
+func Nested(path string, q Query) *NestedQuery {
+	return &NestedQuery{path: path, q: q, opts: map[string]interface{}{}}
+}
+
+// ScoreMode is how the scores of the matching objects are combined: avg,
+// max, min, sum or none.
+func (q *NestedQuery) ScoreMode(mode string) *NestedQuery {
+	q.opts["score_mode"] = mode
+	return q
+}
+
+// InnerHits returns the matching objects in the inner hits of each hit.
+func (q *NestedQuery) InnerHits() *NestedQuery {
+	q.opts["inner_hits"] = map[string]interface{}{}
+	return q
+}
+
+// Source implements Query.
+func (q *NestedQuery) Source() map[string]interface{} {
+	body := map[string]interface{}{"path": q.path, "query": q.q.Source()}
+	for k, v := range q.opts {
+		body[k] = v
+	}
+	return map[string]interface{}{"nested": body}
+}
+
+// Aggregation is an aggregation of the matching documents.
+type Aggregation interface {
+	Source() map[string]interface{}
+}
+
+// Agg is a metric or bucket aggregation, bucket aggregations may hold sub
+// aggregations computed per bucket.
+type Agg struct {
+	kind string
+	body map[string]interface{}
+	subs map[string]Aggregation
+}
+
+func newAgg(kind string, body map[string]interface{}) *Agg {
+	return &Agg{kind: kind, body: body}
+}
+
+// Set sets an option of the aggregation, such as "min_doc_count".
+func (a *Agg) Set(key string, v interface{}) *Agg {
+	a.body[key] = v
+	return a
+}
+
+// Sub adds a sub aggregation computed per bucket.
+func (a *Agg) Sub(name string, sub Aggregation) *Agg {
+	if a.subs == nil {
+		a.subs = map[string]Aggregation{}
+	}
+	a.subs[name] = sub
+	return a
+}
+
+// Source implements Aggregation.
+func (a *Agg) Source() map[string]interface{} {
+	s := map[string]interface{}{a.kind: a.body}
+	if len(a.subs) > 0 {
+		s["aggs"] = aggSources(a.subs)
+	}
+	return s
+}
+
+func aggSources(aggs map[string]Aggregation) map[string]interface{} {
+	s := make(map[string]interface{}, len(aggs))
+	for name, a := range aggs {
+		s[name] = a.Source()
+	}
+	return s
+}
+
+// TermsAgg buckets the documents by the size most frequent values of field.
+func TermsAgg(field string, size int) *Agg {
+	return newAgg("terms", map[string]interface{}{"field": field, "size": size})
+}
+
+// DateHistogramAgg buckets the documents by a calendar interval of field,
+// such as "1d" or "month".
+func DateHistogramAgg(field, interval string) *Agg {
+	return newAgg("date_histogram", map[string]interface{}{"field": field, "calendar_interval": interval})
+}
+
+// RangeAgg buckets the documents by ranges of field, each range is a map
+// such as {"from": 10, "to": 20}.
+func RangeAgg(field string, ranges ...map[string]interface{}) *Agg {
+	return newAgg("range", map[string]interface{}{"field": field, "ranges": ranges})
+}
+
+// FilterAgg is a single bucket of the documents matching q.
+func FilterAgg(q Query) *Agg { return newAgg("filter", q.Source()) }
+
+// NestedAgg is a single bucket of the objects of the nested field path, for
+// the sub aggregations of their fields.
+func NestedAgg(path string) *Agg {
+	return newAgg("nested", map[string]interface{}{"path": path})
+}
+
+// AvgAgg is the average of field.
+func AvgAgg(field string) *Agg { return metricAgg("avg", field) }
+
+// SumAgg is the sum of field.
+func SumAgg(field string) *Agg { return metricAgg("sum", field) }
+
+// MinAgg is the minimum of field.
+func MinAgg(field string) *Agg { return metricAgg("min", field) }
+
+// MaxAgg is the maximum of field.
+func MaxAgg(field string) *Agg { return metricAgg("max", field) }
+
+// CardinalityAgg is the approximate number of distinct values of field.
+func CardinalityAgg(field string) *Agg { return metricAgg("cardinality", field) }
+
+// ValueCountAgg is the number of values of field.
+func ValueCountAgg(field string) *Agg { return metricAgg("value_count", field) }
+
+func metricAgg(kind, field string) *Agg {
+	return newAgg(kind, map[string]interface{}{"field": field})
+}
+
+// SearchSource is the body of a search request.
+type SearchSource struct {
+	query       Query
+	from, size  int
+	sort        []map[string]interface{}
+	includes    []string
+	highlight   []string
+	aggs        map[string]Aggregation
+	searchAfter []interface{}
+	trackTotal  interface{}
+	pit         map[string]interface{}
+}
+
+// NewSearchSource returns a search of every document counting the total
+// hits exactly, the size of the page is the default of 10 hits.
+func NewSearchSource() *SearchSource {
+	return &SearchSource{from: -1, size: -1, trackTotal: true}
+}
+
+// Query sets the query of the search.
+func (s *SearchSource) Query(q Query) *SearchSource {
+	s.query = q
+	return s
+}
+
+// From is the offset of the first hit.
+func (s *SearchSource) From(n int) *SearchSource {
+	s.from = n
+	return s
+}
+
+// Size is the number of hits.
+func (s *SearchSource) Size(n int) *SearchSource {
+	s.size = n
+	return s
+}
+
+// Sort adds a sort on field, the hits are sorted by score by default.
+func (s *SearchSource) Sort(field string, desc bool) *SearchSource {
+	order := "asc"
+	if desc {
+		order = "desc"
+	}
+	s.sort = append(s.sort, map[string]interface{}{field: map[string]interface{}{"order": order}})
+	return s
+}
+
+// Includes restricts the source of the hits to the fields.
+func (s *SearchSource) Includes(fields ...string) *SearchSource {
+	s.includes = fields
+	return s
+}
+
+// Highlight returns the matching fragments of the fields in the hits.
+func (s *SearchSource) Highlight(fields ...string) *SearchSource {
+	s.highlight = append(s.highlight, fields...)
+	return s
+}
+
+// Aggregation adds an aggregation of the matching documents.
+func (s *SearchSource) Aggregation(name string, a Aggregation) *SearchSource {
+	if s.aggs == nil {
+		s.aggs = map[string]Aggregation{}
+	}
+	s.aggs[name] = a
+	return s
+}
+
+// SearchAfter returns the hits after the sort values of a previous hit.
+func (s *SearchSource) SearchAfter(values ...interface{}) *SearchSource {
+	s.searchAfter = values
+	return s
+}
+
+// TrackTotalHits is true to count the total hits exactly, false not to count
+// them or a number to count them up to it.
+func (s *SearchSource) TrackTotalHits(v interface{}) *SearchSource {
+	s.trackTotal = v
+	return s
+}
+
+// Source returns the json body of the search.
+func (s *SearchSource) Source() map[string]interface{} {
+	body := map[string]interface{}{}
+	if s.query != nil {
+		body["query"] = s.query.Source()
+	}
+	if s.from >= 0 {
+		body["from"] = s.from
+	}
+	if s.size >= 0 {
+		body["size"] = s.size
+	}
+	if len(s.sort) > 0 {
+		body["sort"] = s.sort
+	}
+	if s.includes != nil {
+		body["_source"] = s.includes
+	}
+	if len(s.highlight) > 0 {
+		fields := make(map[string]interface{}, len(s.highlight))
+		for _, f := range s.highlight {
+			fields[f] = map[string]interface{}{}
+		}
+		body["highlight"] = map[string]interface{}{"fields": fields}
+	}
+	if len(s.aggs) > 0 {
+		body["aggs"] = aggSources(s.aggs)
+	}
+	if s.searchAfter != nil {
+		body["search_after"] = s.searchAfter
+	}
+	if s.trackTotal != nil {
+		body["track_total_hits"] = s.trackTotal
+	}
+	if s.pit != nil {
+		body["pit"] = s.pit
+	}
+	return body
+}
+
+// clone returns a copy of s that can be changed without changing s.
+func (s *SearchSource) clone() *SearchSource {
+	c := *s
+	c.sort = append([]map[string]interface{}(nil), s.sort...)
+	return &c
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s *SearchSource) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Source())
+}
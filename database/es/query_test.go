@@ -0,0 +1,68 @@
+package es
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSearchSource(t *testing.T) {
+	s := NewSearchSource().
+		Query(Bool().
+			Must(Match("title", "tuba horn").Operator("and")).
+			Filter(Term("status", 1), Range("ctime").Gte("2024-01-01").Lt("2025-01-01").Format("yyyy-MM-dd")).
+			Should(Terms("tags", "brass", "wind"), Nested("comments", Term("comments.author", "quan")).ScoreMode("max")).
+			MustNot(Exists("deleted_at")).
+			MinimumShouldMatch(1)).
+		From(20).Size(10).
+		Sort("ctime", true).Sort("_id", false).
+		Includes("title", "ctime").
+		Highlight("title").
+		Aggregation("tags", TermsAgg("tags", 5).Sub("avg_price", AvgAgg("price"))).
+		Aggregation("comments", NestedAgg("comments").Sub("authors", CardinalityAgg("comments.author")))
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+		"_source": ["title", "ctime"],
+		"aggs": {
+			"comments": {"aggs": {"authors": {"cardinality": {"field": "comments.author"}}}, "nested": {"path": "comments"}},
+			"tags": {"aggs": {"avg_price": {"avg": {"field": "price"}}}, "terms": {"field": "tags", "size": 5}}
+		},
+		"from": 20,
+		"highlight": {"fields": {"title": {}}},
+		"query": {"bool": {
+			"filter": [
+				{"term": {"status": 1}},
+				{"range": {"ctime": {"format": "yyyy-MM-dd", "gte": "2024-01-01", "lt": "2025-01-01"}}}
+			],
+			"minimum_should_match": 1,
+			"must": [{"match": {"title": {"operator": "and", "query": "tuba horn"}}}],
+			"must_not": [{"exists": {"field": "deleted_at"}}],
+			"should": [
+				{"terms": {"tags": ["brass", "wind"]}},
+				{"nested": {"path": "comments", "query": {"term": {"comments.author": "quan"}}, "score_mode": "max"}}
+			]
+		}},
+		"size": 10,
+		"sort": [{"ctime": {"order": "desc"}}, {"_id": {"order": "asc"}}],
+		"track_total_hits": true
+	}`
+	if got := compact(t, string(b)); got != compact(t, want) {
+		t.Errorf("Source() = %s\nwant %s", got, compact(t, want))
+	}
+	if b, _ = json.Marshal(NewSearchSource().TrackTotalHits(false)); string(b) != `{"track_total_hits":false}` {
+		t.Errorf("Source() = %s", b)
+	}
+}
+
+// compact re-encodes the json s with sorted keys and no space.
+func compact(t *testing.T, s string) string {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,411 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+const (
+	_reindexKeep         = 2
+	_reindexPollInterval = time.Second
+)
+
+// TaskStatus is the progress of a reindex task.
+type TaskStatus struct {
+	Completed        bool
+	Total            int64             `json:"total"`
+	Created          int64             `json:"created"`
+	Updated          int64             `json:"updated"`
+	Deleted          int64             `json:"deleted"`
+	Batches          int64             `json:"batches"`
+	VersionConflicts int64             `json:"version_conflicts"`
+	Failures         []json.RawMessage `json:"failures"`
+}
+
+// StartReindex starts a server side reindex of body, such as
+// {"source": {"index": "a"}, "dest": {"index": "b"}}, and returns its task.
+func (e *ElasticClient) StartReindex(c context.Context, body interface{}, o ...func(*esapi.ReindexRequest)) (task string, err error) {
+	r, err := reader(body)
+	if err != nil {
+		return
+	}
+	wait := false
+	req := esapi.ReindexRequest{Body: r, WaitForCompletion: &wait}
+	for _, f := range o {
+		f(&req)
+	}
+	var res struct {
+		Task string `json:"task"`
+	}
+	if err = e.do(c, req, &res); err != nil {
+		return
+	}
+	return res.Task, nil
+}
+
+// TaskStatus returns the progress of the task.
+func (e *ElasticClient) TaskStatus(c context.Context, task string) (st *TaskStatus, err error) {
+	var res struct {
+		Completed bool `json:"completed"`
+		Task      struct {
+			Status TaskStatus `json:"status"`
+		} `json:"task"`
+		Response *TaskStatus `json:"response"`
+		Error    *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	if err = e.do(c, esapi.TasksGetRequest{TaskID: task}, &res); err != nil {
+		return
+	}
+	if res.Error != nil {
+		return nil, errors.WithStack(&Error{Status: http.StatusInternalServerError, Type: res.Error.Type, Reason: res.Error.Reason})
+	}
+	st = &res.Task.Status
+	if res.Response != nil {
+		st = res.Response
+	}
+	st.Completed = res.Completed
+	return
+}
+
+// WaitTask polls the task every interval until it completes. The task is
+// cancelled when c is done, and the failures of a completed task are an
+// error.
+func (e *ElasticClient) WaitTask(c context.Context, task string, interval time.Duration) (st *TaskStatus, err error) {
+	for {
+		if st, err = e.TaskStatus(c, task); err != nil {
+			break
+		}
+		if st.Completed {
+			if len(st.Failures) > 0 {
+				return st, errors.Errorf("es: task %s: %d failures, first %s", task, len(st.Failures), st.Failures[0])
+			}
+			return
+		}
+		log.Infof("es task %s: %d/%d created %d updated %d", task, st.Created+st.Updated+st.Deleted+st.VersionConflicts, st.Total, st.Created, st.Updated)
+		if !sleep(c, interval) {
+			err = c.Err()
+			break
+		}
+	}
+	if c.Err() != nil {
+		cc, cancel := context.WithTimeout(context.Background(), _releaseTimeout)
+		defer cancel()
+		if cerr := e.do(cc, esapi.TasksCancelRequest{TaskID: task}, nil); cerr != nil {
+			log.Errorf("es cancel task %s error(%v)", task, cerr)
+		}
+	}
+	return
+}
+
+// sleep waits for d, it returns false when c is done first.
+func sleep(c context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.Done():
+		return false
+	}
+}
+
+// ReindexConfig is the config of a Reindexer.
+type ReindexConfig struct {
+	// Alias is the read alias, the name searched by the applications. The
+	// versions of the index are named Alias_v1, Alias_v2...
+	Alias string
+	// WriteAlias is the alias the applications write to, Alias_write by
+	// default.
+	WriteAlias string
+	// Template is the settings and mappings of a new version, an index
+	// template matching Alias_v* applies when it is nil.
+	Template interface{}
+	// Keep is the number of versions kept by Cleanup, the current one
+	// included, 2 by default so that Rollback has a version to go back to.
+	Keep int
+	// Slices parallelizes the server side reindex, such as "auto".
+	Slices interface{}
+	// RequestsPerSecond throttles the server side reindex, none by default.
+	RequestsPerSecond int
+	PollInterval      xtime.Duration // poll of the reindex task, 1s by default.
+}
+
+// Reindexer rebuilds an index behind its aliases without downtime: the new
+// version is filled while the searches still read the current one, then
+// both aliases are moved to it in one atomic update.
+//
+// The documents written during the reindex go to the current version, they
+// must be replayed into the new one, by the fill function of Run or after
+// the swap, unless the writes are paused.
+type Reindexer struct {
+	client *ElasticClient
+	conf   *ReindexConfig
+}
+
+// NewReindexer returns the reindexer of the alias.
+func (e *ElasticClient) NewReindexer(c *ReindexConfig) *Reindexer {
+	if c.WriteAlias == "" {
+		c.WriteAlias = c.Alias + "_write"
+	}
+	if c.Keep <= 0 {
+		c.Keep = _reindexKeep
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = xtime.Duration(_reindexPollInterval)
+	}
+	return &Reindexer{client: e, conf: c}
+}
+
+// FillFunc writes the documents of a new version into b, whose items go to
+// the new version by default.
+type FillFunc func(c context.Context, b *BulkIndexer) error
+
+// Run creates a new version, fills it, swaps the aliases to it and cleans
+// up the old versions. The new version is filled by a server side reindex
+// of the current one when fill is nil, and by fill otherwise. It returns
+// the new version, which is deleted when it fails before the swap. When the
+// aliases point to the new version despite an error, or can't be read, the
+// version is kept and returned with the error.
+func (r *Reindexer) Run(c context.Context, fill FillFunc) (index string, err error) {
+	current, err := r.Current(c)
+	if err != nil {
+		return
+	}
+	if index, err = r.CreateVersion(c); err != nil {
+		return
+	}
+	switch {
+	case fill != nil:
+		err = r.Fill(c, index, fill)
+	case current != "":
+		_, err = r.Reindex(c, current, index)
+	}
+	if err == nil {
+		err = r.client.do(c, esapi.IndicesRefreshRequest{Index: []string{index}}, nil)
+	}
+	if err == nil {
+		err = r.Swap(c, index)
+	}
+	if err != nil {
+		cc, cancel := context.WithTimeout(context.Background(), _releaseTimeout)
+		defer cancel()
+		// a swap may fail after elasticsearch applied it, such as on a
+		// timeout, the new version is live then and must be kept.
+		if live, lerr := r.aliased(cc, index); live || lerr != nil {
+			log.Errorf("es reindex %s keep %s after error(%v), aliased:%t error(%v)", r.conf.Alias, index, err, live, lerr)
+			return index, err
+		}
+		if derr := r.client.DeleteIndex(cc, index); derr != nil {
+			log.Errorf("es reindex %s delete %s error(%v)", r.conf.Alias, index, derr)
+		}
+		return "", err
+	}
+	if _, err = r.Cleanup(c); err != nil {
+		log.Errorf("es reindex %s cleanup error(%v)", r.conf.Alias, err)
+		err = nil
+	}
+	return
+}
+
+// aliased reports whether the alias or the write alias points to index.
+func (r *Reindexer) aliased(c context.Context, index string) (bool, error) {
+	for _, a := range []string{r.conf.Alias, r.conf.WriteAlias} {
+		indices, err := r.client.AliasIndices(c, a)
+		if err != nil {
+			return false, err
+		}
+		for _, i := range indices {
+			if i == index {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Versions returns the versions of the index from the oldest.
+func (r *Reindexer) Versions(c context.Context) (indices []string, err error) {
+	var res map[string]interface{}
+	if err = r.client.do(c, esapi.IndicesGetRequest{Index: []string{r.conf.Alias + "_v*"}}, &res); err != nil {
+		return
+	}
+	for index := range res {
+		if r.version(index) > 0 {
+			indices = append(indices, index)
+		}
+	}
+	sort.Slice(indices, func(i, j int) bool { return r.version(indices[i]) < r.version(indices[j]) })
+	return
+}
+
+// version returns the version of the index, 0 when it isn't a version.
+func (r *Reindexer) version(index string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(index, r.conf.Alias+"_v"))
+	if err != nil || !strings.HasPrefix(index, r.conf.Alias+"_v") {
+		return 0
+	}
+	return n
+}
+
+// Current returns the version read through the alias, empty when there is
+// none.
+func (r *Reindexer) Current(c context.Context) (index string, err error) {
+	indices, err := r.client.AliasIndices(c, r.conf.Alias)
+	if err != nil || len(indices) == 0 {
+		return
+	}
+	if len(indices) > 1 {
+		return "", errors.Errorf("es: alias %s points to several indices %v", r.conf.Alias, indices)
+	}
+	return indices[0], nil
+}
+
+// CreateVersion creates the version following the latest one.
+func (r *Reindexer) CreateVersion(c context.Context) (index string, err error) {
+	versions, err := r.Versions(c)
+	if err != nil {
+		return
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = r.version(versions[len(versions)-1]) + 1
+	}
+	index = r.conf.Alias + "_v" + strconv.Itoa(next)
+	if err = r.client.CreateIndex(c, index, r.conf.Template); err != nil {
+		return "", err
+	}
+	return
+}
+
+// Reindex copies the documents of src into dest with a server side reindex
+// and waits for it, the task is cancelled when c is done.
+func (r *Reindexer) Reindex(c context.Context, src, dest string) (st *TaskStatus, err error) {
+	task, err := r.client.StartReindex(c, map[string]interface{}{
+		"conflicts": "proceed",
+		"source":    map[string]interface{}{"index": src},
+		// the external versions keep the documents replayed into dest
+		// meanwhile from being overwritten by older copies.
+		"dest": map[string]interface{}{"index": dest, "version_type": "external"},
+	}, func(req *esapi.ReindexRequest) {
+		req.Slices = r.conf.Slices
+		if r.conf.RequestsPerSecond > 0 {
+			req.RequestsPerSecond = &r.conf.RequestsPerSecond
+		}
+	})
+	if err != nil {
+		return
+	}
+	log.Infof("es reindex %s from %s to %s task %s", r.conf.Alias, src, dest, task)
+	return r.client.WaitTask(c, task, time.Duration(r.conf.PollInterval))
+}
+
+// Fill writes the documents of fill into dest with a bulk indexer, it fails
+// when an item failed.
+func (r *Reindexer) Fill(c context.Context, dest string, fill FillFunc) (err error) {
+	b := r.client.NewBulkIndexer(&BulkConfig{Index: dest})
+	err = fill(c, b)
+	if cerr := b.Close(c); err == nil {
+		err = cerr
+	}
+	if st := b.Stats(); err == nil && st.Failed > 0 {
+		err = errors.Errorf("es: fill %s: %d of %d items failed", dest, st.Failed, st.Added)
+	}
+	return
+}
+
+// Swap moves the read and the write aliases to index in one atomic update.
+func (r *Reindexer) Swap(c context.Context, index string) (err error) {
+	var actions []AliasAction
+	for _, a := range []string{r.conf.Alias, r.conf.WriteAlias} {
+		indices, err := r.client.AliasIndices(c, a)
+		if err != nil {
+			return err
+		}
+		for _, i := range indices {
+			if i != index {
+				actions = append(actions, RemoveAlias(i, a))
+			}
+		}
+	}
+	actions = append(actions, AddAlias(index, r.conf.Alias), AddWriteAlias(index, r.conf.WriteAlias))
+	if err = r.client.UpdateAliases(c, actions...); err != nil {
+		return
+	}
+	log.Infof("es reindex %s aliases swapped to %s", r.conf.Alias, index)
+	return
+}
+
+// Rollback moves the aliases back to the version preceding the current one
+// and returns it. The documents written to the current version since the
+// swap are not in the previous one.
+func (r *Reindexer) Rollback(c context.Context) (index string, err error) {
+	current, err := r.Current(c)
+	if err != nil {
+		return
+	}
+	if current == "" {
+		return "", errors.Errorf("es: alias %s doesn't exist", r.conf.Alias)
+	}
+	versions, err := r.Versions(c)
+	if err != nil {
+		return
+	}
+	for _, v := range versions {
+		if r.version(v) < r.version(current) {
+			index = v
+		}
+	}
+	if index == "" {
+		return "", errors.Errorf("es: alias %s has no version before %s", r.conf.Alias, current)
+	}
+	if err = r.Swap(c, index); err != nil {
+		return "", err
+	}
+	return
+}
+
+// Cleanup deletes the versions older than the Keep latest ones, except the
+// ones an alias points to, and returns them.
+func (r *Reindexer) Cleanup(c context.Context) (deleted []string, err error) {
+	versions, err := r.Versions(c)
+	if err != nil || len(versions) <= r.conf.Keep {
+		return
+	}
+	aliased := map[string]bool{}
+	for _, a := range []string{r.conf.Alias, r.conf.WriteAlias} {
+		indices, err := r.client.AliasIndices(c, a)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range indices {
+			aliased[i] = true
+		}
+	}
+	for _, v := range versions[:len(versions)-r.conf.Keep] {
+		if !aliased[v] {
+			deleted = append(deleted, v)
+		}
+	}
+	if len(deleted) == 0 {
+		return
+	}
+	if err = r.client.DeleteIndex(c, deleted...); err != nil {
+		return nil, err
+	}
+	log.Infof("es reindex %s deleted %v", r.conf.Alias, deleted)
+	return
+}
@@ -0,0 +1,248 @@
+package es
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// aliasServer is a fake cluster keeping the indices and their aliases, its
+// reindex tasks complete at the second poll and fail when failTask is set.
+type aliasServer struct {
+	mu       sync.Mutex
+	indices  map[string]map[string]bool // index -> alias -> is write index
+	reindex  []map[string]interface{}
+	polls    int
+	failTask bool
+	// failAliases applies the alias actions but replies with an error.
+	failAliases bool
+	bulk        int
+}
+
+func newAliasServer(indices ...string) *aliasServer {
+	s := &aliasServer{indices: map[string]map[string]bool{}}
+	for _, i := range indices {
+		s.indices[i] = map[string]bool{}
+	}
+	return s
+}
+
+// aliases returns the indices of the alias.
+func (s *aliasServer) aliases(alias string) (indices []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, as := range s.indices {
+		if _, ok := as[alias]; ok {
+			indices = append(indices, i)
+		}
+	}
+	sort.Strings(indices)
+	return
+}
+
+func (s *aliasServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPost && p == "_aliases":
+		var body struct {
+			Actions []map[string]struct {
+				Index        string `json:"index"`
+				Alias        string `json:"alias"`
+				IsWriteIndex bool   `json:"is_write_index"`
+			} `json:"actions"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, a := range body.Actions {
+			for op, v := range a {
+				if s.indices[v.Index] == nil {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if op == "add" {
+					s.indices[v.Index][v.Alias] = v.IsWriteIndex
+				} else {
+					delete(s.indices[v.Index], v.Alias)
+				}
+			}
+		}
+		if s.failAliases {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		io.WriteString(w, `{"acknowledged":true}`)
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "_alias/"):
+		res := map[string]interface{}{}
+		for i, as := range s.indices {
+			if _, ok := as[strings.TrimPrefix(p, "_alias/")]; ok {
+				res[i] = map[string]interface{}{}
+			}
+		}
+		if len(res) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		json.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPost && p == "_reindex":
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.reindex = append(s.reindex, body)
+		s.polls = 0
+		io.WriteString(w, `{"task":"node:1"}`)
+	case r.Method == http.MethodGet && p == "_tasks/node:1":
+		if s.polls++; s.polls == 1 {
+			io.WriteString(w, `{"completed":false,"task":{"status":{"total":10,"created":4}}}`)
+		} else if s.failTask {
+			io.WriteString(w, `{"completed":true,"task":{"status":{}},"response":{"total":10,"created":9,"failures":[{"id":"7","cause":{"type":"mapper_parsing_exception"}}]}}`)
+		} else {
+			io.WriteString(w, `{"completed":true,"task":{"status":{}},"response":{"total":10,"created":10,"failures":[]}}`)
+		}
+	case r.Method == http.MethodPost && p == "_bulk":
+		var items []string
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			s.bulk++
+			items = append(items, `{"index":{"status":201}}`)
+			sc.Scan()
+		}
+		fmt.Fprintf(w, `{"items":[%s]}`, strings.Join(items, ","))
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/_refresh"):
+		io.WriteString(w, `{}`)
+	case r.Method == http.MethodPut:
+		s.indices[p] = map[string]bool{}
+		io.WriteString(w, `{"acknowledged":true}`)
+	case r.Method == http.MethodDelete:
+		for _, i := range strings.Split(p, ",") {
+			delete(s.indices, i)
+		}
+		io.WriteString(w, `{"acknowledged":true}`)
+	case r.Method == http.MethodGet:
+		res := map[string]interface{}{}
+		for i := range s.indices {
+			if ok, _ := path.Match(p, i); ok {
+				res[i] = map[string]interface{}{}
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestReindexer(t *testing.T) {
+	s := newAliasServer("products_v10_old")
+	e := newTestClient(t, s.ServeHTTP)
+	r := e.NewReindexer(&ReindexConfig{Alias: "products", Template: map[string]interface{}{"mappings": map[string]interface{}{}}, PollInterval: 1})
+	c := context.Background()
+
+	// the first run only creates a version, there is nothing to copy.
+	index, err := r.Run(c, nil)
+	if err != nil || index != "products_v1" || len(s.reindex) != 0 {
+		t.Fatalf("Run() = %s, %v, reindex %v", index, err, s.reindex)
+	}
+	if index, err = r.Run(c, nil); err != nil || index != "products_v2" {
+		t.Fatalf("Run() = %s, %v", index, err)
+	}
+	src := s.reindex[0]["source"].(map[string]interface{})["index"]
+	dest := s.reindex[0]["dest"].(map[string]interface{})["index"]
+	if src != "products_v1" || dest != "products_v2" {
+		t.Errorf("reindex %v", s.reindex[0])
+	}
+	if got := s.aliases("products"); strings.Join(got, ",") != "products_v2" {
+		t.Errorf("products -> %v", got)
+	}
+	if got := s.aliases("products_write"); strings.Join(got, ",") != "products_v2" || !s.indices["products_v2"]["products_write"] {
+		t.Errorf("products_write -> %v, want the write index products_v2", got)
+	}
+
+	// a third version deletes the first one, two are kept.
+	if index, err = r.Run(c, nil); err != nil || index != "products_v3" {
+		t.Fatalf("Run() = %s, %v", index, err)
+	}
+	if versions, _ := r.Versions(c); strings.Join(versions, ",") != "products_v2,products_v3" {
+		t.Errorf("Versions() = %v", versions)
+	}
+	if _, ok := s.indices["products_v10_old"]; !ok {
+		t.Error("Cleanup() deleted an index which isn't a version")
+	}
+
+	if index, err = r.Rollback(c); err != nil || index != "products_v2" {
+		t.Fatalf("Rollback() = %s, %v", index, err)
+	}
+	if got := s.aliases("products_write"); strings.Join(got, ",") != "products_v2" {
+		t.Errorf("products_write -> %v after Rollback()", got)
+	}
+	if _, err = r.Rollback(c); err == nil {
+		t.Error("Rollback() without a previous version should fail")
+	}
+}
+
+func TestReindexerFailure(t *testing.T) {
+	s := newAliasServer()
+	e := newTestClient(t, s.ServeHTTP)
+	r := e.NewReindexer(&ReindexConfig{Alias: "products", PollInterval: 1})
+	c := context.Background()
+	if _, err := r.Run(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.failTask = true
+	if index, err := r.Run(c, nil); err == nil || index != "" {
+		t.Fatalf("Run() = %s, %v, want an error", index, err)
+	}
+	if _, ok := s.indices["products_v2"]; ok {
+		t.Error("the failed version wasn't deleted")
+	}
+	if got := s.aliases("products"); strings.Join(got, ",") != "products_v1" {
+		t.Errorf("products -> %v after a failed run", got)
+	}
+}
+
+func TestReindexerFill(t *testing.T) {
+	s := newAliasServer()
+	e := newTestClient(t, s.ServeHTTP)
+	r := e.NewReindexer(&ReindexConfig{Alias: "products", WriteAlias: "products_w"})
+	index, err := r.Run(context.Background(), func(c context.Context, b *BulkIndexer) error {
+		for i := 0; i < 3; i++ {
+			if err := b.Add(c, &BulkItem{Body: map[string]int{"n": i}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || index != "products_v1" || s.bulk != 3 || len(s.reindex) != 0 {
+		t.Fatalf("Run() = %s, %v, %d items", index, err, s.bulk)
+	}
+	if got := s.aliases("products_w"); strings.Join(got, ",") != "products_v1" {
+		t.Errorf("products_w -> %v", got)
+	}
+}
+
+func TestReindexerSwapFailure(t *testing.T) {
+	s := newAliasServer()
+	e := newTestClient(t, s.ServeHTTP)
+	r := e.NewReindexer(&ReindexConfig{Alias: "products", PollInterval: 1})
+	c := context.Background()
+	if _, err := r.Run(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the swap times out after the aliases were moved.
+	s.failAliases = true
+	index, err := r.Run(c, nil)
+	if err == nil || index != "products_v2" {
+		t.Fatalf("Run() = %s, %v, want products_v2 and an error", index, err)
+	}
+	if _, ok := s.indices["products_v2"]; !ok {
+		t.Error("the live version was deleted")
+	}
+	if got := s.aliases("products"); strings.Join(got, ",") != "products_v2" {
+		t.Errorf("products -> %v", got)
+	}
+}
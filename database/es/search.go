@@ -0,0 +1,154 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/pkg/errors"
+)
+
+// Hit is a matching document whose source decodes into T.
+type Hit[T any] struct {
+	Index     string              `json:"_index"`
+	ID        string              `json:"_id"`
+	Score     float64             `json:"_score"` // 0 when sorted by another field.
+	Source    T                   `json:"_source"`
+	Highlight map[string][]string `json:"highlight"`
+	Sort      []interface{}       `json:"sort"` // sort values, for SearchAfter.
+}
+
+// SearchResult is the result of a search.
+type SearchResult[T any] struct {
+	Took     int64 `json:"took"`
+	TimedOut bool  `json:"timed_out"`
+	// Total is the number of matching documents, a lower bound when
+	// TotalRelation is "gte".
+	Total         int64        `json:"total"`
+	TotalRelation string       `json:"total_relation"`
+	MaxScore      float64      `json:"max_score"`
+	Hits          []Hit[T]     `json:"hits"`
+	Aggregations  Aggregations `json:"aggregations"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *SearchResult[T]) UnmarshalJSON(b []byte) error {
+	type result SearchResult[T]
+	var res struct {
+		*result
+		Hits struct {
+			Total struct {
+				Value    int64  `json:"value"`
+				Relation string `json:"relation"`
+			} `json:"total"`
+			MaxScore float64  `json:"max_score"`
+			Hits     []Hit[T] `json:"hits"`
+		} `json:"hits"`
+	}
+	res.result = (*result)(r)
+	if err := json.Unmarshal(b, &res); err != nil {
+		return err
+	}
+	r.Total, r.TotalRelation = res.Hits.Total.Value, res.Hits.Total.Relation
+	r.MaxScore, r.Hits = res.Hits.MaxScore, res.Hits.Hits
+	if r.Hits == nil {
+		r.Hits = []Hit[T]{}
+	}
+	return nil
+}
+
+// Search searches the indices, all of them when there is none, and decodes
+// the source of the hits into T.
+func Search[T any](c context.Context, e *ElasticClient, s *SearchSource, index ...string) (res *SearchResult[T], err error) {
+	r, err := reader(s)
+	if err != nil {
+		return
+	}
+	res = new(SearchResult[T])
+	if err = e.do(c, esapi.SearchRequest{Index: index, Body: r}, res); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Aggregations are the results of the aggregations by name.
+type Aggregations map[string]json.RawMessage
+
+// Decode decodes the result of the aggregation into v.
+func (a Aggregations) Decode(name string, v interface{}) error {
+	raw, ok := a[name]
+	if !ok {
+		return errors.Errorf("es: no aggregation %s", name)
+	}
+	return errors.Wrapf(json.Unmarshal(raw, v), "es: decode aggregation %s", name)
+}
+
+// Value returns the value of a metric aggregation, ok is false when it has
+// none such as the average of no document.
+func (a Aggregations) Value(name string) (v float64, ok bool, err error) {
+	var res struct {
+		Value *float64 `json:"value"`
+	}
+	if err = a.Decode(name, &res); err != nil || res.Value == nil {
+		return
+	}
+	return *res.Value, true, nil
+}
+
+// Buckets returns the buckets of a multi bucket aggregation such as terms.
+func (a Aggregations) Buckets(name string) (buckets []*Bucket, err error) {
+	var res struct {
+		Buckets []*Bucket `json:"buckets"`
+	}
+	if err = a.Decode(name, &res); err != nil {
+		return
+	}
+	return res.Buckets, nil
+}
+
+// Bucket returns the bucket of a single bucket aggregation such as filter
+// or nested.
+func (a Aggregations) Bucket(name string) (b *Bucket, err error) {
+	b = new(Bucket)
+	if err = a.Decode(name, b); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Bucket is a bucket of documents with the results of its sub aggregations.
+type Bucket struct {
+	Key          interface{} // a string or a number, the epoch millis of a date.
+	KeyAsString  string      // formatted key of the dates.
+	DocCount     int64
+	Aggregations Aggregations
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *Bucket) UnmarshalJSON(data []byte) (err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+	b.Aggregations = Aggregations{}
+	for k, v := range fields {
+		switch k {
+		case "key":
+			err = json.Unmarshal(v, &b.Key)
+		case "key_as_string":
+			err = json.Unmarshal(v, &b.KeyAsString)
+		case "doc_count":
+			err = json.Unmarshal(v, &b.DocCount)
+		case "doc_count_error_upper_bound", "from", "to", "from_as_string", "to_as_string":
+		default:
+			// the other objects are the sub aggregations.
+			if len(v) > 0 && v[0] == '{' {
+				b.Aggregations[k] = v
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
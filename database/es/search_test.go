@@ -0,0 +1,80 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+type testDoc struct {
+	Title string  `json:"title"`
+	Price float64 `json:"price"`
+}
+
+func TestSearch(t *testing.T) {
+	e := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a,b/_search" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["size"] != float64(2) {
+			t.Errorf("body = %v", body)
+		}
+		io.WriteString(w, `{
+			"took": 3, "timed_out": false,
+			"hits": {
+				"total": {"value": 10000, "relation": "gte"},
+				"max_score": 1.5,
+				"hits": [
+					{"_index": "a", "_id": "1", "_score": 1.5, "_source": {"title": "tuba", "price": 10}, "highlight": {"title": ["<em>tuba</em>"]}},
+					{"_index": "b", "_id": "2", "_score": null, "_source": {"title": "horn", "price": 20}, "sort": [1700000000000, "2"]}
+				]
+			},
+			"aggregations": {
+				"tags": {"doc_count_error_upper_bound": 0, "sum_other_doc_count": 0, "buckets": [
+					{"key": "brass", "doc_count": 7, "avg_price": {"value": 12.5}},
+					{"key": "wind", "doc_count": 3, "avg_price": {"value": null}}
+				]},
+				"comments": {"doc_count": 42, "authors": {"value": 5}},
+				"max_price": {"value": 20}
+			}
+		}`)
+	})
+	res, err := Search[testDoc](context.Background(), e, NewSearchSource().Size(2), "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Took != 3 || res.Total != 10000 || res.TotalRelation != "gte" || res.MaxScore != 1.5 || len(res.Hits) != 2 {
+		t.Fatalf("Search() = %+v", res)
+	}
+	if h := res.Hits[0]; h.ID != "1" || h.Score != 1.5 || h.Source.Title != "tuba" || h.Highlight["title"][0] != "<em>tuba</em>" {
+		t.Errorf("Hits[0] = %+v", h)
+	}
+	if h := res.Hits[1]; h.Index != "b" || h.Source.Price != 20 || len(h.Sort) != 2 {
+		t.Errorf("Hits[1] = %+v", h)
+	}
+
+	buckets, err := res.Aggregations.Buckets("tags")
+	if err != nil || len(buckets) != 2 || buckets[0].Key != "brass" || buckets[0].DocCount != 7 {
+		t.Fatalf("Buckets(tags) = %+v, %v", buckets, err)
+	}
+	if v, ok, err := buckets[0].Aggregations.Value("avg_price"); v != 12.5 || !ok || err != nil {
+		t.Errorf("Value(avg_price) = %v, %v, %v", v, ok, err)
+	}
+	if _, ok, err := buckets[1].Aggregations.Value("avg_price"); ok || err != nil {
+		t.Errorf("Value(avg_price) of no document = %v, %v", ok, err)
+	}
+	b, err := res.Aggregations.Bucket("comments")
+	if err != nil || b.DocCount != 42 {
+		t.Fatalf("Bucket(comments) = %+v, %v", b, err)
+	}
+	if v, _, _ := b.Aggregations.Value("authors"); v != 5 {
+		t.Errorf("Value(authors) = %v", v)
+	}
+	if _, err = res.Aggregations.Buckets("missing"); err == nil {
+		t.Error("Buckets() of a missing aggregation should fail")
+	}
+}
@@ -2,56 +2,242 @@ package mongo
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strconv"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/quan-xie/tuba/backoff"
+	"github.com/quan-xie/tuba/retry"
 	"github.com/quan-xie/tuba/util/xtime"
-	"go.mongodb.org/mongo-driver/mongo"
 	xmongo "go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readconcern"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+const (
+	_readPreference    = "secondaryPreferred"
+	_zstdLevel         = 3
+	_heartbeatInterval = time.Second
 )
 
 type Config struct {
 	Addrs         []string
 	Username      string
 	Password      string
+	AuthSource    string // database of the user, admin by default.
+	AuthMechanism string // SCRAM-SHA-256, MONGODB-X509..., negotiated by default.
+	AppName       string // reported in the server logs and currentOp.
 	MaxPool       uint64
 	ReplicaSet    string
 	ConnTimeout   xtime.Duration
 	MaxIdletime   xtime.Duration
 	SocketTimeout xtime.Duration
+	// HeartbeatInterval between the checks of the servers, 1s by default.
+	HeartbeatInterval xtime.Duration
+	// ReadPreference is one of primary, primaryPreferred, secondary,
+	// secondaryPreferred and nearest, secondaryPreferred by default.
+	ReadPreference string
+	// ReadTagSets restricts the eligible secondaries to the first tag set
+	// matching any of them, such as [{"dc": "east"}, {}].
+	ReadTagSets  []map[string]string
+	MaxStaleness xtime.Duration // skip secondaries lagging more than it, 90s at least.
+	// ReadConcern is one of local, majority, available, linearizable and
+	// snapshot, local by default.
+	ReadConcern string
+	// WriteConcern is the number of acknowledging members, majority or a
+	// tag set name, 1 by default.
+	WriteConcern string
+	// Journal waits for the journal commit of writes, true by default.
+	Journal  *bool
+	WTimeout xtime.Duration // write concern timeout, unbounded by default.
+	// Compressors of the wire protocol in preference order, zstd by default.
+	Compressors []string
+	ZstdLevel   int // 3 by default.
+	TLS         *TLSConfig
+	// SlowLogDuration operations slower than it are logged, 250ms by default.
+	SlowLogDuration xtime.Duration
+	// TranTimeout bounds a transaction including its retries, 2m by default.
+	TranTimeout xtime.Duration
+	TranBackoff xtime.Duration // backoff interval between transaction retries, 10ms by default.
+}
+
+// TLSConfig enables TLS to the servers when set.
+type TLSConfig struct {
+	CAFile   string // PEM file of the CA, the system pool by default.
+	CertFile string // PEM file of the client certificate, for x509 auth.
+	KeyFile  string
+	// InsecureSkipVerify disables the verification of the server certificate.
+	InsecureSkipVerify bool
+}
+
+// Client is a mongo client built from a Config.
+type Client struct {
+	*xmongo.Client
+	conf    *Config
+	retrier retry.Retriable
+}
+
+// NewMongo connects to the servers and pings them.
+func NewMongo(c *Config) (client *Client, err error) {
+	if c == nil {
+		return nil, errors.New("init fail: config is nil")
+	}
+	opts, err := clientOptions(c)
+	if err != nil {
+		return
+	}
+	cli, err := xmongo.Connect(context.Background(), opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo connect")
+	}
+	ctx := context.Background()
+	if c.ConnTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.ConnTimeout))
+		defer cancel()
+	}
+	if err = cli.Ping(ctx, nil); err != nil {
+		cli.Disconnect(context.Background())
+		return nil, errors.Wrap(err, "mongo ping")
+	}
+	tranBackoff := c.TranBackoff
+	if tranBackoff <= 0 {
+		tranBackoff = xtime.Duration(_tranBackoff)
+	}
+	return &Client{
+		Client:  cli,
+		conf:    c,
+		retrier: retry.NewRetrier(backoff.NewConstantBackoff(tranBackoff)),
+	}, nil
 }
 
-func NewMongo(c *Config) (client *xmongo.Client) {
-	var err error
-	clientOptions := options.Client()
-	if c.Username != "" && c.Password != "" {
-		clientOptions.SetAuth(options.Credential{Username: c.Username, Password: c.Password})
+// clientOptions builds the driver options of the config.
+func clientOptions(c *Config) (opts *options.ClientOptions, err error) {
+	opts = options.Client()
+	if c.Username != "" || c.AuthMechanism != "" {
+		opts.SetAuth(options.Credential{
+			AuthMechanism: c.AuthMechanism,
+			AuthSource:    c.AuthSource,
+			Username:      c.Username,
+			Password:      c.Password,
+		})
 	}
 	if c.ReplicaSet != "" {
-		clientOptions.SetReplicaSet(c.ReplicaSet)
-	}
-	clientOptions.SetHosts(c.Addrs)
-	clientOptions.SetConnectTimeout(time.Duration(c.ConnTimeout))
-	clientOptions.SetMaxPoolSize(c.MaxPool)
-	clientOptions.SetCompressors([]string{"zstd"}).SetZstdLevel(3)
-	clientOptions.SetMaxConnIdleTime(time.Duration(c.MaxIdletime))
-	clientOptions.SetSocketTimeout(time.Duration(c.SocketTimeout))
-	clientOptions.SetHeartbeatInterval(time.Second)
-	clientOptions.SetReadPreference(readpref.SecondaryPreferred())
-	clientOptions.SetReadConcern(readconcern.Local())
-	clientOptions.SetWriteConcern(writeconcern.New(writeconcern.W(1), writeconcern.J(true)))
-	client, err = mongo.Connect(context.TODO(), clientOptions)
+		opts.SetReplicaSet(c.ReplicaSet)
+	}
+	if c.AppName != "" {
+		opts.SetAppName(c.AppName)
+	}
+	opts.SetHosts(c.Addrs)
+	opts.SetConnectTimeout(time.Duration(c.ConnTimeout))
+	opts.SetMaxPoolSize(c.MaxPool)
+	opts.SetMaxConnIdleTime(time.Duration(c.MaxIdletime))
+	opts.SetSocketTimeout(time.Duration(c.SocketTimeout))
+	heartbeat := time.Duration(c.HeartbeatInterval)
+	if heartbeat <= 0 {
+		heartbeat = _heartbeatInterval
+	}
+	opts.SetHeartbeatInterval(heartbeat)
+	compressors := c.Compressors
+	if len(compressors) == 0 {
+		compressors = []string{"zstd"}
+	}
+	level := c.ZstdLevel
+	if level == 0 {
+		level = _zstdLevel
+	}
+	opts.SetCompressors(compressors).SetZstdLevel(level)
+	rp, err := readPreference(c)
 	if err != nil {
-		log.Fatalf("mongo.Connect error %v", err)
 		return
 	}
-	err = client.Ping(context.TODO(), nil)
+	opts.SetReadPreference(rp)
+	opts.SetReadConcern(readConcern(c))
+	opts.SetWriteConcern(writeConcern(c))
+	m := newMonitor(c)
+	opts.SetMonitor(m.commandMonitor()).SetPoolMonitor(m.poolMonitor())
+	if c.TLS != nil {
+		tc, err := tlsConfig(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tc)
+	}
+	return opts, errors.WithStack(opts.Validate())
+}
+
+func readPreference(c *Config) (rp *readpref.ReadPref, err error) {
+	name := c.ReadPreference
+	if name == "" {
+		name = _readPreference
+	}
+	mode, err := readpref.ModeFromString(name)
 	if err != nil {
-		log.Fatalf("client.Ping error %v", err)
+		return nil, errors.WithStack(err)
+	}
+	var ros []readpref.Option
+	if len(c.ReadTagSets) > 0 {
+		ros = append(ros, readpref.WithTagSets(tag.NewTagSetsFromMaps(c.ReadTagSets)...))
+	}
+	if c.MaxStaleness > 0 {
+		ros = append(ros, readpref.WithMaxStaleness(time.Duration(c.MaxStaleness)))
+	}
+	rp, err = readpref.New(mode, ros...)
+	return rp, errors.WithStack(err)
+}
+
+func readConcern(c *Config) *readconcern.ReadConcern {
+	if c.ReadConcern == "" {
+		return readconcern.Local()
+	}
+	return readconcern.New(readconcern.Level(c.ReadConcern))
+}
+
+func writeConcern(c *Config) *writeconcern.WriteConcern {
+	journal := c.Journal == nil || *c.Journal
+	wos := []writeconcern.Option{writeconcern.J(journal)}
+	switch w := c.WriteConcern; w {
+	case "":
+		wos = append(wos, writeconcern.W(1))
+	case "majority":
+		wos = append(wos, writeconcern.WMajority())
+	default:
+		if n, err := strconv.Atoi(w); err == nil {
+			wos = append(wos, writeconcern.W(n))
+		} else {
+			wos = append(wos, writeconcern.WTagSet(w))
+		}
+	}
+	if c.WTimeout > 0 {
+		wos = append(wos, writeconcern.WTimeout(time.Duration(c.WTimeout)))
+	}
+	return writeconcern.New(wos...)
+}
+
+func tlsConfig(c *TLSConfig) (tc *tls.Config, err error) {
+	tc = &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("mongo: no certificate in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
 	}
 	return
 }
@@ -2,18 +2,15 @@ package mongo
 
 import (
 	"context"
-	"fmt"
 	"testing"
 	"time"
 
 	"github.com/quan-xie/tuba/util/xtime"
-	xmongo "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-var client *xmongo.Client
-
-func init() {
-	cfg := &Config{
+func testConfig() *Config {
+	return &Config{
 		Addrs:         []string{"localhost:55003"},
 		Username:      "",
 		Password:      "",
@@ -23,14 +20,69 @@ func init() {
 		SocketTimeout: xtime.Duration(500 * time.Millisecond),
 		ConnTimeout:   xtime.Duration(500 * time.Millisecond),
 	}
-	client = NewMongo(cfg)
+}
+
+// newTestClient connects to the local mongo, the test is skipped when it
+// isn't running.
+func newTestClient(t *testing.T) *Client {
+	client, err := NewMongo(testConfig())
+	if err != nil {
+		t.Skipf("mongo unavailable: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
 }
 
 func TestDatabase(t *testing.T) {
-	err := client.Ping(context.TODO(), nil)
+	client := newTestClient(t)
+	if err := client.Ping(context.TODO(), nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	opts, err := clientOptions(testConfig())
 	if err != nil {
-		fmt.Println(err)
-		return
+		t.Fatal(err)
+	}
+	if opts.ReadPreference.Mode() != readpref.SecondaryPreferredMode || opts.ReadConcern.GetLevel() != "local" {
+		t.Errorf("default read preference %v read concern %v", opts.ReadPreference, opts.ReadConcern.GetLevel())
+	}
+	if w := opts.WriteConcern; w.GetW() != 1 || !w.GetJ() {
+		t.Errorf("default write concern w:%v j:%v", w.GetW(), w.GetJ())
+	}
+	if len(opts.Compressors) != 1 || opts.Compressors[0] != "zstd" || *opts.ZstdLevel != 3 || *opts.HeartbeatInterval != time.Second {
+		t.Errorf("default compressors %v level %d heartbeat %v", opts.Compressors, *opts.ZstdLevel, *opts.HeartbeatInterval)
+	}
+
+	journal := false
+	c := testConfig()
+	c.ReadPreference = "nearest"
+	c.ReadTagSets = []map[string]string{{"dc": "east"}, {}}
+	c.MaxStaleness = xtime.Duration(2 * time.Minute)
+	c.ReadConcern = "majority"
+	c.WriteConcern = "majority"
+	c.Journal = &journal
+	c.AuthSource = "admin"
+	c.Username, c.Password = "u", "p"
+	if opts, err = clientOptions(c); err != nil {
+		t.Fatal(err)
+	}
+	rp := opts.ReadPreference
+	if ms, _ := rp.MaxStaleness(); rp.Mode() != readpref.NearestMode || len(rp.TagSets()) != 2 || ms != 2*time.Minute {
+		t.Errorf("read preference %v", rp)
+	}
+	if opts.ReadConcern.GetLevel() != "majority" || opts.WriteConcern.GetW() != "majority" || opts.WriteConcern.GetJ() {
+		t.Errorf("read concern %v write concern w:%v j:%v", opts.ReadConcern.GetLevel(), opts.WriteConcern.GetW(), opts.WriteConcern.GetJ())
+	}
+	if opts.Auth == nil || opts.Auth.AuthSource != "admin" {
+		t.Errorf("auth %+v", opts.Auth)
+	}
+
+	c = testConfig()
+	c.ReadPreference = "primary"
+	c.MaxStaleness = xtime.Duration(2 * time.Minute)
+	if _, err = clientOptions(c); err == nil {
+		t.Error("max staleness with a primary read preference should fail")
 	}
-	fmt.Println("Connected to MongoDB!")
 }
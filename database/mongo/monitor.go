@@ -0,0 +1,229 @@
+package mongo
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quan-xie/tuba/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+const (
+	_family          = "mongo_client"
+	_slowLogDuration = 250 * time.Millisecond
+)
+
+var (
+	// KeyAddress is the server address tag of the pool measures.
+	KeyAddress = tag.MustNewKey("mongo_address")
+	// KeyReason is the failure reason tag of MeasureCheckoutFailed.
+	KeyReason = tag.MustNewKey("mongo_reason")
+
+	// MeasureCheckoutWait is the time spent waiting for a pooled connection.
+	MeasureCheckoutWait = stats.Float64("mongo/pool/checkout_wait", "Wait for a pooled connection", stats.UnitMilliseconds)
+	// MeasureInUse is the number of connections checked out of a pool.
+	MeasureInUse = stats.Int64("mongo/pool/in_use", "Connections checked out of the pool", stats.UnitDimensionless)
+	// MeasureCheckoutFailed counts the failed checkouts, such as wait timeouts.
+	MeasureCheckoutFailed = stats.Int64("mongo/pool/checkout_failed", "Failed connection checkouts", stats.UnitDimensionless)
+
+	// PoolViews are the views of the pool measures, register them with
+	// view.Register to export them.
+	PoolViews = []*view.View{
+		{
+			Name:        "mongo/pool/checkout_wait",
+			Description: "Distribution of the wait for a pooled connection",
+			Measure:     MeasureCheckoutWait,
+			TagKeys:     []tag.Key{KeyAddress},
+			Aggregation: view.Distribution(0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000),
+		},
+		{
+			Name:        "mongo/pool/in_use",
+			Description: "Connections checked out of the pool",
+			Measure:     MeasureInUse,
+			TagKeys:     []tag.Key{KeyAddress},
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "mongo/pool/checkout_failed",
+			Description: "Failed connection checkouts",
+			Measure:     MeasureCheckoutFailed,
+			TagKeys:     []tag.Key{KeyAddress, KeyReason},
+			Aggregation: view.Count(),
+		},
+	}
+)
+
+// commandKey identifies a running command, request ids are only unique
+// per connection.
+type commandKey struct {
+	conn string
+	id   int64
+}
+
+// command is a running command.
+type command struct {
+	span       *trace.Span
+	database   string
+	collection string
+	filter     string
+}
+
+// monitor traces the commands, logs the slow ones and records the pool
+// measures.
+type monitor struct {
+	slow     time.Duration
+	commands sync.Map // commandKey -> *command
+	inUse    sync.Map // address -> *int64
+}
+
+func newMonitor(c *Config) *monitor {
+	m := &monitor{slow: time.Duration(c.SlowLogDuration)}
+	if m.slow <= 0 {
+		m.slow = _slowLogDuration
+	}
+	return m
+}
+
+func (m *monitor) commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: m.started,
+		Succeeded: func(c context.Context, e *event.CommandSucceededEvent) {
+			m.finished(c, &e.CommandFinishedEvent, "")
+		},
+		Failed: func(c context.Context, e *event.CommandFailedEvent) {
+			m.finished(c, &e.CommandFinishedEvent, e.Failure)
+		},
+	}
+}
+
+func (m *monitor) poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: m.poolEvent}
+}
+
+func (m *monitor) started(c context.Context, e *event.CommandStartedEvent) {
+	cmd := &command{database: e.DatabaseName}
+	if v, err := e.Command.IndexErr(0); err == nil {
+		cmd.collection, _ = v.Value().StringValueOK()
+	}
+	if f, ok := commandFilter(e.CommandName, e.Command); ok {
+		cmd.filter = redact(f)
+	}
+	_, cmd.span = trace.StartSpan(c, _family+" "+e.CommandName, trace.WithSpanKind(trace.SpanKindClient))
+	cmd.span.AddAttributes(
+		trace.StringAttribute("mongo.database", cmd.database),
+		trace.StringAttribute("mongo.collection", cmd.collection),
+		trace.StringAttribute("mongo.operation", e.CommandName),
+		trace.StringAttribute("mongo.filter", cmd.filter),
+		trace.StringAttribute("mongo.connection", e.ConnectionID),
+	)
+	m.commands.Store(commandKey{e.ConnectionID, e.RequestID}, cmd)
+}
+
+func (m *monitor) finished(c context.Context, e *event.CommandFinishedEvent, failure string) {
+	v, ok := m.commands.LoadAndDelete(commandKey{e.ConnectionID, e.RequestID})
+	if !ok {
+		return
+	}
+	cmd := v.(*command)
+	if failure != "" {
+		cmd.span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: failure})
+	}
+	cmd.span.End()
+	if e.Duration > m.slow {
+		log.CtxWarnf(c, "%s slow log %s %s.%s filter:%s time:%v error(%s)", _family, e.CommandName, cmd.database, cmd.collection, cmd.filter, e.Duration, failure)
+	}
+}
+
+func (m *monitor) poolEvent(e *event.PoolEvent) {
+	switch e.Type {
+	case event.GetSucceeded:
+		n := atomic.AddInt64(m.counter(e.Address), 1)
+		m.record(e.Address, MeasureCheckoutWait.M(float64(e.Duration)/float64(time.Millisecond)), MeasureInUse.M(n))
+	case event.ConnectionReturned:
+		m.record(e.Address, MeasureInUse.M(atomic.AddInt64(m.counter(e.Address), -1)))
+	case event.GetFailed:
+		stats.RecordWithTags(context.Background(),
+			[]tag.Mutator{tag.Upsert(KeyAddress, e.Address), tag.Upsert(KeyReason, e.Reason)},
+			MeasureCheckoutFailed.M(1), MeasureCheckoutWait.M(float64(e.Duration)/float64(time.Millisecond)))
+	case event.PoolClosedEvent:
+		m.inUse.Delete(e.Address)
+	}
+}
+
+func (m *monitor) counter(addr string) *int64 {
+	v, _ := m.inUse.LoadOrStore(addr, new(int64))
+	return v.(*int64)
+}
+
+func (m *monitor) record(addr string, ms ...stats.Measurement) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(KeyAddress, addr)}, ms...)
+}
+
+// commandFilter returns the filter of the command, the pipeline of an
+// aggregate and the first query of a write.
+func commandFilter(name string, cmd bson.Raw) (v bson.RawValue, ok bool) {
+	switch name {
+	case "find":
+		return lookup(cmd, "filter")
+	case "count", "distinct", "findAndModify":
+		return lookup(cmd, "query")
+	case "aggregate":
+		return lookup(cmd, "pipeline")
+	case "update":
+		return lookup(cmd, "updates", "0", "q")
+	case "delete":
+		return lookup(cmd, "deletes", "0", "q")
+	}
+	return
+}
+
+func lookup(cmd bson.Raw, keys ...string) (v bson.RawValue, ok bool) {
+	v, err := cmd.LookupErr(keys...)
+	return v, err == nil
+}
+
+// redact renders the shape of a value with every scalar replaced by ?,
+// such as {name: ?, age: {$gt: ?}}, so that no user data is traced or logged.
+func redact(v bson.RawValue) string {
+	var b strings.Builder
+	redactValue(&b, v)
+	return b.String()
+}
+
+func redactValue(b *strings.Builder, v bson.RawValue) {
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		elems, _ := v.Document().Elements()
+		b.WriteByte('{')
+		for i, e := range elems {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(e.Key())
+			b.WriteString(": ")
+			redactValue(b, e.Value())
+		}
+		b.WriteByte('}')
+	case bsontype.Array:
+		values, _ := v.Array().Values()
+		b.WriteByte('[')
+		for i, e := range values {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			redactValue(b, e)
+		}
+		b.WriteByte(']')
+	default:
+		b.WriteByte('?')
+	}
+}
@@ -0,0 +1,86 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opencensus.io/stats/view"
+)
+
+func TestRedactFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  bson.D
+		want string
+	}{
+		{"find", bson.D{{Key: "find", Value: "user"}, {Key: "filter", Value: bson.M{"age": bson.M{"$gt": 18}}}}, "{age: {$gt: ?}}"},
+		{"update", bson.D{{Key: "update", Value: "user"}, {Key: "updates", Value: bson.A{bson.M{"q": bson.M{"_id": 1}, "u": bson.M{"name": "a"}}}}}, "{_id: ?}"},
+		{"aggregate", bson.D{{Key: "aggregate", Value: "user"}, {Key: "pipeline", Value: bson.A{bson.M{"$match": bson.M{"tags": bson.A{"a", "b"}}}}}}, "[{$match: {tags: [?, ?]}}]"},
+		{"insert", bson.D{{Key: "insert", Value: "user"}, {Key: "documents", Value: bson.A{bson.M{"name": "a"}}}}, ""},
+	}
+	for _, tt := range tests {
+		raw, err := bson.Marshal(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if v, ok := commandFilter(tt.name, raw); ok {
+			got = redact(v)
+		}
+		if got != tt.want {
+			t.Errorf("redact(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMonitorCommand(t *testing.T) {
+	m := newMonitor(&Config{})
+	cm := m.commandMonitor()
+	raw, _ := bson.Marshal(bson.D{{Key: "find", Value: "user"}, {Key: "filter", Value: bson.M{"name": "a"}}})
+	c := context.Background()
+	cm.Started(c, &event.CommandStartedEvent{Command: raw, DatabaseName: "tuba", CommandName: "find", RequestID: 1, ConnectionID: "c1"})
+	v, ok := m.commands.Load(commandKey{"c1", 1})
+	if !ok {
+		t.Fatal("started command not tracked")
+	}
+	if cmd := v.(*command); cmd.collection != "user" || cmd.filter != "{name: ?}" {
+		t.Errorf("command = %+v", cmd)
+	}
+	cm.Failed(c, &event.CommandFailedEvent{
+		CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", RequestID: 1, ConnectionID: "c1", Duration: time.Second},
+		Failure:              "boom",
+	})
+	if _, ok = m.commands.Load(commandKey{"c1", 1}); ok {
+		t.Error("finished command still tracked")
+	}
+}
+
+func TestMonitorPool(t *testing.T) {
+	if err := view.Register(PoolViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(PoolViews...)
+	m := newMonitor(&Config{})
+	pm := m.poolMonitor()
+	pm.Event(&event.PoolEvent{Type: event.GetSucceeded, Address: "a:1", Duration: 5 * time.Millisecond})
+	pm.Event(&event.PoolEvent{Type: event.GetSucceeded, Address: "a:1", Duration: 15 * time.Millisecond})
+	pm.Event(&event.PoolEvent{Type: event.ConnectionReturned, Address: "a:1"})
+
+	rows, err := view.RetrieveData("mongo/pool/in_use")
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("in_use rows = %v, %v", rows, err)
+	}
+	if v := rows[0].Data.(*view.LastValueData).Value; v != 1 {
+		t.Errorf("in_use = %v, want 1", v)
+	}
+	rows, err = view.RetrieveData("mongo/pool/checkout_wait")
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("checkout_wait rows = %v, %v", rows, err)
+	}
+	if d := rows[0].Data.(*view.DistributionData); d.Count != 2 || d.Mean != 10 {
+		t.Errorf("checkout_wait count %d mean %v, want 2 and 10", d.Count, d.Mean)
+	}
+}
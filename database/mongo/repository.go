@@ -0,0 +1,269 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/quan-xie/tuba/ecode"
+	"go.mongodb.org/mongo-driver/bson"
+	xmongo "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	_versionField   = "version"
+	_deletedAtField = "deleted_at"
+)
+
+// ErrVersionConflict is returned by UpdateOne when the document was
+// modified since it was read, it is a conflict error.
+var ErrVersionConflict = errors.Wrap(ecode.Conflict, "mongo: version conflict")
+
+// RepositoryConfig is the config of a Repository.
+type RepositoryConfig struct {
+	Database   string
+	Collection string
+	// SoftDelete makes Delete set deleted_at instead of removing the
+	// documents, the finds of the repository skip the deleted documents.
+	SoftDelete bool
+}
+
+// Page is a page of documents ready to be serialized in a response.
+type Page[T any] struct {
+	Items    []T   `json:"items"`
+	Total    int64 `json:"total"`
+	Page     int64 `json:"page"`
+	PageSize int64 `json:"page_size"`
+}
+
+// Repository is a typed access to a collection whose documents decode into
+// T. UpdateOne and Upsert rely on a version field, declare it in T as
+//
+//	Version int64 `bson:"version"`
+type Repository[T any] struct {
+	coll *xmongo.Collection
+	conf *RepositoryConfig
+}
+
+// NewRepository returns the repository of a collection.
+func NewRepository[T any](client *Client, c *RepositoryConfig) *Repository[T] {
+	return &Repository[T]{
+		coll: client.Database(c.Database).Collection(c.Collection),
+		conf: c,
+	}
+}
+
+// Collection returns the underlying collection.
+func (r *Repository[T]) Collection() *xmongo.Collection {
+	return r.coll
+}
+
+// alive restricts filter to the documents not soft deleted.
+func (r *Repository[T]) alive(filter interface{}) interface{} {
+	if !r.conf.SoftDelete {
+		return filter
+	}
+	return bson.M{"$and": bson.A{filter, bson.M{_deletedAtField: nil}}}
+}
+
+// FindByID returns the document with the id, ecode.NothingFound when there
+// is none.
+func (r *Repository[T]) FindByID(c context.Context, id interface{}) (doc *T, err error) {
+	return r.FindOne(c, bson.M{"_id": id})
+}
+
+// FindOne returns the first document matching filter, ecode.NothingFound
+// when there is none.
+func (r *Repository[T]) FindOne(c context.Context, filter interface{}, opts ...*options.FindOneOptions) (doc *T, err error) {
+	doc = new(T)
+	if err = r.coll.FindOne(c, r.alive(filter), opts...).Decode(doc); err != nil {
+		if err == xmongo.ErrNoDocuments {
+			return nil, errors.Wrapf(ecode.NothingFound, "mongo: %s %v", r.conf.Collection, filter)
+		}
+		return nil, errors.WithStack(err)
+	}
+	return
+}
+
+// Find returns the documents matching filter, sorted by sort when it isn't nil.
+func (r *Repository[T]) Find(c context.Context, filter interface{}, sort interface{}, opts ...*options.FindOptions) (docs []T, err error) {
+	if sort != nil {
+		opts = append(opts, options.Find().SetSort(sort))
+	}
+	cur, err := r.coll.Find(c, r.alive(filter), opts...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	docs = []T{}
+	if err = cur.All(c, &docs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return
+}
+
+// FindPage returns the page-th page, starting at 1, of pageSize documents
+// matching filter along with their total count. sort should end with a
+// unique field such as _id for the pages to be stable.
+func (r *Repository[T]) FindPage(c context.Context, filter interface{}, sort interface{}, page, pageSize int64) (p *Page[T], err error) {
+	if page < 1 || pageSize < 1 {
+		return nil, errors.Wrapf(ecode.RequestErr, "mongo: invalid page %d size %d", page, pageSize)
+	}
+	total, err := r.Count(c, filter)
+	if err != nil {
+		return
+	}
+	p = &Page[T]{Items: []T{}, Total: total, Page: page, PageSize: pageSize}
+	if skip := (page - 1) * pageSize; skip < total {
+		p.Items, err = r.Find(c, filter, sort, options.Find().SetSkip(skip).SetLimit(pageSize))
+	}
+	return
+}
+
+// Count returns the number of documents matching filter.
+func (r *Repository[T]) Count(c context.Context, filter interface{}) (n int64, err error) {
+	n, err = r.coll.CountDocuments(c, r.alive(filter))
+	err = errors.WithStack(err)
+	return
+}
+
+// InsertMany inserts the documents in order and returns their ids.
+func (r *Repository[T]) InsertMany(c context.Context, docs []T) (ids []interface{}, err error) {
+	if len(docs) == 0 {
+		return
+	}
+	vs := make([]interface{}, len(docs))
+	for i := range docs {
+		vs[i] = docs[i]
+	}
+	res, err := r.coll.InsertMany(c, vs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return res.InsertedIDs, nil
+}
+
+// Upsert replaces the document matching filter with doc or inserts doc,
+// it returns the id of the inserted document, nil when one was replaced.
+// Like UpdateOne it skips the soft deleted documents and increments the
+// version, the version of doc is ignored. It needs mongo 4.2 or later.
+func (r *Repository[T]) Upsert(c context.Context, filter interface{}, doc *T) (upsertedID interface{}, err error) {
+	res, err := r.coll.UpdateOne(c, r.alive(filter), replaceWithVersionInc(doc), options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return res.UpsertedID, nil
+}
+
+// replaceWithVersionInc returns the update pipeline replacing a document
+// with doc and incrementing its version, a new document is at version 1.
+func replaceWithVersionInc(doc interface{}) bson.A {
+	version := bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$" + _versionField, 0}}, 1}}
+	return bson.A{bson.M{"$replaceWith": bson.M{"$mergeObjects": bson.A{
+		bson.M{"$literal": doc},
+		bson.M{_versionField: version},
+	}}}}
+}
+
+// UpdateOne applies update to the document with the id if its version is
+// still version, and increments the version. It returns ErrVersionConflict
+// when the document was modified meanwhile and ecode.NothingFound when it
+// doesn't exist. update holds update operators such as $set.
+func (r *Repository[T]) UpdateOne(c context.Context, id interface{}, version int64, update bson.M) (err error) {
+	update, err = withVersionInc(update)
+	if err != nil {
+		return
+	}
+	res, err := r.coll.UpdateOne(c, r.alive(bson.M{"$and": bson.A{bson.M{"_id": id}, versionFilter(version)}}), update)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	n, err := r.Count(c, bson.M{"_id": id})
+	if err != nil {
+		return
+	}
+	if n > 0 {
+		return errors.Wrapf(ErrVersionConflict, "%s %v version %d", r.conf.Collection, id, version)
+	}
+	return errors.Wrapf(ecode.NothingFound, "mongo: %s %v", r.conf.Collection, id)
+}
+
+// versionFilter matches version, a document without version field is at 0.
+func versionFilter(version int64) bson.M {
+	if version == 0 {
+		return bson.M{_versionField: bson.M{"$in": bson.A{0, nil}}}
+	}
+	return bson.M{_versionField: version}
+}
+
+// withVersionInc returns a copy of update incrementing the version.
+func withVersionInc(update bson.M) (bson.M, error) {
+	u := make(bson.M, len(update)+1)
+	for k, v := range update {
+		u[k] = v
+	}
+	inc := bson.M{}
+	switch v := u["$inc"].(type) {
+	case nil:
+	case bson.M:
+		for k, n := range v {
+			inc[k] = n
+		}
+	case bson.D:
+		for _, e := range v {
+			inc[e.Key] = e.Value
+		}
+	default:
+		return nil, errors.Errorf("mongo: unsupported $inc %T", v)
+	}
+	if _, ok := inc[_versionField]; ok {
+		return nil, errors.New("mongo: update must not change the version")
+	}
+	inc[_versionField] = 1
+	u["$inc"] = inc
+	return u, nil
+}
+
+// DeleteByID deletes the document with the id, ecode.NothingFound when
+// there is none.
+func (r *Repository[T]) DeleteByID(c context.Context, id interface{}) (err error) {
+	n, err := r.Delete(c, bson.M{"_id": id})
+	if err == nil && n == 0 {
+		err = errors.Wrapf(ecode.NothingFound, "mongo: %s %v", r.conf.Collection, id)
+	}
+	return
+}
+
+// Delete deletes the documents matching filter and returns their number,
+// they are only marked with deleted_at in soft delete mode.
+func (r *Repository[T]) Delete(c context.Context, filter interface{}) (n int64, err error) {
+	if r.conf.SoftDelete {
+		res, err := r.coll.UpdateMany(c, r.alive(filter), bson.M{"$set": bson.M{_deletedAtField: time.Now()}})
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		return res.ModifiedCount, nil
+	}
+	res, err := r.coll.DeleteMany(c, filter)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return res.DeletedCount, nil
+}
+
+// BulkWrite runs the write models in one batch, in order when ordered is
+// true, otherwise every model is attempted even after a failure. The models
+// are sent as they are: unlike the other writes of the repository they
+// neither skip the soft deleted documents nor increment the version, add
+// deleted_at: nil to their filters and $inc the version where needed.
+func (r *Repository[T]) BulkWrite(c context.Context, models []xmongo.WriteModel, ordered bool) (res *xmongo.BulkWriteResult, err error) {
+	if len(models) == 0 {
+		return &xmongo.BulkWriteResult{}, nil
+	}
+	res, err = r.coll.BulkWrite(c, models, options.BulkWrite().SetOrdered(ordered))
+	err = errors.WithStack(err)
+	return
+}
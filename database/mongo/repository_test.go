@@ -0,0 +1,95 @@
+package mongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/quan-xie/tuba/ecode"
+	"go.mongodb.org/mongo-driver/bson"
+	xmongo "go.mongodb.org/mongo-driver/mongo"
+)
+
+type repoUser struct {
+	ID      int64  `bson:"_id"`
+	Name    string `bson:"name"`
+	Version int64  `bson:"version"`
+}
+
+func TestWithVersionInc(t *testing.T) {
+	update := bson.M{"$set": bson.M{"name": "a"}, "$inc": bson.M{"visits": 1}}
+	got, err := withVersionInc(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"$set": bson.M{"name": "a"}, "$inc": bson.M{"visits": 1, "version": 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withVersionInc() = %v, want %v", got, want)
+	}
+	if _, ok := update["$inc"].(bson.M)["version"]; ok {
+		t.Error("withVersionInc() modified the update")
+	}
+	if _, err = withVersionInc(bson.M{"$inc": bson.M{"version": 2}}); err == nil {
+		t.Error("withVersionInc() should refuse an update of the version")
+	}
+}
+
+func TestReplaceWithVersionInc(t *testing.T) {
+	doc := &repoUser{ID: 1, Name: "$a", Version: 7}
+	got := replaceWithVersionInc(doc)
+	want := bson.A{bson.M{"$replaceWith": bson.M{"$mergeObjects": bson.A{
+		bson.M{"$literal": doc},
+		bson.M{"version": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}}},
+	}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replaceWithVersionInc() = %v, want %v", got, want)
+	}
+}
+
+func TestRepository(t *testing.T) {
+	client := newTestClient(t)
+	c := context.Background()
+	r := NewRepository[repoUser](client, &RepositoryConfig{Database: "tuba_test", Collection: "repo_users", SoftDelete: true})
+	r.Collection().Drop(c)
+	defer r.Collection().Drop(c)
+
+	if _, err := r.InsertMany(c, []repoUser{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}, {ID: 3, Name: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateOne(c, int64(1), 0, bson.M{"$set": bson.M{"name": "aa"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateOne(c, int64(1), 0, bson.M{"$set": bson.M{"name": "ab"}}); !ecode.EqualError(ecode.Conflict, err) {
+		t.Errorf("UpdateOne() of a stale version error = %v, want conflict", err)
+	}
+	u, err := r.FindByID(c, int64(1))
+	if err != nil || u.Name != "aa" || u.Version != 1 {
+		t.Errorf("FindByID() = %+v, %v", u, err)
+	}
+	if err = r.DeleteByID(c, int64(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.FindByID(c, int64(2)); !ecode.EqualError(ecode.NothingFound, err) {
+		t.Errorf("FindByID() of a deleted document error = %v, want nothing found", err)
+	}
+	page, err := r.FindPage(c, bson.M{}, bson.D{{Key: "_id", Value: -1}}, 1, 1)
+	if err != nil || page.Total != 2 || len(page.Items) != 1 || page.Items[0].ID != 3 {
+		t.Errorf("FindPage() = %+v, %v", page, err)
+	}
+	res, err := r.BulkWrite(c, []xmongo.WriteModel{
+		xmongo.NewUpdateOneModel().SetFilter(bson.M{"_id": 3}).SetUpdate(bson.M{"$set": bson.M{"name": "cc"}}),
+	}, true)
+	if err != nil || res.ModifiedCount != 1 {
+		t.Errorf("BulkWrite() = %+v, %v", res, err)
+	}
+	if _, err = r.Upsert(c, bson.M{"_id": 1}, &repoUser{ID: 1, Name: "ac"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = r.FindByID(c, int64(1)); err != nil || u.Name != "ac" || u.Version != 2 {
+		t.Errorf("FindByID() after Upsert = %+v, %v", u, err)
+	}
+	// the soft deleted document isn't replaced, the upsert conflicts on its id.
+	if _, err = r.Upsert(c, bson.M{"_id": 2}, &repoUser{ID: 2, Name: "bb"}); err == nil {
+		t.Error("Upsert() of a soft deleted document should fail")
+	}
+}
@@ -0,0 +1,412 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/util/xtime"
+	"go.mongodb.org/mongo-driver/bson"
+	xmongo "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+// Schema actions reported by Reconcile.
+const (
+	ActionCreateCollection = "create_collection"
+	ActionUpdateValidator  = "update_validator"
+	ActionCreateIndex      = "create_index"
+	// ActionChangedIndex reports an index whose name is declared with
+	// another definition, it is left as is and must be migrated by hand.
+	ActionChangedIndex = "changed_index"
+	// ActionExtraIndex reports an index that isn't declared, it is left as is.
+	ActionExtraIndex = "extra_index"
+)
+
+// Schema declares the collections of a database, in Go or in YAML:
+//
+//	database: shop
+//	collections:
+//	  - name: orders
+//	    validator:
+//	      $jsonSchema:
+//	        bsonType: object
+//	        required: [user_id, status]
+//	    validation_level: moderate
+//	    indexes:
+//	      - keys: [user_id, -ctime]
+//	      - keys: [order_no]
+//	        unique: true
+//	      - keys: [expire_at]
+//	        expire_after: 0s
+//	      - keys: [status]
+//	        partial_filter: {status: {$in: [pending, paid]}}
+//	      - keys: [text:title, text:body]
+//	        weights: {title: 10}
+type Schema struct {
+	Database    string              `yaml:"database"`
+	Collections []*CollectionSchema `yaml:"collections"`
+}
+
+// CollectionSchema declares the validator and the indexes of a collection.
+type CollectionSchema struct {
+	Name string `yaml:"name"`
+	// Validator is the validation document, such as a $jsonSchema.
+	Validator        map[string]interface{} `yaml:"validator"`
+	ValidationLevel  string                 `yaml:"validation_level"`  // strict by default.
+	ValidationAction string                 `yaml:"validation_action"` // error by default.
+	Indexes          []*Index               `yaml:"indexes"`
+}
+
+// Index declares an index. Keys are field names in order, prefixed by - for
+// a descending key, or by text:, 2dsphere: or hashed: for those types.
+type Index struct {
+	Name   string   `yaml:"name"` // derived from the keys as by the shell when empty.
+	Keys   []string `yaml:"keys"`
+	Unique bool     `yaml:"unique"`
+	Sparse bool     `yaml:"sparse"`
+	// ExpireAfter makes a TTL index, the documents expire this long after
+	// the date of the key.
+	ExpireAfter     *xtime.Duration        `yaml:"expire_after"`
+	PartialFilter   map[string]interface{} `yaml:"partial_filter"`
+	Weights         map[string]int32       `yaml:"weights"` // text index weights.
+	DefaultLanguage string                 `yaml:"default_language"`
+}
+
+// SchemaChange is a difference between a Schema and a database.
+type SchemaChange struct {
+	Collection string
+	Action     string
+	Name       string // index name.
+}
+
+func (sc SchemaChange) String() string {
+	if sc.Name == "" {
+		return sc.Action + " " + sc.Collection
+	}
+	return sc.Action + " " + sc.Collection + "." + sc.Name
+}
+
+// LoadSchema parses a YAML schema.
+func LoadSchema(b []byte) (s *Schema, err error) {
+	s = new(Schema)
+	if err = yaml.Unmarshal(b, s); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s, s.validate()
+}
+
+// LoadSchemaFile parses a YAML schema file.
+func LoadSchemaFile(path string) (s *Schema, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return LoadSchema(b)
+}
+
+func (s *Schema) validate() error {
+	if s.Database == "" {
+		return errors.New("mongo: schema without database")
+	}
+	for _, cs := range s.Collections {
+		for _, idx := range cs.Indexes {
+			if _, err := idx.keys(); err != nil {
+				return errors.Wrapf(err, "collection %s", cs.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// keys returns the ordered key document of the index.
+func (idx *Index) keys() (keys bson.D, err error) {
+	if len(idx.Keys) == 0 {
+		return nil, errors.New("mongo: index without keys")
+	}
+	for _, k := range idx.Keys {
+		var v interface{} = 1
+		if i := strings.IndexByte(k, ':'); i > 0 {
+			v, k = k[:i], k[i+1:]
+		} else if strings.HasPrefix(k, "-") {
+			v, k = -1, k[1:]
+		}
+		if k == "" {
+			return nil, errors.Errorf("mongo: invalid index key %v", idx.Keys)
+		}
+		keys = append(keys, bson.E{Key: k, Value: v})
+	}
+	return
+}
+
+// name returns the declared name or the one the server would give.
+func (idx *Index) name() string {
+	if idx.Name != "" {
+		return idx.Name
+	}
+	keys, _ := idx.keys()
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s_%v", k.Key, k.Value)
+	}
+	return strings.Join(parts, "_")
+}
+
+func (idx *Index) model() xmongo.IndexModel {
+	keys, _ := idx.keys()
+	opts := options.Index().SetName(idx.name())
+	if idx.Unique {
+		opts.SetUnique(true)
+	}
+	if idx.Sparse {
+		opts.SetSparse(true)
+	}
+	if idx.ExpireAfter != nil {
+		opts.SetExpireAfterSeconds(int32(time.Duration(*idx.ExpireAfter) / time.Second))
+	}
+	if idx.PartialFilter != nil {
+		opts.SetPartialFilterExpression(idx.PartialFilter)
+	}
+	if idx.Weights != nil {
+		opts.SetWeights(idx.Weights)
+	}
+	if idx.DefaultLanguage != "" {
+		opts.SetDefaultLanguage(idx.DefaultLanguage)
+	}
+	return xmongo.IndexModel{Keys: keys, Options: opts}
+}
+
+// existingIndex is an index as listed by the server.
+type existingIndex struct {
+	Name               string   `bson:"name"`
+	Key                bson.D   `bson:"key"`
+	Unique             bool     `bson:"unique"`
+	Sparse             bool     `bson:"sparse"`
+	ExpireAfterSeconds *int32   `bson:"expireAfterSeconds"`
+	PartialFilter      bson.Raw `bson:"partialFilterExpression"`
+}
+
+// differs reports whether the existing index doesn't match the declaration,
+// the keys of text indexes are stored in another form and aren't compared.
+func (idx *Index) differs(e *existingIndex) bool {
+	if idx.Unique != e.Unique || idx.Sparse != e.Sparse {
+		return true
+	}
+	if (idx.ExpireAfter == nil) != (e.ExpireAfterSeconds == nil) ||
+		(idx.ExpireAfter != nil && int32(time.Duration(*idx.ExpireAfter)/time.Second) != *e.ExpireAfterSeconds) {
+		return true
+	}
+	if (idx.PartialFilter == nil) != (e.PartialFilter == nil) ||
+		(idx.PartialFilter != nil && !sameDocument(idx.PartialFilter, e.PartialFilter)) {
+		return true
+	}
+	keys, _ := idx.keys()
+	for _, k := range keys {
+		if _, ok := k.Value.(string); ok {
+			return false
+		}
+	}
+	if len(keys) != len(e.Key) {
+		return true
+	}
+	for i, k := range keys {
+		if k.Key != e.Key[i].Key || normalize(k.Value) != normalize(e.Key[i].Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reconcile creates the missing collections and indexes of the schema and
+// updates the validators that differ. Changed and extra indexes are only
+// reported. Nothing is modified in dry-run mode, the changes that would be
+// made are returned.
+func (c *Client) Reconcile(ctx context.Context, s *Schema, dryRun bool) (changes []SchemaChange, err error) {
+	db := c.Database(s.Database)
+	names, err := db.ListCollectionSpecifications(ctx, bson.M{})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	specs := make(map[string]*xmongo.CollectionSpecification, len(names))
+	for _, spec := range names {
+		specs[spec.Name] = spec
+	}
+	report := func(change SchemaChange) {
+		log.Infof("%s schema %s dry_run:%t", _family, change, dryRun)
+		changes = append(changes, change)
+	}
+	for _, cs := range s.Collections {
+		spec, ok := specs[cs.Name]
+		switch {
+		case !ok:
+			report(SchemaChange{Collection: cs.Name, Action: ActionCreateCollection})
+			if !dryRun {
+				if err = createCollection(ctx, db, cs); err != nil {
+					return
+				}
+			}
+		case validatorDiffers(cs, spec.Options):
+			report(SchemaChange{Collection: cs.Name, Action: ActionUpdateValidator})
+			if !dryRun {
+				if err = updateValidator(ctx, db, cs); err != nil {
+					return
+				}
+			}
+		}
+		var existing []*existingIndex
+		if ok {
+			if existing, err = listIndexes(ctx, db.Collection(cs.Name)); err != nil {
+				return
+			}
+		}
+		if err = reconcileIndexes(ctx, db.Collection(cs.Name), cs, existing, dryRun, report); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func reconcileIndexes(ctx context.Context, coll *xmongo.Collection, cs *CollectionSchema, existing []*existingIndex, dryRun bool, report func(SchemaChange)) error {
+	byName := make(map[string]*existingIndex, len(existing))
+	for _, e := range existing {
+		byName[e.Name] = e
+	}
+	declared := make(map[string]bool, len(cs.Indexes))
+	var missing []xmongo.IndexModel
+	for _, idx := range cs.Indexes {
+		name := idx.name()
+		declared[name] = true
+		e, ok := byName[name]
+		if !ok {
+			report(SchemaChange{Collection: cs.Name, Action: ActionCreateIndex, Name: name})
+			missing = append(missing, idx.model())
+		} else if idx.differs(e) {
+			report(SchemaChange{Collection: cs.Name, Action: ActionChangedIndex, Name: name})
+		}
+	}
+	for _, e := range existing {
+		if e.Name != "_id_" && !declared[e.Name] {
+			report(SchemaChange{Collection: cs.Name, Action: ActionExtraIndex, Name: e.Name})
+		}
+	}
+	if dryRun || len(missing) == 0 {
+		return nil
+	}
+	_, err := coll.Indexes().CreateMany(ctx, missing)
+	return errors.Wrapf(err, "create indexes of %s", cs.Name)
+}
+
+func listIndexes(ctx context.Context, coll *xmongo.Collection) (indexes []*existingIndex, err error) {
+	cur, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = errors.WithStack(cur.All(ctx, &indexes))
+	return
+}
+
+func createCollection(ctx context.Context, db *xmongo.Database, cs *CollectionSchema) error {
+	opts := options.CreateCollection()
+	if cs.Validator != nil {
+		opts.SetValidator(cs.Validator)
+	}
+	if cs.ValidationLevel != "" {
+		opts.SetValidationLevel(cs.ValidationLevel)
+	}
+	if cs.ValidationAction != "" {
+		opts.SetValidationAction(cs.ValidationAction)
+	}
+	return errors.Wrapf(db.CreateCollection(ctx, cs.Name, opts), "create collection %s", cs.Name)
+}
+
+func updateValidator(ctx context.Context, db *xmongo.Database, cs *CollectionSchema) error {
+	var validator interface{} = cs.Validator
+	if validator == nil {
+		validator = bson.M{}
+	}
+	cmd := bson.D{{Key: "collMod", Value: cs.Name}, {Key: "validator", Value: validator}}
+	cmd = append(cmd, bson.E{Key: "validationLevel", Value: orDefault(cs.ValidationLevel, "strict")})
+	cmd = append(cmd, bson.E{Key: "validationAction", Value: orDefault(cs.ValidationAction, "error")})
+	return errors.Wrapf(db.RunCommand(ctx, cmd).Err(), "update validator of %s", cs.Name)
+}
+
+// validatorDiffers compares the declared validation with the options of
+// the existing collection.
+func validatorDiffers(cs *CollectionSchema, opts bson.Raw) bool {
+	var current struct {
+		Validator        bson.Raw `bson:"validator"`
+		ValidationLevel  string   `bson:"validationLevel"`
+		ValidationAction string   `bson:"validationAction"`
+	}
+	if len(opts) > 0 {
+		if err := bson.Unmarshal(opts, &current); err != nil {
+			return true
+		}
+	}
+	if cs.Validator == nil {
+		// an empty validator disables the validation.
+		return len(current.Validator) > 0 && !sameDocument(bson.M{}, current.Validator)
+	}
+	return !sameDocument(cs.Validator, current.Validator) ||
+		orDefault(cs.ValidationLevel, "strict") != orDefault(current.ValidationLevel, "strict") ||
+		orDefault(cs.ValidationAction, "error") != orDefault(current.ValidationAction, "error")
+}
+
+// sameDocument compares a declared document with a stored one regardless
+// of the order of the fields.
+func sameDocument(declared interface{}, stored bson.Raw) bool {
+	b, err := bson.Marshal(declared)
+	if err != nil {
+		return false
+	}
+	var x, y bson.M
+	if bson.Unmarshal(b, &x) != nil || bson.Unmarshal(stored, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(normalize(x), normalize(y))
+}
+
+// normalize converts the numbers to float64 so that an int declared in Go
+// or YAML equals the int32 or double stored by the server.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = normalize(e)
+		}
+		return m
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = normalize(e.Value)
+		}
+		return m
+	case bson.A:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = normalize(e)
+		}
+		return a
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return v
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,118 @@
+package mongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const testSchema = `
+database: tuba_test
+collections:
+  - name: schema_orders
+    validator:
+      $jsonSchema:
+        bsonType: object
+        required: [user_id]
+    validation_level: moderate
+    indexes:
+      - keys: [user_id, -ctime]
+      - keys: [order_no]
+        unique: true
+      - keys: [expire_at]
+        expire_after: 24h
+      - keys: [status]
+        partial_filter: {status: {$in: [pending, paid]}}
+      - keys: [text:title, text:body]
+        weights: {title: 10}
+`
+
+func TestLoadSchema(t *testing.T) {
+	s, err := LoadSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxs := s.Collections[0].Indexes
+	var names []string
+	for _, idx := range idxs {
+		names = append(names, idx.name())
+	}
+	want := []string{"user_id_1_ctime_-1", "order_no_1", "expire_at_1", "status_1", "title_text_body_text"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("index names = %v, want %v", names, want)
+	}
+	if keys, _ := idxs[0].keys(); !reflect.DeepEqual(keys, bson.D{{Key: "user_id", Value: 1}, {Key: "ctime", Value: -1}}) {
+		t.Errorf("keys() = %v", keys)
+	}
+	if d := idxs[2].ExpireAfter; d == nil || time.Duration(*d) != 24*time.Hour {
+		t.Errorf("expire_after = %v, want 24h", d)
+	}
+	if idxs[4].Weights["title"] != 10 {
+		t.Errorf("weights = %v", idxs[4].Weights)
+	}
+	if _, err = LoadSchema([]byte("database: x\ncollections: [{name: a, indexes: [{keys: []}]}]")); err == nil {
+		t.Error("LoadSchema() should refuse an index without keys")
+	}
+}
+
+func TestIndexDiffers(t *testing.T) {
+	ttl := int32(60)
+	partial, _ := bson.Marshal(bson.D{{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"pending"}}}}})
+	idx := &Index{Keys: []string{"a", "-b"}, Unique: true, PartialFilter: map[string]interface{}{"status": map[string]interface{}{"$in": []interface{}{"pending"}}}}
+	e := &existingIndex{Name: "a_1_b_-1", Key: bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: float64(-1)}}, Unique: true, PartialFilter: partial}
+	if idx.differs(e) {
+		t.Error("differs() of an identical index")
+	}
+	e.ExpireAfterSeconds = &ttl
+	if !idx.differs(e) {
+		t.Error("differs() should detect a TTL")
+	}
+	e.ExpireAfterSeconds = nil
+	e.Key[1].Value = int32(1)
+	if !idx.differs(e) {
+		t.Error("differs() should detect another key order")
+	}
+}
+
+func TestValidatorDiffers(t *testing.T) {
+	s, _ := LoadSchema([]byte(testSchema))
+	cs := s.Collections[0]
+	opts, _ := bson.Marshal(bson.M{
+		"validator":        bson.M{"$jsonSchema": bson.M{"required": bson.A{"user_id"}, "bsonType": "object"}},
+		"validationLevel":  "moderate",
+		"validationAction": "error",
+	})
+	if validatorDiffers(cs, opts) {
+		t.Error("validatorDiffers() of the same validator")
+	}
+	cs.ValidationLevel = ""
+	if !validatorDiffers(cs, opts) {
+		t.Error("validatorDiffers() should detect another level")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	client := newTestClient(t)
+	c := context.Background()
+	s, _ := LoadSchema([]byte(testSchema))
+	db := client.Database(s.Database)
+	db.Collection("schema_orders").Drop(c)
+	defer db.Collection("schema_orders").Drop(c)
+
+	changes, err := client.Reconcile(c, s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 6 || changes[0].Action != ActionCreateCollection {
+		t.Errorf("dry run changes = %v", changes)
+	}
+	if _, err = client.Reconcile(c, s, false); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = client.Reconcile(c, s, false); err != nil || len(changes) != 0 {
+		t.Errorf("second Reconcile() = %v, %v, want no change", changes, err)
+	}
+}
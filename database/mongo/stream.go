@@ -0,0 +1,330 @@
+package mongo
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/quan-xie/tuba/backoff"
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/retry"
+	"github.com/quan-xie/tuba/util/xtime"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	xmongo "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	_streamBackoff    = time.Second
+	_streamMaxBackoff = time.Minute
+	// _invalidate is the last event of a stream whose collection or
+	// database was dropped or renamed.
+	_invalidate = "invalidate"
+)
+
+// errInvalidated ends a watch after an invalidate event, the stream is
+// reopened right after it.
+var errInvalidated = errors.New("mongo: change stream invalidated")
+
+// TokenStore persists the resume token of a change stream.
+type TokenStore interface {
+	// Load returns the saved token of the stream, nil when there is none.
+	Load(c context.Context, name string) (bson.Raw, error)
+	Save(c context.Context, name string, token bson.Raw) error
+}
+
+// MongoTokenStore saves the resume tokens in a collection, one document
+// per stream.
+type MongoTokenStore struct {
+	coll *xmongo.Collection
+}
+
+// NewMongoTokenStore returns a store of the tokens in database.collection.
+func NewMongoTokenStore(client *Client, database, collection string) *MongoTokenStore {
+	return &MongoTokenStore{coll: client.Database(database).Collection(collection)}
+}
+
+// Load implements TokenStore.
+func (s *MongoTokenStore) Load(c context.Context, name string) (token bson.Raw, err error) {
+	var doc struct {
+		Token bson.Raw `bson:"token"`
+	}
+	if err = s.coll.FindOne(c, bson.M{"_id": name}).Decode(&doc); err != nil {
+		if err == xmongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	return doc.Token, nil
+}
+
+// Save implements TokenStore.
+func (s *MongoTokenStore) Save(c context.Context, name string, token bson.Raw) (err error) {
+	_, err = s.coll.ReplaceOne(c, bson.M{"_id": name}, bson.M{"_id": name, "token": token, "mtime": time.Now()}, options.Replace().SetUpsert(true))
+	return errors.WithStack(err)
+}
+
+// RedisTokenStore saves the resume tokens in redis keys.
+type RedisTokenStore struct {
+	client redis.Cmdable
+	prefix string
+}
+
+// NewRedisTokenStore returns a store of the tokens in the keys prefix+name.
+func NewRedisTokenStore(client redis.Cmdable, prefix string) *RedisTokenStore {
+	return &RedisTokenStore{client: client, prefix: prefix}
+}
+
+// Load implements TokenStore.
+func (s *RedisTokenStore) Load(c context.Context, name string) (token bson.Raw, err error) {
+	b, err := s.client.Get(c, s.prefix+name).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	return bson.Raw(b), nil
+}
+
+// Save implements TokenStore.
+func (s *RedisTokenStore) Save(c context.Context, name string, token bson.Raw) error {
+	return errors.WithStack(s.client.Set(c, s.prefix+name, []byte(token), 0).Err())
+}
+
+// StreamConfig is the config of a Stream.
+type StreamConfig struct {
+	Name       string // key of the resume token in the store.
+	Database   string // watched database, the whole cluster when empty.
+	Collection string // watched collection, the whole database when empty.
+	// Pipeline filters or reshapes the events, such as a $match on operationType.
+	Pipeline xmongo.Pipeline
+	// FullDocument looks up the current document of the update events.
+	FullDocument bool
+	BatchSize    int32
+	MaxAwaitTime xtime.Duration
+	// Backoff is the first retry interval after an error of the stream or of
+	// the handler, doubled on every attempt up to MaxBackoff.
+	Backoff    xtime.Duration
+	MaxBackoff xtime.Duration
+}
+
+// ChangeEvent is an event of a change stream.
+type ChangeEvent struct {
+	ID            bson.Raw `bson:"_id"` // resume token.
+	OperationType string   `bson:"operationType"`
+	Namespace     struct {
+		Database   string `bson:"db"`
+		Collection string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey       bson.Raw            `bson:"documentKey"`
+	FullDocument      bson.Raw            `bson:"fullDocument"`
+	UpdateDescription bson.Raw            `bson:"updateDescription"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime"`
+}
+
+// StreamHandler handles an event, it is called again with the same event
+// after it returns an error.
+type StreamHandler func(c context.Context, e *ChangeEvent) error
+
+// Stream consumes a change stream with at-least-once delivery: events are
+// handled one at a time in order, and the resume token of an event is saved
+// once its handler succeeds, so an event may be handled again after a crash
+// and handlers must be idempotent.
+type Stream struct {
+	client  *Client
+	conf    *StreamConfig
+	store   TokenStore
+	handler StreamHandler
+	retrier retry.Retriable
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewStream returns a stream of changes, start it with Start.
+func NewStream(client *Client, c *StreamConfig, store TokenStore, h StreamHandler) *Stream {
+	if c.Backoff <= 0 {
+		c.Backoff = xtime.Duration(_streamBackoff)
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = xtime.Duration(_streamMaxBackoff)
+	}
+	return &Stream{
+		client:  client,
+		conf:    c,
+		store:   store,
+		handler: h,
+		retrier: retry.NewRetrier(backoff.NewConstantBackoff(c.Backoff)),
+	}
+}
+
+// SetRetrier sets the retrier computing the delay before a retry.
+func (s *Stream) SetRetrier(retrier retry.Retriable) {
+	s.retrier = retrier
+}
+
+// Start consumes the stream in the background until Close is called.
+func (s *Stream) Start() {
+	var c context.Context
+	c, s.cancel = context.WithCancel(context.Background())
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.Run(c)
+	}()
+}
+
+// Close stops the stream started by Start and waits for the handler.
+func (s *Stream) Close() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+// Run consumes the stream until c is done. The stream is reopened from the
+// saved token after an error, with backoff; a token lost from the oplog
+// fails until the token is removed from the store.
+//
+// An invalidate event, sent when the watched collection or database is
+// dropped or renamed, is handled like the others, then the stream is
+// reopened after it and follows the namespace if it is created again.
+// Reopening after a token needs mongo 4.2 or later.
+func (s *Stream) Run(c context.Context) error {
+	for attempt := 0; ; {
+		progressed, err := s.watch(c)
+		if c.Err() != nil {
+			return c.Err()
+		}
+		if err == errInvalidated {
+			log.Warnf("%s stream %s invalidated, reopened after it", _family, s.conf.Name)
+			attempt = 0
+			continue
+		}
+		if progressed {
+			attempt = 0
+		}
+		attempt++
+		delay := s.retryDelay(attempt)
+		log.Errorf("%s stream %s error(%v) retry in %v", _family, s.conf.Name, err, delay)
+		if !sleep(c, delay) {
+			return c.Err()
+		}
+	}
+}
+
+// watch opens the change stream after the saved token and handles its
+// events, it reports whether any event was handled.
+func (s *Stream) watch(c context.Context) (progressed bool, err error) {
+	token, err := s.store.Load(c, s.conf.Name)
+	if err != nil {
+		return
+	}
+	opts := options.ChangeStream()
+	if token != nil {
+		// unlike resumeAfter, startAfter accepts the token of an invalidate.
+		opts.SetStartAfter(token)
+	}
+	if s.conf.FullDocument {
+		opts.SetFullDocument(options.UpdateLookup)
+	}
+	if s.conf.BatchSize > 0 {
+		opts.SetBatchSize(s.conf.BatchSize)
+	}
+	if s.conf.MaxAwaitTime > 0 {
+		opts.SetMaxAwaitTime(time.Duration(s.conf.MaxAwaitTime))
+	}
+	pipeline := s.conf.Pipeline
+	if pipeline == nil {
+		pipeline = xmongo.Pipeline{}
+	}
+	var cs *xmongo.ChangeStream
+	switch {
+	case s.conf.Database == "":
+		cs, err = s.client.Watch(c, pipeline, opts)
+	case s.conf.Collection == "":
+		cs, err = s.client.Database(s.conf.Database).Watch(c, pipeline, opts)
+	default:
+		cs, err = s.client.Database(s.conf.Database).Collection(s.conf.Collection).Watch(c, pipeline, opts)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "watch")
+	}
+	defer cs.Close(context.Background())
+	for {
+		// TryNext waits for at most MaxAwaitTime on the server.
+		if cs.TryNext(c) {
+			e := new(ChangeEvent)
+			if err = cs.Decode(e); err != nil {
+				return progressed, errors.WithStack(err)
+			}
+			if err = s.handle(c, e); err != nil {
+				return
+			}
+			progressed = true
+			token = e.ID
+			if e.OperationType == _invalidate {
+				// the server closed the stream, it can't go on.
+				return progressed, errInvalidated
+			}
+			continue
+		}
+		if err = cs.Err(); err != nil {
+			return progressed, errors.WithStack(err)
+		}
+		if cs.ID() == 0 {
+			return progressed, errors.New("mongo: change stream closed by the server")
+		}
+		if err = c.Err(); err != nil {
+			return
+		}
+		// an empty batch still moves the position forward, saving it spares
+		// a restart the scan of the idle oplog.
+		if rt := cs.ResumeToken(); rt != nil && !bytes.Equal(rt, token) {
+			if err = s.store.Save(c, s.conf.Name, rt); err != nil {
+				return
+			}
+			token = rt
+		}
+	}
+}
+
+// handle calls the handler until it succeeds and saves the token of e.
+func (s *Stream) handle(c context.Context, e *ChangeEvent) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = s.handler(c, e); err == nil {
+			break
+		}
+		delay := s.retryDelay(attempt)
+		log.CtxWarnf(c, "%s stream %s handle %s error(%v) retry in %v", _family, s.conf.Name, e.OperationType, err, delay)
+		if !sleep(c, delay) {
+			return c.Err()
+		}
+	}
+	return s.store.Save(c, s.conf.Name, e.ID)
+}
+
+func (s *Stream) retryDelay(attempt int) time.Duration {
+	d := s.retrier.NextInterval(attempt)
+	if max := time.Duration(s.conf.MaxBackoff); d > max || d <= 0 {
+		return max
+	}
+	return d
+}
+
+// sleep waits for d, it returns false when c is done first.
+func sleep(c context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.Done():
+		return false
+	}
+}
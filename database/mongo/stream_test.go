@@ -0,0 +1,118 @@
+package mongo
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/quan-xie/tuba/util/xtime"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type memTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]bson.Raw
+}
+
+func (s *memTokenStore) Load(c context.Context, name string) (bson.Raw, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[name], nil
+}
+
+func (s *memTokenStore) Save(c context.Context, name string, token bson.Raw) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[name] = token
+	return nil
+}
+
+func TestStreamRetryDelay(t *testing.T) {
+	s := NewStream(nil, &StreamConfig{Backoff: xtime.Duration(time.Second), MaxBackoff: xtime.Duration(5 * time.Second)}, nil, nil)
+	for attempt, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 5 * time.Second, 40: 5 * time.Second} {
+		if got := s.retryDelay(attempt); got != want {
+			t.Errorf("retryDelay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestStreamHandle(t *testing.T) {
+	store := &memTokenStore{tokens: make(map[string]bson.Raw)}
+	calls := 0
+	s := NewStream(nil, &StreamConfig{Name: "users", Backoff: xtime.Duration(time.Millisecond)}, store, func(c context.Context, e *ChangeEvent) error {
+		if calls++; calls < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	token, _ := bson.Marshal(bson.M{"_data": "01"})
+	if err := s.handle(context.Background(), &ChangeEvent{ID: token}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+	if saved, _ := store.Load(context.Background(), "users"); string(saved) != string(token) {
+		t.Error("the token should be saved once the handler succeeds")
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.handler = func(c context.Context, e *ChangeEvent) error { return errors.New("unavailable") }
+	other, _ := bson.Marshal(bson.M{"_data": "02"})
+	if err := s.handle(c, &ChangeEvent{ID: other}); err != context.Canceled {
+		t.Errorf("handle() error = %v, want %v", err, context.Canceled)
+	}
+	if saved, _ := store.Load(context.Background(), "users"); string(saved) != string(token) {
+		t.Error("the token of a failed event should not be saved")
+	}
+}
+
+func TestStream(t *testing.T) {
+	client := newTestClient(t)
+	c := context.Background()
+	coll := client.Database("tuba_test").Collection("stream_users")
+	coll.Drop(c)
+	defer coll.Drop(c)
+	store := &memTokenStore{tokens: make(map[string]bson.Raw)}
+	events := make(chan *ChangeEvent, 8)
+	s := NewStream(client, &StreamConfig{Name: "users", Database: "tuba_test", Collection: "stream_users"}, store, func(c context.Context, e *ChangeEvent) error {
+		events <- e
+		return nil
+	})
+	// change streams need a replica set.
+	if _, err := coll.Watch(c, bson.A{}); err != nil {
+		t.Skipf("change streams unavailable: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := coll.InsertOne(c, bson.M{"_id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	next := func(want string) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.OperationType != want {
+				t.Errorf("event %s, want %s", e.OperationType, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event received", want)
+		}
+	}
+	next("insert")
+	// the stream goes on after the invalidate of the drop.
+	if err := coll.Drop(c); err != nil {
+		t.Fatal(err)
+	}
+	next("drop")
+	next("invalidate")
+	time.Sleep(500 * time.Millisecond)
+	if _, err := coll.InsertOne(c, bson.M{"_id": 2}); err != nil {
+		t.Fatal(err)
+	}
+	next("insert")
+}
@@ -0,0 +1,102 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/quan-xie/tuba/retry"
+	xmongo "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	_tranTimeout = 2 * time.Minute
+	_tranBackoff = 10 * time.Millisecond
+
+	labelTransientTransaction = "TransientTransactionError"
+	labelUnknownCommitResult  = "UnknownTransactionCommitResult"
+)
+
+// TxFunc is the body of a transaction, the operations must use sc as
+// their context to be part of the transaction.
+type TxFunc func(sc xmongo.SessionContext) error
+
+// SetRetrier sets the retrier used to back off between transaction retries.
+func (c *Client) SetRetrier(retrier retry.Retriable) {
+	c.retrier = retrier
+}
+
+// WithTransaction runs fn in a transaction on the primary with the read and
+// write concerns of the Config, and commits it when fn returns nil. The
+// transaction is retried with backoff when it fails with the
+// TransientTransactionError label, and its commit when it fails with the
+// UnknownTransactionCommitResult label, all within Config.TranTimeout, so
+// fn must be safe to run more than once.
+func (c *Client) WithTransaction(ctx context.Context, fn TxFunc) (err error) {
+	timeout := time.Duration(c.conf.TranTimeout)
+	if timeout <= 0 {
+		timeout = _tranTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	sess, err := c.StartSession()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer sess.EndSession(context.Background())
+	opts := options.Transaction().
+		SetReadPreference(readpref.Primary()).
+		SetReadConcern(readConcern(c.conf)).
+		SetWriteConcern(writeConcern(c.conf))
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && !sleep(ctx, c.retrier.NextInterval(attempt)) {
+			return errors.Wrapf(ctx.Err(), "transaction error(%v)", err)
+		}
+		if err = sess.StartTransaction(opts); err != nil {
+			return errors.WithStack(err)
+		}
+		if err = fn(xmongo.NewSessionContext(ctx, sess)); err != nil {
+			// the abort must run even when ctx expired.
+			sess.AbortTransaction(context.WithoutCancel(ctx))
+			if hasLabel(err, labelTransientTransaction) && ctx.Err() == nil {
+				continue
+			}
+			return
+		}
+		if err = c.commit(ctx, sess); err == nil || !hasLabel(err, labelTransientTransaction) || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// commit commits the transaction, retrying while its outcome is unknown.
+func (c *Client) commit(ctx context.Context, sess xmongo.Session) (err error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && !sleep(ctx, c.retrier.NextInterval(attempt)) {
+			return errors.Wrapf(ctx.Err(), "commit error(%v)", err)
+		}
+		// an interrupted commit has an unknown outcome, it isn't cancelled.
+		if err = sess.CommitTransaction(context.WithoutCancel(ctx)); err == nil {
+			return
+		}
+		var se xmongo.ServerError
+		if !hasLabel(err, labelUnknownCommitResult) || (errors.As(err, &se) && isMaxTimeMSExpired(se)) {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// hasLabel reports whether err carries the error label of the server.
+func hasLabel(err error, label string) bool {
+	var le xmongo.LabeledError
+	return errors.As(err, &le) && le.HasErrorLabel(label)
+}
+
+// isMaxTimeMSExpired reports whether the commit exceeded its max time, it
+// is not retried as another attempt would time out as well.
+func isMaxTimeMSExpired(se xmongo.ServerError) bool {
+	const errMaxTimeMSExpired = 50
+	return se.HasErrorCode(errMaxTimeMSExpired)
+}
@@ -0,0 +1,57 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	xmongo "go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestHasLabel(t *testing.T) {
+	err := errors.Wrap(xmongo.CommandError{Code: 112, Labels: []string{labelTransientTransaction}}, "update")
+	if !hasLabel(err, labelTransientTransaction) {
+		t.Error("hasLabel() should find the label of a wrapped error")
+	}
+	if hasLabel(err, labelUnknownCommitResult) || hasLabel(errors.New("boom"), labelTransientTransaction) {
+		t.Error("hasLabel() found a missing label")
+	}
+	if !isMaxTimeMSExpired(xmongo.CommandError{Code: 50}) {
+		t.Error("isMaxTimeMSExpired() should match code 50")
+	}
+}
+
+func TestWithTransaction(t *testing.T) {
+	client := newTestClient(t)
+	c := context.Background()
+	coll := client.Database("tuba_test").Collection("tx_users")
+	coll.Drop(c)
+	defer coll.Drop(c)
+	if _, err := coll.InsertOne(c, bson.M{"_id": 0}); err != nil {
+		t.Fatal(err)
+	}
+	want := errors.New("abort")
+	err := client.WithTransaction(c, func(sc xmongo.SessionContext) error {
+		if _, err := coll.InsertOne(sc, bson.M{"_id": 1}); err != nil {
+			return err
+		}
+		return want
+	})
+	if err != nil && errors.Cause(err) != want {
+		// transactions need a replica set.
+		t.Skipf("transactions unavailable: %v", err)
+	}
+	if n, _ := coll.CountDocuments(c, bson.M{"_id": 1}); n != 0 {
+		t.Error("aborted transaction should not insert")
+	}
+	if err = client.WithTransaction(c, func(sc xmongo.SessionContext) error {
+		_, err := coll.InsertOne(sc, bson.M{"_id": 2})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := coll.CountDocuments(c, bson.M{"_id": 2}); n != 1 {
+		t.Error("committed transaction should insert")
+	}
+}
@@ -0,0 +1,69 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/ecode"
+)
+
+// _stateCodes maps the SQLSTATE codes to ecode, see
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+var _stateCodes = map[pq.ErrorCode]ecode.Code{
+	"23505": ecode.Conflict,           // unique_violation
+	"23P01": ecode.Conflict,           // exclusion_violation
+	"40001": ecode.Conflict,           // serialization_failure
+	"40P01": ecode.Conflict,           // deadlock_detected
+	"55P03": ecode.Conflict,           // lock_not_available
+	"23503": ecode.RequestErr,         // foreign_key_violation
+	"23502": ecode.RequestErr,         // not_null_violation
+	"23514": ecode.RequestErr,         // check_violation
+	"42501": ecode.AccessDenied,       // insufficient_privilege
+	"28000": ecode.Unauthorized,       // invalid_authorization_specification
+	"28P01": ecode.Unauthorized,       // invalid_password
+	"57014": ecode.Deadline,           // query_canceled
+	"53300": ecode.ServiceUnavailable, // too_many_connections
+	"57P01": ecode.ServiceUnavailable, // admin_shutdown
+	"57P03": ecode.ServiceUnavailable, // cannot_connect_now
+}
+
+// _classCodes maps the SQLSTATE classes to ecode when the code itself is
+// not mapped.
+var _classCodes = map[pq.ErrorClass]ecode.Code{
+	"08": ecode.ServiceUnavailable, // connection_exception
+	"22": ecode.RequestErr,         // data_exception
+	"23": ecode.Conflict,           // integrity_constraint_violation
+	"40": ecode.Conflict,           // transaction_rollback
+	"53": ecode.ServiceUnavailable, // insufficient_resources
+}
+
+// Ecode maps err to an ecode: sql.ErrNoRows is ecode.NothingFound, postgres
+// errors are mapped by their SQLSTATE and the others are ecode.ServerErr.
+func Ecode(err error) ecode.Codes {
+	if err == nil {
+		return ecode.OK
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ecode.NothingFound
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ecode.Deadline
+	}
+	if errors.Is(err, context.Canceled) {
+		return ecode.Canceled
+	}
+	var pe *pq.Error
+	if !errors.As(err, &pe) {
+		return ecode.ServerErr
+	}
+	if code, ok := _stateCodes[pe.Code]; ok {
+		return code
+	}
+	if code, ok := _classCodes[pe.Code.Class()]; ok {
+		return code
+	}
+	return ecode.ServerErr
+}
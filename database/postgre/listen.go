@@ -0,0 +1,377 @@
+package postgre
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+const (
+	_listenMinReconnect = time.Second
+	_listenMaxReconnect = time.Minute
+	_listenPingInterval = 90 * time.Second
+	_listenBuffer       = 64
+	// postgres rejects NOTIFY payloads of 8000 bytes or more.
+	_notifyMaxPayload = 7999
+)
+
+var (
+	// ErrPayloadTooLarge is returned by Notify when the payload can't be sent.
+	ErrPayloadTooLarge = errors.New("postgre: notify payload too large")
+	// ErrSubscriberClosed is returned by Subscribe after Close.
+	ErrSubscriberClosed = errors.New("postgre: subscriber closed")
+)
+
+// ListenConfig is the config of a Subscriber.
+type ListenConfig struct {
+	DSN          string         // data source name of the dedicated connection.
+	MinReconnect xtime.Duration // first reconnect interval, 1s by default.
+	MaxReconnect xtime.Duration // max reconnect interval, 1m by default.
+	PingInterval xtime.Duration // health check of an idle connection, 90s by default.
+	Buffer       int            // notifications queued per channel, 64 by default, the ones over it are dropped.
+}
+
+// Handler handles the payload of a notification, c is canceled when the
+// Subscriber is closed.
+type Handler func(c context.Context, channel, payload string)
+
+// listener is the dedicated connection, a *pq.Listener.
+type listener interface {
+	Listen(channel string) error
+	Unlisten(channel string) error
+	Ping() error
+	Close() error
+	NotificationChannel() <-chan *pq.Notification
+}
+
+// Subscriber holds a dedicated connection listening to channels and
+// dispatches the notifications to the handlers of their channel. The
+// connection is re-established and the channels listened again after
+// failures, notifications sent meanwhile are lost and reported to the
+// OnReconnect hook.
+//
+// Every channel has a goroutine of its own running its handlers, one
+// notification after the other in the order they were sent, so that a slow
+// handler delays its channel only. The notifications arriving while
+// ListenConfig.Buffer of them are queued are dropped and logged.
+type Subscriber struct {
+	conf     *ListenConfig
+	listener listener
+	ctx      context.Context
+	cancel   func()
+
+	mu          sync.RWMutex
+	channels    map[string]*channel
+	onReconnect func()
+	wg          sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+// channel is a listened channel and the queue of its notifications.
+type channel struct {
+	name     string
+	handlers []*subscription
+	queue    chan *pq.Notification
+	stopped  bool          // the queue is closed.
+	closing  bool          // unsubscribed, gone is closed once unlistened.
+	listened chan struct{} // closed when Listen returns, err is set then.
+	err      error
+	gone     chan struct{}
+}
+
+type subscription struct {
+	h Handler
+}
+
+// NewSubscriber connects to the database and starts dispatching.
+func NewSubscriber(c *ListenConfig) *Subscriber {
+	s := newSubscriber(c)
+	s.listener = pq.NewListener(c.DSN, time.Duration(c.MinReconnect), time.Duration(c.MaxReconnect), s.event)
+	go s.dispatch()
+	return s
+}
+
+func newSubscriber(c *ListenConfig) *Subscriber {
+	if c.MinReconnect <= 0 {
+		c.MinReconnect = xtime.Duration(_listenMinReconnect)
+	}
+	if c.MaxReconnect <= 0 {
+		c.MaxReconnect = xtime.Duration(_listenMaxReconnect)
+	}
+	if c.PingInterval <= 0 {
+		c.PingInterval = xtime.Duration(_listenPingInterval)
+	}
+	if c.Buffer <= 0 {
+		c.Buffer = _listenBuffer
+	}
+	s := &Subscriber{
+		conf:     c,
+		channels: make(map[string]*channel),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// OnReconnect sets the hook called after the connection is re-established,
+// such as to drop a whole cache whose invalidations may have been lost.
+func (s *Subscriber) OnReconnect(fn func()) {
+	s.mu.Lock()
+	s.onReconnect = fn
+	s.mu.Unlock()
+}
+
+// Subscribe adds a handler of the channel, the channel is listened on the
+// first handler. It waits until the channel is listened or c is done, the
+// handler isn't added when it returns an error.
+func (s *Subscriber) Subscribe(c context.Context, name string, h Handler) error {
+	sub := &subscription{h: h}
+	for {
+		s.mu.Lock()
+		select {
+		case <-s.closed:
+			s.mu.Unlock()
+			return ErrSubscriberClosed
+		default:
+		}
+		ch := s.channels[name]
+		if ch != nil && ch.closing {
+			// wait for the pending Unsubscribe before listening again.
+			s.mu.Unlock()
+			select {
+			case <-ch.gone:
+				continue
+			case <-c.Done():
+				return errors.WithStack(c.Err())
+			}
+		}
+		if ch == nil {
+			ch = s.listen(name)
+		}
+		ch.handlers = append(ch.handlers, sub)
+		s.mu.Unlock()
+		select {
+		case <-ch.listened:
+			if ch.err == nil {
+				return nil
+			}
+			s.mu.Lock()
+			if s.channels[name] == ch {
+				delete(s.channels, name)
+				ch.stop()
+			}
+			s.mu.Unlock()
+			return errors.Wrapf(ch.err, "listen %s", name)
+		case <-c.Done():
+			s.remove(ch, sub)
+			return errors.WithStack(c.Err())
+		}
+	}
+}
+
+// listen adds the channel and listens to it in the background, s.mu is held.
+func (s *Subscriber) listen(name string) *channel {
+	ch := &channel{
+		name:     name,
+		queue:    make(chan *pq.Notification, s.conf.Buffer),
+		listened: make(chan struct{}),
+		gone:     make(chan struct{}),
+	}
+	s.channels[name] = ch
+	s.wg.Add(1)
+	go s.work(ch)
+	go func() {
+		if err := s.listener.Listen(name); err != nil && err != pq.ErrChannelAlreadyOpen {
+			ch.err = err
+		}
+		close(ch.listened)
+	}()
+	return ch
+}
+
+// remove removes the handler of a Subscribe which gave up.
+func (s *Subscriber) remove(ch *channel, sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hs := make([]*subscription, 0, len(ch.handlers))
+	for _, h := range ch.handlers {
+		if h != sub {
+			hs = append(hs, h)
+		}
+	}
+	ch.handlers = hs
+}
+
+// stop closes the queue of the channel, s.mu is held.
+func (ch *channel) stop() {
+	if !ch.stopped {
+		ch.stopped = true
+		close(ch.queue)
+	}
+}
+
+// Unsubscribe removes all the handlers of the channel and stops listening to
+// it, it waits until the channel is unlistened or c is done.
+func (s *Subscriber) Unsubscribe(c context.Context, name string) error {
+	s.mu.Lock()
+	ch := s.channels[name]
+	if ch == nil || ch.closing {
+		s.mu.Unlock()
+		return nil
+	}
+	ch.closing = true
+	ch.handlers = nil
+	ch.stop()
+	s.mu.Unlock()
+	errc := make(chan error, 1)
+	go func() {
+		<-ch.listened
+		err := s.listener.Unlisten(name)
+		s.mu.Lock()
+		if s.channels[name] == ch {
+			delete(s.channels, name)
+		}
+		s.mu.Unlock()
+		close(ch.gone)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err != nil && err != pq.ErrChannelNotOpen {
+			return errors.Wrapf(err, "unlisten %s", name)
+		}
+		return nil
+	case <-c.Done():
+		return errors.WithStack(c.Err())
+	}
+}
+
+// Close stops listening, cancels the context of the running handlers, waits
+// for them and closes the connection. The later calls return the error of
+// the first one.
+func (s *Subscriber) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.closed)
+		for _, ch := range s.channels {
+			ch.stop()
+		}
+		s.mu.Unlock()
+		s.cancel()
+		<-s.done
+		s.wg.Wait()
+		s.closeErr = errors.WithStack(s.listener.Close())
+	})
+	return s.closeErr
+}
+
+func (s *Subscriber) dispatch() {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Duration(s.conf.PingInterval))
+	defer ticker.Stop()
+	notify := s.listener.NotificationChannel()
+	for {
+		select {
+		case n := <-notify:
+			// a nil notification follows a reconnection.
+			if n != nil {
+				s.enqueue(n)
+			}
+		case <-ticker.C:
+			go func() {
+				if err := s.listener.Ping(); err != nil {
+					log.Warnf("%s listener ping error(%v)", _family, err)
+				}
+			}()
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// enqueue queues the notification to the goroutine of its channel.
+func (s *Subscriber) enqueue(n *pq.Notification) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ch := s.channels[n.Channel]
+	if ch == nil || ch.stopped {
+		return
+	}
+	select {
+	case ch.queue <- n:
+	default:
+		log.Errorf("%s listener queue of %s full, notification dropped", _family, n.Channel)
+	}
+}
+
+// work runs the handlers of the notifications of the channel until it is
+// unsubscribed or the Subscriber closed.
+func (s *Subscriber) work(ch *channel) {
+	defer s.wg.Done()
+	for n := range ch.queue {
+		s.mu.RLock()
+		hs := ch.handlers
+		s.mu.RUnlock()
+		for _, sub := range hs {
+			s.handle(sub.h, n)
+		}
+	}
+}
+
+func (s *Subscriber) handle(h Handler, n *pq.Notification) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf("%s listener handler of %s panic(%v)", _family, n.Channel, p)
+		}
+	}()
+	h(s.ctx, n.Channel, n.Extra)
+}
+
+func (s *Subscriber) event(ev pq.ListenerEventType, err error) {
+	switch ev {
+	case pq.ListenerEventConnected:
+		log.Infof("%s listener connected", _family)
+	case pq.ListenerEventDisconnected:
+		log.Warnf("%s listener disconnected error(%v)", _family, err)
+	case pq.ListenerEventReconnected:
+		log.Infof("%s listener reconnected", _family)
+		s.mu.RLock()
+		fn := s.onReconnect
+		s.mu.RUnlock()
+		if fn != nil {
+			go fn()
+		}
+	case pq.ListenerEventConnectionAttemptFailed:
+		log.Errorf("%s listener connect error(%v)", _family, err)
+	}
+}
+
+// Notify sends a notification on the master instance.
+func (db *DB) Notify(c context.Context, channel, payload string) (err error) {
+	if len(payload) > _notifyMaxPayload {
+		return ErrPayloadTooLarge
+	}
+	_, err = db.Exec(c, "SELECT pg_notify($1, $2)", channel, payload)
+	return
+}
+
+// Notify queues a notification which is sent when the transaction commits
+// and dropped when it rolls back.
+func (tx *Tx) Notify(channel, payload string) (err error) {
+	if len(payload) > _notifyMaxPayload {
+		return ErrPayloadTooLarge
+	}
+	_, err = tx.Exec("SELECT pg_notify($1, $2)", channel, payload)
+	return
+}
@@ -1 +1,48 @@
 package postgre
+
+import (
+	"time"
+
+	xsql "github.com/quan-xie/tuba/database/sql"
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+type Config struct {
+	DSN          string         // write data source name.
+	ReadDSN      []string       // read data source name.
+	Active       int            // pool
+	Idle         int            // pool
+	IdleTimeout  xtime.Duration // connect max life time.
+	QueryTimeout xtime.Duration // query sql timeout
+	ExecTimeout  xtime.Duration // execute sql timeout
+	TranTimeout  xtime.Duration // transaction sql timeout
+	TranRetry    int            // retry times of a transaction aborted by a serialization failure or deadlock, 3 by default, negative disables it.
+	TranBackoff  xtime.Duration // backoff interval between transaction retries, 10ms by default.
+	// SlowLogDuration statements slower than it are logged, 250ms by default.
+	SlowLogDuration xtime.Duration
+	// Breaker enables a circuit breaker per instance when it is set.
+	Breaker *xsql.Breaker
+}
+
+// NewPostgre new db instance .
+func NewPostgre(c *Config) (db *DB) {
+	if c.QueryTimeout == 0 {
+		log.Warnf("NewPostgre QueryTimeout is c.QueryTimeout=%d", c.QueryTimeout)
+		c.QueryTimeout = xtime.Duration(20 * time.Second)
+	}
+	if c.ExecTimeout == 0 {
+		log.Warnf("NewPostgre ExecTimeout is c.ExecTimeout=%d", c.ExecTimeout)
+		c.ExecTimeout = xtime.Duration(20 * time.Second)
+	}
+	if c.TranTimeout == 0 {
+		log.Warnf("NewPostgre TranTimeout is c.TranTimeout=%d", c.TranTimeout)
+		c.TranTimeout = xtime.Duration(2 * time.Second)
+	}
+	db, err := Open(c)
+	if err != nil {
+		log.Errorf("open postgre error(%v)", err)
+		panic(err)
+	}
+	return
+}
@@ -0,0 +1,227 @@
+package postgre
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	xsql "github.com/quan-xie/tuba/database/sql"
+)
+
+const _family = "postgre_client"
+
+var (
+	ErrNoMaster = xsql.ErrNoMaster
+	// ErrNoRows is returned by Scan when QueryRow doesn't return a row.
+	ErrNoRows = sql.ErrNoRows
+	// ErrTxDone transaction done.
+	ErrTxDone = sql.ErrTxDone
+)
+
+// _dialect runs the database/sql wrappers, with their slow log, breaker and
+// replica routing, against postgres.
+var _dialect = &xsql.Dialect{
+	Rebind:    Rebind,
+	Addr:      parseDSN,
+	Retryable: isRetryableTx,
+}
+
+// DB database, the statements are written with ? placeholders like the
+// mysql DB, or with the $1, $2... placeholders of postgres.
+type DB struct {
+	*xsql.DB
+	master *DB
+}
+
+// Tx transaction.
+type Tx struct {
+	*xsql.Tx
+}
+
+// Rows rows.
+type Rows = xsql.Rows
+
+// Row row.
+type Row = xsql.Row
+
+// Open create a postgres database .
+func Open(c *Config) (*DB, error) {
+	d, err := xsql.Open(&xsql.Config{
+		Driver:          "postgres",
+		DSN:             c.DSN,
+		ReadDSN:         c.ReadDSN,
+		Active:          c.Active,
+		Idle:            c.Idle,
+		IdleTimeout:     c.IdleTimeout,
+		QueryTimeout:    c.QueryTimeout,
+		ExecTimeout:     c.ExecTimeout,
+		TranTimeout:     c.TranTimeout,
+		TranRetry:       c.TranRetry,
+		TranBackoff:     c.TranBackoff,
+		SlowLogDuration: c.SlowLogDuration,
+		Breaker:         c.Breaker,
+		Dialect:         _dialect,
+	})
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{DB: d}
+	db.master = &DB{DB: d.Master()}
+	return db, nil
+}
+
+// parseDSN parse dsn name and return addr, both URL and key=value DSNs
+// are accepted.
+func parseDSN(dsn string) (addr string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return ""
+		}
+		return u.Host
+	}
+	var host, port string
+	for _, kv := range strings.Fields(dsn) {
+		switch {
+		case strings.HasPrefix(kv, "host="):
+			host = strings.TrimPrefix(kv, "host=")
+		case strings.HasPrefix(kv, "port="):
+			port = strings.TrimPrefix(kv, "port=")
+		}
+	}
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
+
+// isRetryableTx reports whether err aborted the transaction because of a
+// serialization failure or a deadlock.
+func isRetryableTx(err error) bool {
+	var pe *pq.Error
+	if !errors.As(err, &pe) {
+		return false
+	}
+	return pe.Code == "40001" || pe.Code == "40P01"
+}
+
+// Begin starts a transaction on the master instance.
+func (db *DB) Begin(c context.Context) (*Tx, error) {
+	tx, err := db.DB.Begin(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx}, nil
+}
+
+// BeginTx starts a transaction with the given options on the master instance.
+func (db *DB) BeginTx(c context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTx(c, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx}, nil
+}
+
+// Master is postgres master instance
+func (db *DB) Master() *DB {
+	if db.master == nil {
+		panic(ErrNoMaster)
+	}
+	return db.master
+}
+
+// Rebind turns the ? placeholders of query into the $1, $2... placeholders
+// of postgres, the DB calls it on every statement. Question marks within
+// quotes, comments and dollar quoted bodies are left as they are, write ??
+// for the jsonb ? operator.
+func Rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var (
+		b strings.Builder
+		n int
+	)
+	b.Grow(len(query) + 8)
+	for i := 0; i < len(query); {
+		end := i + 1
+		switch c := query[i]; {
+		case c == '\'' || c == '"':
+			end = skipTo(query, i+1, query[i:i+1])
+		case strings.HasPrefix(query[i:], "--"):
+			end = skipTo(query, i+2, "\n")
+		case strings.HasPrefix(query[i:], "/*"):
+			end = skipComment(query, i)
+		case c == '$':
+			if tag := dollarTag(query[i:]); tag != "" {
+				end = skipTo(query, i+len(tag), tag)
+			}
+		case strings.HasPrefix(query[i:], "??"):
+			b.WriteByte('?')
+			i += 2
+			continue
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			i++
+			continue
+		}
+		b.WriteString(query[i:end])
+		i = end
+	}
+	return b.String()
+}
+
+// skipTo returns the index after the first sep of query from i, or the end
+// of query when there is none.
+func skipTo(query string, i int, sep string) int {
+	if j := strings.Index(query[i:], sep); j >= 0 {
+		return i + j + len(sep)
+	}
+	return len(query)
+}
+
+// skipComment returns the index after the block comment starting at i,
+// postgres block comments nest.
+func skipComment(query string, i int) int {
+	depth := 0
+	for i < len(query) {
+		switch {
+		case strings.HasPrefix(query[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(query[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// dollarTag returns the $tag$ opening a dollar quoted string at the start of
+// s, or an empty string when s starts with a parameter such as $1.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+		case c >= '0' && c <= '9' && i > 1:
+		default:
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	_batchMaxRows  = 500
+	_batchMaxBytes = 1 << 20 // keep far below the 4MB default max_allowed_packet.
+	// mysql refuses statements of more placeholders.
+	_batchMaxPlaceholders = 65535
+)
+
+// BatchConfig is the config of a BatchWriter.
+type BatchConfig struct {
+	MaxRows     int  // rows of a multi-row INSERT, 500 by default, fewer when they exceed 65535 placeholders
+	MaxBytes    int  // estimated size of a multi-row INSERT, 1MB by default
+	ChunksPerTx int  // chunks committed in one transaction, 1 by default
+	Upsert      bool // append ON DUPLICATE KEY UPDATE
+	// UpdateColumns are overwritten on duplicate key in upsert mode, all the
+	// columns by default.
+	UpdateColumns []string
+}
+
+// BatchWriter writes rows with chunked multi-row INSERT statements.
+type BatchWriter struct {
+	db      *DB
+	table   string
+	columns []string
+	conf    *BatchConfig
+}
+
+// ChunkResult is the result of a chunk of rows.
+type ChunkResult struct {
+	Offset       int   // index of the first row of the chunk
+	Rows         int   // rows of the chunk
+	RowsAffected int64 // rows affected reported by mysql
+	Err          error
+}
+
+// BatchResult is the result of BatchWriter.Write.
+type BatchResult struct {
+	Chunks       []*ChunkResult
+	RowsAffected int64
+	Failed       []*ChunkResult
+}
+
+// NewBatchWriter returns a writer inserting rows of columns into table.
+func (db *DB) NewBatchWriter(table string, columns []string, c *BatchConfig) *BatchWriter {
+	if c == nil {
+		c = &BatchConfig{}
+	}
+	if c.MaxRows <= 0 {
+		c.MaxRows = _batchMaxRows
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = _batchMaxBytes
+	}
+	if c.ChunksPerTx <= 0 {
+		c.ChunksPerTx = 1
+	}
+	if c.Upsert && len(c.UpdateColumns) == 0 {
+		c.UpdateColumns = columns
+	}
+	return &BatchWriter{db: db, table: table, columns: columns, conf: c}
+}
+
+// Write splits rows into chunks bounded by MaxRows and MaxBytes and inserts
+// them, ChunksPerTx chunks per transaction. A failed transaction fails all
+// its chunks and doesn't stop the following ones, the failures are reported
+// in the result and the returned error is the first of them. When c is done
+// the chunks not sent yet fail with its error.
+func (w *BatchWriter) Write(c context.Context, rows [][]interface{}) (res *BatchResult, err error) {
+	res = &BatchResult{}
+	chunks := w.split(rows)
+	for i := 0; i < len(chunks); i += w.conf.ChunksPerTx {
+		if cerr := c.Err(); cerr != nil {
+			// the chunks left are not sent.
+			for _, chunk := range chunks[i:] {
+				chunk.Err = cerr
+				res.Failed = append(res.Failed, chunk)
+			}
+			res.Chunks = append(res.Chunks, chunks[i:]...)
+			break
+		}
+		group := chunks[i:min(i+w.conf.ChunksPerTx, len(chunks))]
+		txErr := w.db.WithTx(c, nil, func(tx *Tx) error {
+			for _, chunk := range group {
+				r, err := tx.ExecBuilder(w.insert(rows[chunk.Offset : chunk.Offset+chunk.Rows]))
+				if err != nil {
+					return err
+				}
+				chunk.RowsAffected, _ = r.RowsAffected()
+			}
+			return nil
+		})
+		for _, chunk := range group {
+			if txErr != nil {
+				chunk.RowsAffected, chunk.Err = 0, txErr
+				res.Failed = append(res.Failed, chunk)
+			}
+			res.RowsAffected += chunk.RowsAffected
+		}
+		res.Chunks = append(res.Chunks, group...)
+	}
+	if len(res.Failed) > 0 {
+		f := res.Failed[0]
+		err = errors.Wrapf(f.Err, "batch insert %s: %d of %d chunks failed, first at row %d", w.table, len(res.Failed), len(res.Chunks), f.Offset)
+	}
+	return
+}
+
+func (w *BatchWriter) insert(rows [][]interface{}) *InsertBuilder {
+	b := NewInsert(w.table, w.columns...)
+	for _, row := range rows {
+		b.Values(row...)
+	}
+	if w.conf.Upsert {
+		b.OnDuplicateKeyUpdate(w.conf.UpdateColumns...)
+	}
+	return b
+}
+
+// split cuts rows into chunks respecting MaxRows, MaxBytes and the
+// placeholders limit of mysql, a chunk holds at least one row.
+func (w *BatchWriter) split(rows [][]interface{}) (chunks []*ChunkResult) {
+	var chunk *ChunkResult
+	overhead := w.overhead()
+	size, params := 0, 0
+	for i, row := range rows {
+		n := rowSize(row)
+		if chunk == nil || chunk.Rows >= w.conf.MaxRows || size+n > w.conf.MaxBytes || params+len(row) > _batchMaxPlaceholders {
+			chunk = &ChunkResult{Offset: i}
+			chunks = append(chunks, chunk)
+			size, params = overhead, 0
+		}
+		chunk.Rows++
+		size += n
+		params += len(row)
+	}
+	return
+}
+
+// overhead returns the bytes of the statement besides its rows.
+func (w *BatchWriter) overhead() int {
+	row := make([]interface{}, len(w.columns))
+	query, _, _ := w.insert([][]interface{}{row}).ToSQL()
+	return len(query) - len(placeholders(len(row)))
+}
+
+// rowSize estimates the bytes taken by row in the statement packet.
+func rowSize(row []interface{}) (n int) {
+	n = 4 // "(), "
+	for _, v := range row {
+		switch v := v.(type) {
+		case string:
+			n += len(v) + 4
+		case []byte:
+			n += len(v) + 4
+		case nil:
+			n += 5
+		case fmt.Stringer:
+			n += len(v.String()) + 4
+		default:
+			n += 12
+		}
+	}
+	return
+}
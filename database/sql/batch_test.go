@@ -0,0 +1,107 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestBatchWriterSplit(t *testing.T) {
+	db := &DB{}
+	rows := make([][]interface{}, 0, 10)
+	for i := 0; i < 10; i++ {
+		rows = append(rows, []interface{}{i, "name"})
+	}
+	w := db.NewBatchWriter("user", []string{"id", "name"}, &BatchConfig{MaxRows: 4})
+	chunks := w.split(rows)
+	if len(chunks) != 3 || chunks[2].Offset != 8 || chunks[2].Rows != 2 {
+		t.Errorf("split() by rows = %+v %+v %+v", chunks[0], chunks[1], chunks[2])
+	}
+	w = db.NewBatchWriter("user", []string{"id", "name"}, &BatchConfig{})
+	w.conf.MaxBytes = w.overhead() + 2*rowSize(rows[0])
+	if chunks = w.split(rows); len(chunks) != 5 {
+		t.Errorf("split() by bytes got %d chunks, want 5", len(chunks))
+	}
+	if w.overhead() != len("INSERT INTO user (id, name) VALUES ") {
+		t.Errorf("overhead() = %d", w.overhead())
+	}
+	big := [][]interface{}{{1, strings.Repeat("x", 100)}}
+	if chunks = w.split(big); len(chunks) != 1 || chunks[0].Rows != 1 {
+		t.Errorf("split() should keep an oversized row in its own chunk")
+	}
+}
+
+func TestBatchWriterSplitPlaceholders(t *testing.T) {
+	columns := make([]string, 200)
+	row := make([]interface{}, len(columns))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("c%d", i)
+	}
+	rows := make([][]interface{}, 500)
+	for i := range rows {
+		rows[i] = row
+	}
+	w := (&DB{}).NewBatchWriter("wide", columns, &BatchConfig{MaxBytes: 1 << 30})
+	for _, chunk := range w.split(rows) {
+		if chunk.Rows*len(columns) > _batchMaxPlaceholders {
+			t.Errorf("chunk at %d has %d placeholders", chunk.Offset, chunk.Rows*len(columns))
+		}
+	}
+}
+
+func TestBatchWriterUpsert(t *testing.T) {
+	w := (&DB{}).NewBatchWriter("user", []string{"id", "name"}, &BatchConfig{Upsert: true, UpdateColumns: []string{"name"}})
+	query, args, err := w.insert([][]interface{}{{1, "a"}, {2, "b"}}).ToSQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO user (id, name) VALUES (?, ?), (?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name)"; query != want {
+		t.Errorf("insert() = %s, want %s", query, want)
+	}
+	if len(args) != 4 {
+		t.Errorf("insert() args = %v", args)
+	}
+}
+
+func TestBatchWriterWrite(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	rows := [][]interface{}{{1, "a"}, {2, "b"}, {3, "c"}, {4, "d"}, {5, "e"}}
+	d.ExpectBegin()
+	d.ExpectExec(`^INSERT INTO user \(id, name\) VALUES \(\?, \?\), \(\?, \?\)$`).WithArgs(1, "a", 2, "b").WillReturnResult(0, 2)
+	d.ExpectCommit()
+	d.ExpectBegin()
+	d.ExpectExec(`^INSERT INTO user`).WithArgs(3, "c", 4, "d").WillReturnError(errors.New("duplicate entry"))
+	d.ExpectRollback()
+	d.ExpectBegin()
+	d.ExpectExec(`^INSERT INTO user`).WithArgs(5, "e").WillReturnResult(0, 1)
+	d.ExpectCommit()
+
+	w := db.NewBatchWriter("user", []string{"id", "name"}, &BatchConfig{MaxRows: 2})
+	res, err := w.Write(context.Background(), rows)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 chunks failed, first at row 2") {
+		t.Errorf("Write() error = %v", err)
+	}
+	if res.RowsAffected != 3 || len(res.Chunks) != 3 {
+		t.Errorf("Write() = %d rows affected, %d chunks", res.RowsAffected, len(res.Chunks))
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Offset != 2 || res.Failed[0].Rows != 2 || res.Failed[0].Err == nil {
+		t.Errorf("Failed = %+v", res.Failed)
+	}
+}
+
+func TestBatchWriterWriteCanceled(t *testing.T) {
+	db, _ := openTest(t, &Config{})
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := db.NewBatchWriter("user", []string{"id", "name"}, &BatchConfig{MaxRows: 1})
+	res, err := w.Write(c, [][]interface{}{{1, "a"}, {2, "b"}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Write() error = %v, want canceled", err)
+	}
+	if len(res.Chunks) != 2 || len(res.Failed) != 2 || res.Failed[1].Offset != 1 || res.Failed[1].Err != context.Canceled {
+		t.Errorf("Write() = %+v, want the 2 chunks failed", res)
+	}
+}
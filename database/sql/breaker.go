@@ -0,0 +1,107 @@
+package sql
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v3"
+	"github.com/go-sql-driver/mysql"
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/ecode"
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+const (
+	// mysql server errors that mean the instance can't serve connections.
+	_errConCount       = 1040
+	_errServerShutdown = 1053
+)
+
+// Breaker is the circuit breaker config of every mysql instance, only
+// connection level errors are counted as failures.
+type Breaker struct {
+	CounterResetInterval xtime.Duration // interval to reset the failure counter
+	Threshold            int64          // failures to open the breaker
+	OpenTimeout          xtime.Duration // time to stay open before half-open
+	HalfOpenMaxSuccesses int64          // successes to close a half-open breaker
+}
+
+func newBreaker(c *Breaker, addr string) *circuitbreaker.CircuitBreaker {
+	if c.CounterResetInterval == 0 {
+		c.CounterResetInterval = xtime.Duration(time.Minute)
+	}
+	if c.Threshold == 0 {
+		c.Threshold = 5
+	}
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = xtime.Duration(10 * time.Second)
+	}
+	if c.HalfOpenMaxSuccesses == 0 {
+		c.HalfOpenMaxSuccesses = 10
+	}
+	return circuitbreaker.New(
+		circuitbreaker.WithCounterResetInterval(time.Duration(c.CounterResetInterval)),
+		circuitbreaker.WithTripFunc(circuitbreaker.NewTripFuncThreshold(c.Threshold)),
+		circuitbreaker.WithOpenTimeout(time.Duration(c.OpenTimeout)),
+		circuitbreaker.WithOpenTimeoutBackOff(backoff.NewExponentialBackOff()),
+		circuitbreaker.WithHalfOpenMaxSuccesses(c.HalfOpenMaxSuccesses),
+		circuitbreaker.WithOnStateChangeHookFn(func(from, to circuitbreaker.State) {
+			log.Warnf("%s breaker of %s state changed from %s to %s", _family, addr, from, to)
+		}),
+	)
+}
+
+// ready reports whether the instance accepts statements.
+func (db *conn) ready() bool {
+	return db.breaker == nil || db.breaker.Ready()
+}
+
+// allow rejects the statement with ecode.ServiceUnavailable when the
+// breaker of the instance is open.
+func (db *conn) allow() error {
+	if db.ready() {
+		return nil
+	}
+	return errors.Wrapf(ecode.ServiceUnavailable, "%s breaker of %s is open", _family, db.addr)
+}
+
+// done reports the statement result to the breaker.
+func (db *conn) done(err error) {
+	if db.breaker == nil {
+		return
+	}
+	if isConnErr(err) {
+		db.breaker.Fail()
+		return
+	}
+	db.breaker.Success()
+}
+
+// isConnErr reports whether err means the instance is unreachable or
+// refuses connections, statement errors such as a duplicate key don't count
+// and neither do the context errors, a slow query or a short deadline of the
+// caller says nothing about the instance.
+func isConnErr(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		return me.Number == _errConCount || me.Number == _errServerShutdown
+	}
+	return false
+}
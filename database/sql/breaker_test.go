@@ -0,0 +1,61 @@
+package sql
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/ecode"
+)
+
+func TestIsConnErr(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{driver.ErrBadConn, true},
+		{errors.Wrap(mysql.ErrInvalidConn, "query:SELECT 1"), true},
+		{context.DeadlineExceeded, false},
+		{errors.Wrap(context.DeadlineExceeded, "query:SELECT SLEEP(10)"), false},
+		{context.Canceled, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{syscall.ECONNRESET, true},
+		{&mysql.MySQLError{Number: _errConCount}, true},
+		{&mysql.MySQLError{Number: 1062}, false},
+	}
+	for _, tt := range tests {
+		if got := isConnErr(tt.err); got != tt.want {
+			t.Errorf("isConnErr(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestReadConnFailover(t *testing.T) {
+	c := &Config{Breaker: &Breaker{Threshold: 1}}
+	db := &DB{
+		write: newConn(c, nil, "master"),
+		read:  []*conn{newConn(c, nil, "replica1"), newConn(c, nil, "replica2")},
+	}
+	db.read[0].done(driver.ErrBadConn)
+	if db.read[0].ready() {
+		t.Fatal("breaker of replica1 should be open")
+	}
+	if err := db.read[0].allow(); !ecode.EqualError(ecode.ServiceUnavailable, err) {
+		t.Errorf("allow() = %v, want %v", err, ecode.ServiceUnavailable)
+	}
+	for i := 0; i < 4; i++ {
+		if cn := db.readConn(context.Background()); cn.addr != "replica2" {
+			t.Errorf("readConn() = %s, want replica2", cn.addr)
+		}
+	}
+	db.read[1].done(driver.ErrBadConn)
+	if cn := db.readConn(context.Background()); cn.addr != "master" {
+		t.Errorf("readConn() with every breaker open = %s, want master", cn.addr)
+	}
+}
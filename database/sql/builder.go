@@ -0,0 +1,586 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrEmptyWhere is returned when an UPDATE or DELETE has no condition.
+	ErrEmptyWhere = errors.New("sql: UPDATE or DELETE without WHERE")
+	// ErrEmptyValues is returned when an INSERT or UPDATE has nothing to write.
+	ErrEmptyValues = errors.New("sql: INSERT or UPDATE without values")
+)
+
+// Builder builds a statement made of placeholders and its args.
+type Builder interface {
+	ToSQL() (query string, args []interface{}, err error)
+}
+
+// Cond is a composable WHERE condition.
+type Cond interface {
+	build(b *condBuilder)
+}
+
+// condBuilder writes the conditions and collects their args, the first
+// error of a condition is returned by ToSQL.
+type condBuilder struct {
+	strings.Builder
+	args []interface{}
+	err  error
+}
+
+// cond writes the condition, a raw expression is parenthesized so that its
+// own OR doesn't bind to the conditions around it.
+func (b *condBuilder) cond(c Cond) {
+	if _, ok := c.(expr); ok {
+		b.WriteByte('(')
+		c.build(b)
+		b.WriteByte(')')
+		return
+	}
+	c.build(b)
+}
+
+// result returns the statement built, or the first error of its conditions.
+func (b *condBuilder) result() (query string, args []interface{}, err error) {
+	if b.err != nil {
+		return "", nil, b.err
+	}
+	return b.String(), b.args, nil
+}
+
+type condFunc func(b *condBuilder)
+
+func (f condFunc) build(b *condBuilder) {
+	f(b)
+}
+
+func compare(column, op string, v interface{}) Cond {
+	return condFunc(func(b *condBuilder) {
+		b.WriteString(column)
+		b.WriteString(op)
+		b.WriteByte('?')
+		b.args = append(b.args, v)
+	})
+}
+
+// Eq is column = v.
+func Eq(column string, v interface{}) Cond { return compare(column, " = ", v) }
+
+// Neq is column <> v.
+func Neq(column string, v interface{}) Cond { return compare(column, " <> ", v) }
+
+// Gt is column > v.
+func Gt(column string, v interface{}) Cond { return compare(column, " > ", v) }
+
+// Gte is column >= v.
+func Gte(column string, v interface{}) Cond { return compare(column, " >= ", v) }
+
+// Lt is column < v.
+func Lt(column string, v interface{}) Cond { return compare(column, " < ", v) }
+
+// Lte is column <= v.
+func Lte(column string, v interface{}) Cond { return compare(column, " <= ", v) }
+
+// Like is column LIKE v.
+func Like(column string, v interface{}) Cond { return compare(column, " LIKE ", v) }
+
+// IsNull is column IS NULL.
+func IsNull(column string) Cond { return suffix(column, " IS NULL") }
+
+// IsNotNull is column IS NOT NULL.
+func IsNotNull(column string) Cond { return suffix(column, " IS NOT NULL") }
+
+func suffix(column, op string) Cond {
+	return condFunc(func(b *condBuilder) {
+		b.WriteString(column)
+		b.WriteString(op)
+	})
+}
+
+// In is column IN (?, ...), values must be a slice or an array, ToSQL fails
+// otherwise. An empty slice matches nothing, a []byte is a single value.
+func In(column string, values interface{}) Cond { return in(column, " IN ", "1 = 0", values) }
+
+// NotIn is column NOT IN (?, ...), values must be a slice or an array, ToSQL
+// fails otherwise. An empty slice matches everything, a []byte is a single
+// value.
+func NotIn(column string, values interface{}) Cond {
+	return in(column, " NOT IN ", "1 = 1", values)
+}
+
+func in(column, op, empty string, values interface{}) Cond {
+	return condFunc(func(b *condBuilder) {
+		v := reflect.ValueOf(values)
+		if values == nil {
+			b.WriteString(empty)
+			return
+		}
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			if b.err == nil {
+				b.err = errors.Errorf("sql: %s values of %s must be a slice, got %T", strings.TrimSpace(op), column, values)
+			}
+			return
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			b.WriteString(column)
+			b.WriteString(op)
+			b.WriteString("(?)")
+			b.args = append(b.args, values)
+			return
+		}
+		if v.Len() == 0 {
+			b.WriteString(empty)
+			return
+		}
+		b.WriteString(column)
+		b.WriteString(op)
+		b.WriteByte('(')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteByte('?')
+			b.args = append(b.args, v.Index(i).Interface())
+		}
+		b.WriteByte(')')
+	})
+}
+
+// expr is a raw condition, it is parenthesized next to other conditions.
+type expr struct {
+	query string
+	args  []interface{}
+}
+
+func (e expr) build(b *condBuilder) {
+	b.WriteString(e.query)
+	b.args = append(b.args, e.args...)
+}
+
+// Expr is a raw condition with its own placeholders.
+func Expr(query string, args ...interface{}) Cond {
+	return expr{query: query, args: args}
+}
+
+// And joins the conditions with AND, it matches everything without any.
+func And(conds ...Cond) Cond { return join(" AND ", "1 = 1", conds) }
+
+// Or joins the conditions with OR, it matches nothing without any.
+func Or(conds ...Cond) Cond { return join(" OR ", "1 = 0", conds) }
+
+// Not negates the condition.
+func Not(cond Cond) Cond {
+	return condFunc(func(b *condBuilder) {
+		b.WriteString("NOT (")
+		cond.build(b)
+		b.WriteByte(')')
+	})
+}
+
+func join(sep, empty string, conds []Cond) Cond {
+	return condFunc(func(b *condBuilder) {
+		switch len(conds) {
+		case 0:
+			b.WriteString(empty)
+			return
+		case 1:
+			b.cond(conds[0])
+			return
+		}
+		b.WriteByte('(')
+		for i, cond := range conds {
+			if i > 0 {
+				b.WriteString(sep)
+			}
+			b.cond(cond)
+		}
+		b.WriteByte(')')
+	})
+}
+
+// where writes the conditions joined with AND.
+func where(b *condBuilder, conds []Cond) {
+	if len(conds) == 0 {
+		return
+	}
+	b.WriteString(" WHERE ")
+	for i, cond := range conds {
+		if i > 0 {
+			b.WriteString(" AND ")
+		}
+		b.cond(cond)
+	}
+}
+
+// _noLimit is the largest LIMIT of mysql, which has no OFFSET without LIMIT.
+const _noLimit = "18446744073709551615"
+
+func limit(b *condBuilder, n, offset int) {
+	if n > 0 {
+		b.WriteString(" LIMIT ")
+		b.WriteString(strconv.Itoa(n))
+	} else if offset > 0 {
+		b.WriteString(" LIMIT " + _noLimit)
+	}
+	if offset > 0 {
+		b.WriteString(" OFFSET ")
+		b.WriteString(strconv.Itoa(offset))
+	}
+}
+
+// SelectBuilder builds a SELECT statement.
+type SelectBuilder struct {
+	table     string
+	columns   []string
+	conds     []Cond
+	groupBy   []string
+	having    []Cond
+	orderBy   []string
+	limit     int
+	offset    int
+	forUpdate bool
+}
+
+// NewSelect returns a SELECT builder, all the columns are selected when
+// none is given.
+func NewSelect(table string, columns ...string) *SelectBuilder {
+	return &SelectBuilder{table: table, columns: columns}
+}
+
+// Where adds conditions joined with AND.
+func (s *SelectBuilder) Where(conds ...Cond) *SelectBuilder {
+	s.conds = append(s.conds, conds...)
+	return s
+}
+
+// GroupBy adds GROUP BY columns.
+func (s *SelectBuilder) GroupBy(columns ...string) *SelectBuilder {
+	s.groupBy = append(s.groupBy, columns...)
+	return s
+}
+
+// Having adds HAVING conditions joined with AND.
+func (s *SelectBuilder) Having(conds ...Cond) *SelectBuilder {
+	s.having = append(s.having, conds...)
+	return s
+}
+
+// OrderBy adds ORDER BY expressions, such as "id DESC".
+func (s *SelectBuilder) OrderBy(exprs ...string) *SelectBuilder {
+	s.orderBy = append(s.orderBy, exprs...)
+	return s
+}
+
+// Limit sets the LIMIT.
+func (s *SelectBuilder) Limit(n int) *SelectBuilder {
+	s.limit = n
+	return s
+}
+
+// Offset sets the OFFSET.
+func (s *SelectBuilder) Offset(n int) *SelectBuilder {
+	s.offset = n
+	return s
+}
+
+// ForUpdate appends FOR UPDATE.
+func (s *SelectBuilder) ForUpdate() *SelectBuilder {
+	s.forUpdate = true
+	return s
+}
+
+// ToSQL implements Builder.
+func (s *SelectBuilder) ToSQL() (query string, args []interface{}, err error) {
+	var b condBuilder
+	b.WriteString("SELECT ")
+	if len(s.columns) == 0 {
+		b.WriteByte('*')
+	} else {
+		b.WriteString(strings.Join(s.columns, ", "))
+	}
+	b.WriteString(" FROM ")
+	b.WriteString(s.table)
+	where(&b, s.conds)
+	if len(s.groupBy) > 0 {
+		b.WriteString(" GROUP BY ")
+		b.WriteString(strings.Join(s.groupBy, ", "))
+	}
+	for i, cond := range s.having {
+		if i == 0 {
+			b.WriteString(" HAVING ")
+		} else {
+			b.WriteString(" AND ")
+		}
+		b.cond(cond)
+	}
+	if len(s.orderBy) > 0 {
+		b.WriteString(" ORDER BY ")
+		b.WriteString(strings.Join(s.orderBy, ", "))
+	}
+	limit(&b, s.limit, s.offset)
+	if s.forUpdate {
+		b.WriteString(" FOR UPDATE")
+	}
+	return b.result()
+}
+
+// assignment is a column = expr pair of UPDATE SET or ON DUPLICATE KEY UPDATE.
+type assignment struct {
+	column string
+	expr   string
+	args   []interface{}
+}
+
+func assign(b *condBuilder, sets []assignment) {
+	for i, set := range sets {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(set.column)
+		b.WriteString(" = ")
+		b.WriteString(set.expr)
+		b.args = append(b.args, set.args...)
+	}
+}
+
+// InsertBuilder builds an INSERT statement.
+type InsertBuilder struct {
+	table   string
+	ignore  bool
+	columns []string
+	rows    [][]interface{}
+	updates []assignment
+}
+
+// NewInsert returns an INSERT builder.
+func NewInsert(table string, columns ...string) *InsertBuilder {
+	return &InsertBuilder{table: table, columns: columns}
+}
+
+// Ignore turns the statement into INSERT IGNORE.
+func (s *InsertBuilder) Ignore() *InsertBuilder {
+	s.ignore = true
+	return s
+}
+
+// Values adds a row, values are in the order of the columns.
+func (s *InsertBuilder) Values(values ...interface{}) *InsertBuilder {
+	s.rows = append(s.rows, values)
+	return s
+}
+
+// OnDuplicateKeyUpdate turns the statement into an upsert which overwrites
+// the columns with the inserted values.
+func (s *InsertBuilder) OnDuplicateKeyUpdate(columns ...string) *InsertBuilder {
+	for _, column := range columns {
+		s.updates = append(s.updates, assignment{column: column, expr: "VALUES(" + column + ")"})
+	}
+	return s
+}
+
+// OnDuplicateKeyUpdateExpr sets the column to expr on duplicate key, such as
+// OnDuplicateKeyUpdateExpr("cnt", "cnt + ?", 1).
+func (s *InsertBuilder) OnDuplicateKeyUpdateExpr(column, expr string, args ...interface{}) *InsertBuilder {
+	s.updates = append(s.updates, assignment{column: column, expr: expr, args: args})
+	return s
+}
+
+// ToSQL implements Builder.
+func (s *InsertBuilder) ToSQL() (query string, args []interface{}, err error) {
+	if len(s.rows) == 0 {
+		return "", nil, ErrEmptyValues
+	}
+	var b condBuilder
+	if s.ignore {
+		b.WriteString("INSERT IGNORE INTO ")
+	} else {
+		b.WriteString("INSERT INTO ")
+	}
+	b.WriteString(s.table)
+	if len(s.columns) > 0 {
+		b.WriteString(" (")
+		b.WriteString(strings.Join(s.columns, ", "))
+		b.WriteByte(')')
+	}
+	b.WriteString(" VALUES ")
+	for i, row := range s.rows {
+		if len(s.columns) > 0 && len(row) != len(s.columns) {
+			return "", nil, errors.Errorf("sql: row %d has %d values, want %d", i, len(row), len(s.columns))
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(placeholders(len(row)))
+		b.args = append(b.args, row...)
+	}
+	if len(s.updates) > 0 {
+		b.WriteString(" ON DUPLICATE KEY UPDATE ")
+		assign(&b, s.updates)
+	}
+	return b.result()
+}
+
+// placeholders returns (?, ?, ...) with n placeholders.
+func placeholders(n int) string {
+	if n == 0 {
+		return "()"
+	}
+	return "(" + strings.Repeat("?, ", n-1) + "?)"
+}
+
+// UpdateBuilder builds an UPDATE statement.
+type UpdateBuilder struct {
+	table   string
+	sets    []assignment
+	conds   []Cond
+	orderBy []string
+	limit   int
+}
+
+// NewUpdate returns an UPDATE builder.
+func NewUpdate(table string) *UpdateBuilder {
+	return &UpdateBuilder{table: table}
+}
+
+// Set sets the column to v.
+func (s *UpdateBuilder) Set(column string, v interface{}) *UpdateBuilder {
+	s.sets = append(s.sets, assignment{column: column, expr: "?", args: []interface{}{v}})
+	return s
+}
+
+// SetExpr sets the column to expr, such as SetExpr("cnt", "cnt + ?", 1).
+func (s *UpdateBuilder) SetExpr(column, expr string, args ...interface{}) *UpdateBuilder {
+	s.sets = append(s.sets, assignment{column: column, expr: expr, args: args})
+	return s
+}
+
+// Where adds conditions joined with AND.
+func (s *UpdateBuilder) Where(conds ...Cond) *UpdateBuilder {
+	s.conds = append(s.conds, conds...)
+	return s
+}
+
+// OrderBy adds ORDER BY expressions.
+func (s *UpdateBuilder) OrderBy(exprs ...string) *UpdateBuilder {
+	s.orderBy = append(s.orderBy, exprs...)
+	return s
+}
+
+// Limit sets the LIMIT.
+func (s *UpdateBuilder) Limit(n int) *UpdateBuilder {
+	s.limit = n
+	return s
+}
+
+// ToSQL implements Builder, it refuses to update the whole table.
+func (s *UpdateBuilder) ToSQL() (query string, args []interface{}, err error) {
+	if len(s.sets) == 0 {
+		return "", nil, ErrEmptyValues
+	}
+	if len(s.conds) == 0 {
+		return "", nil, ErrEmptyWhere
+	}
+	var b condBuilder
+	b.WriteString("UPDATE ")
+	b.WriteString(s.table)
+	b.WriteString(" SET ")
+	assign(&b, s.sets)
+	where(&b, s.conds)
+	if len(s.orderBy) > 0 {
+		b.WriteString(" ORDER BY ")
+		b.WriteString(strings.Join(s.orderBy, ", "))
+	}
+	limit(&b, s.limit, 0)
+	return b.result()
+}
+
+// DeleteBuilder builds a DELETE statement.
+type DeleteBuilder struct {
+	table   string
+	conds   []Cond
+	orderBy []string
+	limit   int
+}
+
+// NewDelete returns a DELETE builder.
+func NewDelete(table string) *DeleteBuilder {
+	return &DeleteBuilder{table: table}
+}
+
+// Where adds conditions joined with AND.
+func (s *DeleteBuilder) Where(conds ...Cond) *DeleteBuilder {
+	s.conds = append(s.conds, conds...)
+	return s
+}
+
+// OrderBy adds ORDER BY expressions.
+func (s *DeleteBuilder) OrderBy(exprs ...string) *DeleteBuilder {
+	s.orderBy = append(s.orderBy, exprs...)
+	return s
+}
+
+// Limit sets the LIMIT.
+func (s *DeleteBuilder) Limit(n int) *DeleteBuilder {
+	s.limit = n
+	return s
+}
+
+// ToSQL implements Builder, it refuses to delete the whole table.
+func (s *DeleteBuilder) ToSQL() (query string, args []interface{}, err error) {
+	if len(s.conds) == 0 {
+		return "", nil, ErrEmptyWhere
+	}
+	var b condBuilder
+	b.WriteString("DELETE FROM ")
+	b.WriteString(s.table)
+	where(&b, s.conds)
+	if len(s.orderBy) > 0 {
+		b.WriteString(" ORDER BY ")
+		b.WriteString(strings.Join(s.orderBy, ", "))
+	}
+	limit(&b, s.limit, 0)
+	return b.result()
+}
+
+// ExecBuilder builds the statement and executes it on the master instance.
+func (db *DB) ExecBuilder(c context.Context, b Builder) (res sql.Result, err error) {
+	query, args, err := b.ToSQL()
+	if err != nil {
+		return
+	}
+	return db.Exec(c, query, args...)
+}
+
+// QueryBuilder builds the statement and runs it like Query.
+func (db *DB) QueryBuilder(c context.Context, b Builder) (rows *Rows, err error) {
+	query, args, err := b.ToSQL()
+	if err != nil {
+		return
+	}
+	return db.Query(c, query, args...)
+}
+
+// ExecBuilder builds the statement and executes it in the transaction.
+func (tx *Tx) ExecBuilder(b Builder) (res sql.Result, err error) {
+	query, args, err := b.ToSQL()
+	if err != nil {
+		return
+	}
+	return tx.Exec(query, args...)
+}
+
+// QueryBuilder builds the statement and runs it in the transaction.
+func (tx *Tx) QueryBuilder(b Builder) (rows *Rows, err error) {
+	query, args, err := b.ToSQL()
+	if err != nil {
+		return
+	}
+	return tx.Query(query, args...)
+}
@@ -0,0 +1,105 @@
+package sql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	tests := []struct {
+		name  string
+		b     Builder
+		query string
+		args  []interface{}
+		err   error
+	}{
+		{
+			name: "select",
+			b: NewSelect("user", "id", "name").
+				Where(Eq("status", 1), In("id", []int64{1, 2, 3}), Or(Gt("age", 18), IsNull("age"))).
+				OrderBy("id DESC").Limit(10).Offset(20),
+			query: "SELECT id, name FROM user WHERE status = ? AND id IN (?, ?, ?) AND (age > ? OR age IS NULL) ORDER BY id DESC LIMIT 10 OFFSET 20",
+			args:  []interface{}{1, int64(1), int64(2), int64(3), 18},
+		},
+		{
+			name:  "select empty in",
+			b:     NewSelect("user").Where(In("id", []int64{}), Not(NotIn("id", nil))).ForUpdate(),
+			query: "SELECT * FROM user WHERE 1 = 0 AND NOT (1 = 1) FOR UPDATE",
+		},
+		{
+			name: "upsert",
+			b: NewInsert("counter", "id", "name", "cnt").Values(1, "a", 1).Values(2, "b", 1).
+				OnDuplicateKeyUpdate("name").OnDuplicateKeyUpdateExpr("cnt", "cnt + ?", 1),
+			query: "INSERT INTO counter (id, name, cnt) VALUES (?, ?, ?), (?, ?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name), cnt = cnt + ?",
+			args:  []interface{}{1, "a", 1, 2, "b", 1, 1},
+		},
+		{
+			name:  "update",
+			b:     NewUpdate("user").Set("name", "a").SetExpr("version", "version + 1").Where(Eq("id", 1)).Limit(1),
+			query: "UPDATE user SET name = ?, version = version + 1 WHERE id = ? LIMIT 1",
+			args:  []interface{}{"a", 1},
+		},
+		{
+			name:  "delete",
+			b:     NewDelete("user").Where(Lt("ctime", 100), Expr("deleted = ?", 1)),
+			query: "DELETE FROM user WHERE ctime < ? AND (deleted = ?)",
+			args:  []interface{}{100, 1},
+		},
+		{
+			name:  "expr with or",
+			b:     NewSelect("user").Where(Expr("a = ? OR b = ?", 1, 2), Eq("c", 3), Or(Expr("d = 1 OR e = 1"), IsNull("d"))),
+			query: "SELECT * FROM user WHERE (a = ? OR b = ?) AND c = ? AND ((d = 1 OR e = 1) OR d IS NULL)",
+			args:  []interface{}{1, 2, 3},
+		},
+		{
+			name:  "empty and or",
+			b:     NewSelect("user").Where(And(), Or(), Eq("id", 1)),
+			query: "SELECT * FROM user WHERE 1 = 1 AND 1 = 0 AND id = ?",
+			args:  []interface{}{1},
+		},
+		{
+			name:  "in bytes",
+			b:     NewSelect("user").Where(In("uuid", []byte("ab"))),
+			query: "SELECT * FROM user WHERE uuid IN (?)",
+			args:  []interface{}{[]byte("ab")},
+		},
+		{
+			name:  "in byte array",
+			b:     NewSelect("user").Where(In("flag", [2]byte{1, 2})).Offset(20),
+			query: "SELECT * FROM user WHERE flag IN (?, ?) LIMIT 18446744073709551615 OFFSET 20",
+			args:  []interface{}{byte(1), byte(2)},
+		},
+		{name: "update without where", b: NewUpdate("user").Set("name", "a"), err: ErrEmptyWhere},
+		{name: "delete without where", b: NewDelete("user"), err: ErrEmptyWhere},
+		{name: "insert without values", b: NewInsert("user", "id"), err: ErrEmptyValues},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, err := tt.b.ToSQL()
+			if err != tt.err {
+				t.Fatalf("ToSQL() error = %v, want %v", err, tt.err)
+			}
+			if query != tt.query {
+				t.Errorf("ToSQL() query = %s, want %s", query, tt.query)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("ToSQL() args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestBuilderInNotSlice(t *testing.T) {
+	for _, b := range []Builder{
+		NewSelect("user").Where(In("id", 1)),
+		NewDelete("user").Where(Or(Eq("a", 1), NotIn("id", "1,2"))),
+	} {
+		if query, _, err := b.ToSQL(); err == nil {
+			t.Errorf("ToSQL() = %s, want an error", query)
+		}
+	}
+	if _, err := (&DB{}).ExecBuilder(context.Background(), NewDelete("user").Where(NotIn("id", 1))); err == nil {
+		t.Error("ExecBuilder() should fail")
+	}
+}
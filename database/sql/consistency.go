@@ -0,0 +1,215 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/log"
+)
+
+const (
+	_lagCheckInterval = 5 * time.Second
+	_lagUnknown       = math.MaxInt64
+
+	// mysql server error of a statement it doesn't know.
+	_errParse = 1064
+)
+
+type masterKey struct{}
+
+type sessionKey struct{}
+
+// Session tracks the writes of a request or of a user session, reads made
+// with it go to the master for Config.ReadYourWrites after its last write,
+// or to a replica which applied that write when Config.GTIDWait is set.
+// A Session is safe for concurrent use.
+type Session struct {
+	lastWrite int64 // unix nano.
+	gtid      atomic.Value
+}
+
+// WithMaster returns a context whose reads always go to the master.
+func WithMaster(c context.Context) context.Context {
+	return context.WithValue(c, masterKey{}, true)
+}
+
+// NewSession returns a context carrying a new Session.
+func NewSession(c context.Context) context.Context {
+	return WithSession(c, &Session{})
+}
+
+// WithSession returns a context carrying s, s may be kept across requests
+// of the same user.
+func WithSession(c context.Context, s *Session) context.Context {
+	return context.WithValue(c, sessionKey{}, s)
+}
+
+// LastWrite returns the time of the last write made in the session.
+func (s *Session) LastWrite() time.Time {
+	if n := atomic.LoadInt64(&s.lastWrite); n > 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// markWrite records a successful write in the session of the context, and
+// the GTID set of the master when Config.GTIDWait is set.
+func (db *conn) markWrite(c context.Context) {
+	s, ok := c.Value(sessionKey{}).(*Session)
+	if !ok {
+		return
+	}
+	atomic.StoreInt64(&s.lastWrite, time.Now().UnixNano())
+	if db.conf.GTIDWait <= 0 || db.conf.ReadYourWrites <= 0 {
+		return
+	}
+	// c may be done already, the write succeeded.
+	c, cancel := shrink(context.WithoutCancel(c), db.conf.QueryTimeout)
+	defer cancel()
+	var gtid string
+	if err := db.QueryRowContext(c, "SELECT @@GLOBAL.gtid_executed").Scan(&gtid); err != nil {
+		// the reads of the session go to the master.
+		log.Errorf("%s %s gtid_executed error(%v)", _family, db.addr, err)
+	}
+	s.gtid.Store(gtid)
+}
+
+// forceMaster reports whether the context asks for the master.
+func forceMaster(c context.Context) bool {
+	force, _ := c.Value(masterKey{}).(bool)
+	return force
+}
+
+// lastWrite returns whether the session of the context wrote within
+// Config.ReadYourWrites and the GTID set of that write, if known.
+func (db *DB) lastWrite(c context.Context) (recent bool, gtid string) {
+	window := time.Duration(db.write.conf.ReadYourWrites)
+	if window <= 0 {
+		return
+	}
+	s, ok := c.Value(sessionKey{}).(*Session)
+	if !ok {
+		return
+	}
+	n := atomic.LoadInt64(&s.lastWrite)
+	if n == 0 || time.Since(time.Unix(0, n)) >= window {
+		return
+	}
+	gtid, _ = s.gtid.Load().(string)
+	return true, gtid
+}
+
+// waitGTID waits up to Config.GTIDWait for the replica to apply the GTID set.
+func (db *conn) waitGTID(c context.Context, gtid string) bool {
+	wait := time.Duration(db.conf.GTIDWait)
+	c, cancel := shrink(c, db.conf.QueryTimeout)
+	defer cancel()
+	var timeout sql.NullInt64
+	if err := db.QueryRowContext(c, "SELECT WAIT_FOR_EXECUTED_GTID_SET(?, ?)", gtid, wait.Seconds()).Scan(&timeout); err != nil {
+		log.Errorf("%s replica %s wait gtid error(%v)", _family, db.addr, err)
+		return false
+	}
+	return timeout.Valid && timeout.Int64 == 0
+}
+
+// fresh reports whether the replication lag of the instance is acceptable.
+func (db *conn) fresh() bool {
+	max := time.Duration(db.conf.MaxReplicaLag)
+	return max <= 0 || atomic.LoadInt64(&db.lag) <= int64(max)
+}
+
+// checkLag polls the replication lag of every replica until the db is closed.
+func (db *DB) checkLag() {
+	interval := time.Duration(db.write.conf.LagCheckInterval)
+	if interval <= 0 {
+		interval = _lagCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, r := range db.read {
+			lag, err := r.replicaLag(context.Background())
+			if err != nil {
+				log.Errorf("%s replica %s lag error(%v)", _family, r.addr, err)
+				lag = _lagUnknown
+			}
+			atomic.StoreInt64(&r.lag, int64(lag))
+		}
+		select {
+		case <-ticker.C:
+		case <-db.closed:
+			return
+		}
+	}
+}
+
+// replicaLag runs Config.LagQuery, which returns the lag in seconds such as
+// a pt-heartbeat query, or reads the lag of SHOW REPLICA STATUS, or of SHOW
+// SLAVE STATUS before mysql 8.0.22.
+func (db *conn) replicaLag(c context.Context) (lag time.Duration, err error) {
+	c, cancel := shrink(c, db.conf.QueryTimeout)
+	defer cancel()
+	if db.conf.LagQuery != "" {
+		var seconds sql.NullFloat64
+		if err = db.QueryRowContext(c, db.conf.LagQuery).Scan(&seconds); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if !seconds.Valid {
+			return _lagUnknown, nil
+		}
+		return time.Duration(seconds.Float64 * float64(time.Second)), nil
+	}
+	lag, err = db.statusLag(c, "SHOW REPLICA STATUS", "Seconds_Behind_Source")
+	var me *mysql.MySQLError
+	if errors.As(err, &me) && me.Number == _errParse {
+		return db.statusLag(c, "SHOW SLAVE STATUS", "Seconds_Behind_Master")
+	}
+	return
+}
+
+// statusLag reads the lag in seconds of the column of a replica status.
+func (db *conn) statusLag(c context.Context, query, column string) (lag time.Duration, err error) {
+	rows, err := db.QueryContext(c, query)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if !rows.Next() {
+		return 0, errors.Errorf("sql: %s is not a replica", db.addr)
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	for i, name := range columns {
+		if !strings.EqualFold(name, column) {
+			continue
+		}
+		if values[i] == nil {
+			// replication is stopped.
+			return _lagUnknown, nil
+		}
+		seconds, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, errors.Errorf("sql: no %s in %s", column, query)
+}
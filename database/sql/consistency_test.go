@@ -0,0 +1,98 @@
+package sql
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/quan-xie/tuba/database/sql/sqltest"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+func TestReadYourWrites(t *testing.T) {
+	c := &Config{ReadYourWrites: xtime.Duration(time.Hour)}
+	db := &DB{write: newConn(c, nil, "master"), read: []*conn{newConn(c, nil, "replica")}}
+	ctx := NewSession(context.Background())
+	if cn := db.readConn(ctx); cn.addr != "replica" {
+		t.Errorf("readConn() before write = %s, want replica", cn.addr)
+	}
+	db.write.markWrite(ctx)
+	if cn := db.readConn(ctx); cn.addr != "master" {
+		t.Errorf("readConn() after write = %s, want master", cn.addr)
+	}
+	if cn := db.readConn(context.Background()); cn.addr != "replica" {
+		t.Errorf("readConn() of another request = %s, want replica", cn.addr)
+	}
+	if cn := db.readConn(WithMaster(context.Background())); cn.addr != "master" {
+		t.Errorf("readConn() with master marker = %s, want master", cn.addr)
+	}
+}
+
+func TestReadReplicaLag(t *testing.T) {
+	c := &Config{MaxReplicaLag: xtime.Duration(time.Second)}
+	db := &DB{
+		write: newConn(c, nil, "master"),
+		read:  []*conn{newConn(c, nil, "replica1"), newConn(c, nil, "replica2")},
+	}
+	atomic.StoreInt64(&db.read[0].lag, int64(time.Minute))
+	for i := 0; i < 4; i++ {
+		if cn := db.readConn(context.Background()); cn.addr != "replica2" {
+			t.Errorf("readConn() = %s, want replica2", cn.addr)
+		}
+	}
+	atomic.StoreInt64(&db.read[1].lag, _lagUnknown)
+	if cn := db.readConn(context.Background()); cn.addr != "master" {
+		t.Errorf("readConn() with lagging replicas = %s, want master", cn.addr)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	db, _ := openTest(t, &Config{MaxReplicaLag: xtime.Duration(time.Second)})
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the cleanup of openTest closes it a second time.
+}
+
+func TestReadYourWritesGTID(t *testing.T) {
+	db, d := openTest(t, &Config{ReadYourWrites: xtime.Duration(time.Minute), GTIDWait: xtime.Duration(50 * time.Millisecond)})
+	c := NewSession(context.Background())
+	d.ExpectExec(`^UPDATE user`).WithDSN("master")
+	d.ExpectQuery(`^SELECT @@GLOBAL.gtid_executed$`).WithDSN("master").WillReturnRows(sqltest.NewRows("gtid").AddRow("3e11fa47:1-5"))
+	// replica2 applied the write.
+	d.ExpectQuery(`^SELECT WAIT_FOR_EXECUTED_GTID_SET\(\?, \?\)$`).WithDSN("replica2").WithArgs("3e11fa47:1-5", 0.05).WillReturnRows(sqltest.NewRows("w").AddRow(0))
+	d.ExpectQuery(`^SELECT name`).WithDSN("replica2")
+	// none of them did, the read goes to the master.
+	d.ExpectQuery(`^SELECT WAIT_FOR_EXECUTED_GTID_SET`).WithDSN("replica1").WillReturnRows(sqltest.NewRows("w").AddRow(1))
+	d.ExpectQuery(`^SELECT WAIT_FOR_EXECUTED_GTID_SET`).WithDSN("replica2").WillReturnRows(sqltest.NewRows("w").AddRow(1))
+	d.ExpectQuery(`^SELECT name`).WithDSN("master")
+
+	if _, err := db.Exec(c, "UPDATE user SET name = ''"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		rows, err := db.Query(c, "SELECT name FROM user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+}
+
+func TestReplicaLagStatus(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	d.ExpectQuery(`^SHOW REPLICA STATUS$`).WithDSN("replica1").WillReturnRows(sqltest.NewRows("Replica_IO_State", "Seconds_Behind_Source").AddRow("Waiting", "3"))
+	// before mysql 8.0.22.
+	d.ExpectQuery(`^SHOW REPLICA STATUS$`).WithDSN("replica2").WillReturnError(&mysql.MySQLError{Number: _errParse})
+	d.ExpectQuery(`^SHOW SLAVE STATUS$`).WithDSN("replica2").WillReturnRows(sqltest.NewRows("Seconds_Behind_Master").AddRow(nil))
+
+	if lag, err := db.read[0].replicaLag(context.Background()); err != nil || lag != 3*time.Second {
+		t.Errorf("replicaLag() = %v, %v, want 3s", lag, err)
+	}
+	if lag, err := db.read[1].replicaLag(context.Background()); err != nil || lag != _lagUnknown {
+		t.Errorf("replicaLag() of a stopped replica = %v, %v", lag, err)
+	}
+}
@@ -0,0 +1,39 @@
+package sql
+
+// Dialect adapts the DB to a database other than mysql, such as the
+// postgres DB of database/postgre.
+type Dialect struct {
+	// Rebind rewrites the ? placeholders of the statements, they are sent
+	// as they are when it is nil.
+	Rebind func(query string) string
+	// Addr returns the address of a data source name for the logs and the
+	// spans, the mysql DSN is parsed when it is nil.
+	Addr func(dsn string) string
+	// Retryable reports whether err aborted a transaction which WithTx may
+	// retry, the mysql deadlocks and lock wait timeouts when it is nil.
+	Retryable func(err error) bool
+}
+
+// rebind rewrites the placeholders of query for the dialect.
+func (db *conn) rebind(query string) string {
+	if d := db.conf.Dialect; d != nil && d.Rebind != nil {
+		return d.Rebind(query)
+	}
+	return query
+}
+
+// addr returns the address of the data source name for the dialect.
+func addr(c *Config, dsn string) string {
+	if c.Dialect != nil && c.Dialect.Addr != nil {
+		return c.Dialect.Addr(dsn)
+	}
+	return parseDSN(dsn)
+}
+
+// retryable reports whether err aborted a transaction which may be retried.
+func (db *conn) retryable(err error) bool {
+	if d := db.conf.Dialect; d != nil && d.Retryable != nil {
+		return d.Retryable(err)
+	}
+	return isRetryableTx(err)
+}
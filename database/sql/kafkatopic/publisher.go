@@ -0,0 +1,39 @@
+// Package kafkatopic relays the events of a database/sql outbox to kafka
+// topics.
+package kafkatopic
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/quan-xie/tuba/database/sql"
+)
+
+// Writer writes messages to kafka, such as a *kafka.Writer whose Topic is
+// empty so that every message names its own.
+type Writer interface {
+	WriteMessages(c context.Context, msgs ...kafka.Message) error
+}
+
+// Publisher publishes every message to the kafka topic named after its
+// topic, keyed by its key so that the messages of a key keep their order.
+type Publisher struct {
+	w Writer
+}
+
+// NewPublisher returns a publisher writing the messages with w.
+func NewPublisher(w Writer) *Publisher {
+	return &Publisher{w: w}
+}
+
+// Publish implements sql.Publisher, the outbox id is sent in the id header.
+func (p *Publisher) Publish(c context.Context, msg *sql.Message) error {
+	return p.w.WriteMessages(c, kafka.Message{
+		Topic:   msg.Topic,
+		Key:     []byte(msg.Key),
+		Value:   msg.Payload,
+		Headers: []kafka.Header{{Key: "id", Value: []byte(strconv.FormatInt(msg.ID, 10))}},
+	})
+}
@@ -0,0 +1,255 @@
+package sql
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/ecode"
+)
+
+// ErrInvalidCursor is returned when a cursor is malformed, was not signed
+// with the secret or belongs to another ordering, it is a request error.
+var ErrInvalidCursor = errors.Wrap(ecode.RequestErr, "sql: invalid cursor")
+
+// Order is a column of a keyset ordering.
+type Order struct {
+	Column string
+	Desc   bool
+}
+
+// Asc orders by column ascending.
+func Asc(column string) Order { return Order{Column: column} }
+
+// Desc orders by column descending.
+func Desc(column string) Order { return Order{Column: column, Desc: true} }
+
+// Keyset paginates on an ordered set of NOT NULL columns. Rows are located
+// by the values of these columns in the last row of the previous page
+// instead of an OFFSET, so the last column must be unique, such as the
+// primary key, to break the ties of the others. An index on the columns in
+// the same order keeps every page as cheap as the first one.
+type Keyset struct {
+	orders []Order
+	secret []byte
+}
+
+// NewKeyset returns a keyset ordering, cursors are signed with secret so
+// that clients can't forge them.
+func NewKeyset(secret []byte, orders ...Order) *Keyset {
+	return &Keyset{orders: orders, secret: secret}
+}
+
+// OrderBy returns the ORDER BY expressions of the keyset.
+func (k *Keyset) OrderBy() []string {
+	exprs := make([]string, len(k.orders))
+	for i, o := range k.orders {
+		exprs[i] = o.Column
+		if o.Desc {
+			exprs[i] += " DESC"
+		}
+	}
+	return exprs
+}
+
+// After returns the condition matching the rows following the one with
+// values in the keyset order. For (a ASC, b DESC, id ASC) it is:
+//
+//	a > ? OR (a = ? AND b < ?) OR (a = ? AND b = ? AND id > ?)
+func (k *Keyset) After(values []interface{}) Cond {
+	ors := make([]Cond, len(k.orders))
+	for i, o := range k.orders {
+		ands := make([]Cond, 0, i+1)
+		for j := 0; j < i; j++ {
+			ands = append(ands, Eq(k.orders[j].Column, values[j]))
+		}
+		if o.Desc {
+			ands = append(ands, Lt(o.Column, values[i]))
+		} else {
+			ands = append(ands, Gt(o.Column, values[i]))
+		}
+		ors[i] = And(ands...)
+	}
+	return Or(ors...)
+}
+
+// cursorValue is a typed value of a cursor, the type is kept so that ids
+// and times are compared as such once decoded.
+type cursorValue [2]string
+
+// Encode returns the opaque cursor of the row with values in the keyset
+// order. Values are converted to driver values first.
+func (k *Keyset) Encode(values []interface{}) (cursor string, err error) {
+	if len(values) != len(k.orders) {
+		return "", errors.Errorf("sql: %d cursor values for %d columns", len(values), len(k.orders))
+	}
+	cvs := make([]cursorValue, len(values))
+	for i, v := range values {
+		dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+		if err != nil {
+			return "", errors.Wrapf(err, "cursor column %s", k.orders[i].Column)
+		}
+		switch dv := dv.(type) {
+		case int64:
+			cvs[i] = cursorValue{"i", strconv.FormatInt(dv, 10)}
+		case float64:
+			cvs[i] = cursorValue{"f", strconv.FormatFloat(dv, 'g', -1, 64)}
+		case bool:
+			cvs[i] = cursorValue{"b", strconv.FormatBool(dv)}
+		case []byte:
+			cvs[i] = cursorValue{"x", base64.RawStdEncoding.EncodeToString(dv)}
+		case string:
+			cvs[i] = cursorValue{"s", dv}
+		case time.Time:
+			cvs[i] = cursorValue{"t", dv.Format(time.RFC3339Nano)}
+		default:
+			return "", errors.Errorf("sql: cursor column %s can't be %T", k.orders[i].Column, v)
+		}
+	}
+	payload, err := json.Marshal(cvs)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(k.sign(payload)), nil
+}
+
+// Decode verifies the cursor and returns its values in the keyset order.
+func (k *Keyset) Decode(cursor string) (values []interface{}, err error) {
+	i := strings.IndexByte(cursor, '.')
+	if i < 0 {
+		return nil, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(cursor[:i])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(cursor[i+1:])
+	if err != nil || !hmac.Equal(sig, k.sign(payload)) {
+		return nil, ErrInvalidCursor
+	}
+	var cvs []cursorValue
+	if err = json.Unmarshal(payload, &cvs); err != nil || len(cvs) != len(k.orders) {
+		return nil, ErrInvalidCursor
+	}
+	values = make([]interface{}, len(cvs))
+	for i, cv := range cvs {
+		switch cv[0] {
+		case "i":
+			values[i], err = strconv.ParseInt(cv[1], 10, 64)
+		case "f":
+			values[i], err = strconv.ParseFloat(cv[1], 64)
+		case "b":
+			values[i], err = strconv.ParseBool(cv[1])
+		case "x":
+			values[i], err = base64.RawStdEncoding.DecodeString(cv[1])
+		case "s":
+			values[i] = cv[1]
+		case "t":
+			values[i], err = time.Parse(time.RFC3339Nano, cv[1])
+		default:
+			err = ErrInvalidCursor
+		}
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return
+}
+
+// sign signs the payload along with the ordering, a cursor can't be
+// replayed on another keyset sharing the secret.
+func (k *Keyset) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte(strings.Join(k.OrderBy(), ",")))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Page is a page of items ready to be serialized in a response, NextCursor
+// fetches the following page and is empty on the last one.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// Paginate runs the select ordered by the keyset, starting after cursor or
+// at the first row when cursor is empty, and returns up to limit items.
+// The keyset columns are read from the fields of T mapped as by Select,
+// qualified columns such as u.id are looked up without their table. The
+// builder is not modified and must have no ORDER BY nor LIMIT of its own.
+func Paginate[T any](c context.Context, db *DB, sel *SelectBuilder, k *Keyset, cursor string, limit int) (page *Page[T], err error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("sql: invalid page limit %d", limit)
+	}
+	q := *sel
+	q.conds = append([]Cond{}, sel.conds...)
+	if cursor != "" {
+		values, err := k.Decode(cursor)
+		if err != nil {
+			return nil, err
+		}
+		q.conds = append(q.conds, k.After(values))
+	}
+	q.orderBy = k.OrderBy()
+	// one more row tells whether a next page exists.
+	q.limit, q.offset = limit+1, 0
+	rows, err := db.QueryBuilder(c, &q)
+	if err != nil {
+		return
+	}
+	items, err := ScanAll[T](rows)
+	if err != nil {
+		return
+	}
+	page = &Page[T]{Items: items}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	if len(items) > limit {
+		page.Items, page.HasMore = items[:limit], true
+		values, err := k.values(items[limit-1])
+		if err != nil {
+			return nil, err
+		}
+		if page.NextCursor, err = k.Encode(values); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// values reads the keyset columns of item.
+func (k *Keyset) values(item interface{}) (values []interface{}, err error) {
+	v := reflect.ValueOf(item)
+	if !isStruct(v.Type()) {
+		if len(k.orders) != 1 {
+			return nil, errors.Errorf("sql: %d keyset columns from non-struct type %s", len(k.orders), v.Type())
+		}
+		return []interface{}{item}, nil
+	}
+	// fieldByIndex needs an addressable value.
+	p := reflect.New(v.Type()).Elem()
+	p.Set(v)
+	meta := structMetaOf(v.Type())
+	values = make([]interface{}, len(k.orders))
+	for i, o := range k.orders {
+		column := strings.ToLower(o.Column[strings.LastIndexByte(o.Column, '.')+1:])
+		index, ok := meta.fields[column]
+		if !ok {
+			return nil, errors.Errorf("sql: missing field for keyset column %q in %s", o.Column, v.Type())
+		}
+		values[i] = fieldByIndex(p, index).Interface()
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package sql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/quan-xie/tuba/database/sql/sqltest"
+	"github.com/quan-xie/tuba/ecode"
+)
+
+func TestKeysetCursor(t *testing.T) {
+	k := NewKeyset([]byte("secret"), Desc("ctime"), Asc("name"), Asc("id"))
+	ctime := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	cursor, err := k.Encode([]interface{}{ctime, "tuba", 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := k.Decode(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{ctime, "tuba", int64(42)}; !reflect.DeepEqual(values, want) {
+		t.Errorf("Decode() = %v, want %v", values, want)
+	}
+	other := NewKeyset([]byte("secret"), Asc("ctime"), Asc("name"), Asc("id"))
+	for _, bad := range []string{"", "abc", cursor[:len(cursor)-2], "x" + cursor} {
+		if _, err = k.Decode(bad); err != ErrInvalidCursor {
+			t.Errorf("Decode(%q) error = %v, want %v", bad, err, ErrInvalidCursor)
+		}
+	}
+	if _, err = other.Decode(cursor); err != ErrInvalidCursor {
+		t.Errorf("Decode() of another ordering error = %v, want %v", err, ErrInvalidCursor)
+	}
+	if !ecode.EqualError(ecode.RequestErr, ErrInvalidCursor) {
+		t.Error("ErrInvalidCursor should be a request error")
+	}
+}
+
+func TestKeysetAfter(t *testing.T) {
+	k := NewKeyset(nil, Asc("score"), Desc("ctime"), Asc("id"))
+	query, args, _ := NewSelect("user", "id").Where(Eq("status", 1), k.After([]interface{}{10, "t", 3})).OrderBy(k.OrderBy()...).ToSQL()
+	want := "SELECT id FROM user WHERE status = ? AND (score > ? OR (score = ? AND ctime < ?) OR (score = ? AND ctime = ? AND id > ?)) ORDER BY score, ctime DESC, id"
+	if query != want {
+		t.Errorf("ToSQL() = %s, want %s", query, want)
+	}
+	if wantArgs := []interface{}{1, 10, 10, "t", 10, "t", 3}; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("ToSQL() args = %v, want %v", args, wantArgs)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	c := context.Background()
+	k := NewKeyset([]byte("secret"), Desc("u.name"), Asc("u.user_id"))
+	sel := NewSelect("user u", "u.user_id", "u.name").Where(Eq("u.status", 1))
+	d.ExpectQuery(`^SELECT u.user_id, u.name FROM user u WHERE u.status = \? ORDER BY u.name DESC, u.user_id LIMIT 3$`).WithArgs(1).
+		WillReturnRows(sqltest.NewRows("user_id", "name").AddRow(1, "c").AddRow(2, "b").AddRow(3, "b"))
+	d.ExpectQuery(`WHERE u.status = \? AND \(u.name < \? OR \(u.name = \? AND u.user_id > \?\)\) ORDER BY`).WithArgs(1, "b", "b", 2).
+		WillReturnRows(sqltest.NewRows("user_id", "name").AddRow(3, "b"))
+
+	page, err := Paginate[scanUser](c, db, sel, k, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || !page.HasMore || page.NextCursor == "" {
+		t.Fatalf("Paginate() = %+v, want 2 items and a next cursor", page)
+	}
+	page, err = Paginate[scanUser](c, db, sel, k, page.NextCursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.HasMore || page.NextCursor != "" {
+		t.Errorf("Paginate() = %+v, want the last item", page)
+	}
+	if _, err = Paginate[scanUser](c, db, sel, k, "bad", 2); err != ErrInvalidCursor {
+		t.Errorf("Paginate() error = %v, want %v", err, ErrInvalidCursor)
+	}
+	if query, _, _ := sel.ToSQL(); query != "SELECT u.user_id, u.name FROM user u WHERE u.status = ?" {
+		t.Errorf("Paginate() modified the builder: %s", query)
+	}
+}
@@ -0,0 +1,278 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+const (
+	_migrateTable       = "schema_migrations"
+	_migrateLock        = "tuba_migrate"
+	_migrateLockTimeout = 10 * time.Second
+
+	_errNoSuchTable = 1146
+)
+
+// _migrationFile matches 0001_create_user.up.sql and 0001_create_user.down.sql.
+var _migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// ErrMigrateLocked is returned when another instance holds the migration lock.
+var ErrMigrateLocked = errors.New("sql: migration lock held by another instance")
+
+// MigrateConfig is the config of a Migrator.
+type MigrateConfig struct {
+	Table       string         // history table, "schema_migrations" by default.
+	LockName    string         // advisory lock name, "tuba_migrate" by default.
+	LockTimeout xtime.Duration // wait for the advisory lock, 10s by default.
+	DryRun      bool           // only report the migrations that would run.
+}
+
+// Migration is a versioned schema change read from VERSION_NAME.up.sql and
+// VERSION_NAME.down.sql files.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies migrations on the master instance and records the
+// applied versions in the history table.
+type Migrator struct {
+	db         *DB
+	conf       *MigrateConfig
+	migrations []*Migration
+}
+
+// NewMigrator reads the migration files at the root of fsys, use fs.Sub for
+// a sub directory.
+func NewMigrator(db *DB, fsys fs.FS, c *MigrateConfig) (m *Migrator, err error) {
+	if c == nil {
+		c = &MigrateConfig{}
+	}
+	if c.Table == "" {
+		c.Table = _migrateTable
+	}
+	if c.LockName == "" {
+		c.LockName = _migrateLock
+	}
+	if c.LockTimeout <= 0 {
+		c.LockTimeout = xtime.Duration(_migrateLockTimeout)
+	}
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, f := range files {
+		ms := _migrationFile.FindStringSubmatch(f.Name())
+		if f.IsDir() || ms == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(ms[1], 10, 64)
+		b, err := fs.ReadFile(fsys, f.Name())
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		mg, ok := byVersion[version]
+		if !ok {
+			mg = &Migration{Version: version, Name: ms[2]}
+			byVersion[version] = mg
+		} else if mg.Name != ms[2] {
+			return nil, errors.Errorf("sql: migration version %d used by %s and %s", version, mg.Name, ms[2])
+		}
+		if ms[3] == "up" {
+			mg.Up = string(b)
+		} else {
+			mg.Down = string(b)
+		}
+	}
+	m = &Migrator{db: db, conf: c}
+	for _, mg := range byVersion {
+		if mg.Up == "" {
+			return nil, errors.Errorf("sql: migration %d_%s has no up file", mg.Version, mg.Name)
+		}
+		m.migrations = append(m.migrations, mg)
+	}
+	sort.Slice(m.migrations, func(i, j int) bool { return m.migrations[i].Version < m.migrations[j].Version })
+	return
+}
+
+// Migrations returns all the migrations ordered by version.
+func (m *Migrator) Migrations() []*Migration {
+	return m.migrations
+}
+
+// Up applies the pending migrations up to and including target, all of them
+// when target is 0. It returns the migrations applied, or that would be
+// applied in dry-run mode.
+func (m *Migrator) Up(c context.Context, target int64) (done []*Migration, err error) {
+	err = m.withLock(c, func(cn *sql.Conn, applied map[int64]bool) error {
+		for _, mg := range m.migrations {
+			if applied[mg.Version] {
+				continue
+			}
+			if target > 0 && mg.Version > target {
+				break
+			}
+			if !m.conf.DryRun {
+				if err := m.apply(c, cn, mg, mg.Up); err != nil {
+					return err
+				}
+				if _, err := cn.ExecContext(c, "INSERT INTO "+m.conf.Table+" (version, name) VALUES (?, ?)", mg.Version, mg.Name); err != nil {
+					return errors.Wrapf(err, "record migration %d_%s", mg.Version, mg.Name)
+				}
+			}
+			log.Infof("%s migrate up %d_%s dry_run:%t", _family, mg.Version, mg.Name, m.conf.DryRun)
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return
+}
+
+// Down rolls back the applied migrations above target, newest first. It
+// returns the migrations rolled back, or that would be in dry-run mode.
+func (m *Migrator) Down(c context.Context, target int64) (done []*Migration, err error) {
+	err = m.withLock(c, func(cn *sql.Conn, applied map[int64]bool) error {
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mg := m.migrations[i]
+			if mg.Version <= target {
+				break
+			}
+			if !applied[mg.Version] {
+				continue
+			}
+			if mg.Down == "" {
+				return errors.Errorf("sql: migration %d_%s has no down file", mg.Version, mg.Name)
+			}
+			if !m.conf.DryRun {
+				if err := m.apply(c, cn, mg, mg.Down); err != nil {
+					return err
+				}
+				if _, err := cn.ExecContext(c, "DELETE FROM "+m.conf.Table+" WHERE version = ?", mg.Version); err != nil {
+					return errors.Wrapf(err, "delete migration %d_%s", mg.Version, mg.Name)
+				}
+			}
+			log.Infof("%s migrate down %d_%s dry_run:%t", _family, mg.Version, mg.Name, m.conf.DryRun)
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return
+}
+
+// Version returns the newest applied version, 0 when none is applied. It
+// only reads the history table, without taking the lock.
+func (m *Migrator) Version(c context.Context) (version int64, err error) {
+	err = m.db.write.queryRow(c, "SELECT COALESCE(MAX(version), 0) FROM "+m.conf.Table).Scan(&version)
+	var me *mysql.MySQLError
+	if errors.As(err, &me) && me.Number == _errNoSuchTable {
+		return 0, nil
+	}
+	return
+}
+
+// withLock holds the advisory lock on a dedicated master connection, so
+// that a single instance migrates, and calls fn with the applied versions.
+func (m *Migrator) withLock(c context.Context, fn func(cn *sql.Conn, applied map[int64]bool) error) (err error) {
+	cn, err := m.db.write.Conn(c)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer cn.Close()
+	var locked sql.NullInt64
+	timeout := int(time.Duration(m.conf.LockTimeout) / time.Second)
+	if err = cn.QueryRowContext(c, "SELECT GET_LOCK(?, ?)", m.conf.LockName, timeout).Scan(&locked); err != nil {
+		return errors.Wrap(err, "get migration lock")
+	}
+	if locked.Int64 != 1 {
+		return ErrMigrateLocked
+	}
+	defer func() {
+		if _, e := cn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", m.conf.LockName); e != nil {
+			log.Errorf("%s release migration lock error(%v)", _family, e)
+		}
+	}()
+	if !m.conf.DryRun {
+		if _, err = cn.ExecContext(c, "CREATE TABLE IF NOT EXISTS "+m.conf.Table+" ("+
+			"version BIGINT NOT NULL PRIMARY KEY, "+
+			"name VARCHAR(255) NOT NULL, "+
+			"applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)"); err != nil {
+			return errors.Wrap(err, "create migration table")
+		}
+	}
+	applied, err := m.applied(c, cn)
+	if err != nil {
+		return
+	}
+	return fn(cn, applied)
+}
+
+func (m *Migrator) applied(c context.Context, cn *sql.Conn) (applied map[int64]bool, err error) {
+	applied = make(map[int64]bool)
+	rows, err := cn.QueryContext(c, "SELECT version FROM "+m.conf.Table)
+	if err != nil {
+		var me *mysql.MySQLError
+		if m.conf.DryRun && errors.As(err, &me) && me.Number == _errNoSuchTable {
+			return applied, nil
+		}
+		return nil, errors.Wrap(err, "load applied migrations")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int64
+		if err = rows.Scan(&v); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		applied[v] = true
+	}
+	return applied, errors.WithStack(rows.Err())
+}
+
+// apply executes the statements of a migration file one by one, as mysql
+// commits DDL implicitly a failed migration may be partially applied.
+func (m *Migrator) apply(c context.Context, cn *sql.Conn, mg *Migration, script string) error {
+	for _, stmt := range splitStatements(script) {
+		if _, err := cn.ExecContext(c, stmt); err != nil {
+			return errors.Wrapf(err, "migration %d_%s", mg.Version, mg.Name)
+		}
+	}
+	return nil
+}
+
+// splitStatements splits a script on the semicolons ending a line, comment
+// lines starting with -- are dropped.
+func splitStatements(script string) (stmts []string) {
+	var b strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+		if strings.HasSuffix(trimmed, ";") {
+			if stmt := strings.TrimSuffix(strings.TrimSpace(b.String()), ";"); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			b.Reset()
+		}
+	}
+	if stmt := strings.TrimSpace(b.String()); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return
+}
@@ -0,0 +1,158 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/quan-xie/tuba/database/sql/sqltest"
+)
+
+func TestNewMigrator(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_email.up.sql":     {Data: []byte("ALTER TABLE user ADD email VARCHAR(64);")},
+		"0002_add_email.down.sql":   {Data: []byte("ALTER TABLE user DROP email;")},
+		"0001_create_user.up.sql":   {Data: []byte("CREATE TABLE user (id BIGINT);")},
+		"0001_create_user.down.sql": {Data: []byte("DROP TABLE user;")},
+		"README.md":                 {Data: []byte("not a migration")},
+	}
+	m, err := NewMigrator(&DB{}, fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := m.Migrations()
+	if len(ms) != 2 || ms[0].Version != 1 || ms[0].Name != "create_user" || ms[1].Down != "ALTER TABLE user DROP email;" {
+		t.Errorf("NewMigrator() migrations = %+v %+v", ms[0], ms[1])
+	}
+	fsys["0003_orphan.down.sql"] = &fstest.MapFile{Data: []byte("DROP TABLE orphan;")}
+	if _, err = NewMigrator(&DB{}, fsys, nil); err == nil {
+		t.Error("NewMigrator() should fail on a migration without up file")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- create the table
+CREATE TABLE user (
+	id BIGINT NOT NULL,
+	name VARCHAR(64) DEFAULT ';'
+);
+
+CREATE INDEX idx_name ON user (name);
+INSERT INTO user VALUES (1, 'a')`
+	want := []string{
+		"CREATE TABLE user (\n\tid BIGINT NOT NULL,\n\tname VARCHAR(64) DEFAULT ';'\n)",
+		"CREATE INDEX idx_name ON user (name)",
+		"INSERT INTO user VALUES (1, 'a')",
+	}
+	if got := splitStatements(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements() = %q, want %q", got, want)
+	}
+}
+
+func newTestMigrator(t *testing.T) (*Migrator, *sqltest.Driver) {
+	db, d := openTest(t, &Config{})
+	fsys := fstest.MapFS{}
+	for i, name := range []string{"a", "b", "c"} {
+		file := fmt.Sprintf("%04d_%s", i+1, name)
+		fsys[file+".up.sql"] = &fstest.MapFile{Data: []byte(fmt.Sprintf("CREATE TABLE %s (id BIGINT);\nCREATE INDEX idx ON %s (id);", name, name))}
+		fsys[file+".down.sql"] = &fstest.MapFile{Data: []byte(fmt.Sprintf("DROP TABLE %s;", name))}
+	}
+	m, err := NewMigrator(db, fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, d
+}
+
+// expectLock expects the lock and the history table holding the versions.
+func expectLock(d *sqltest.Driver, versions ...int64) {
+	d.ExpectQuery(`^SELECT GET_LOCK\(\?, \?\)$`).WithArgs("tuba_migrate", 10).WillReturnRows(sqltest.NewRows("locked").AddRow(1))
+	d.ExpectExec(`^CREATE TABLE IF NOT EXISTS schema_migrations`)
+	rows := sqltest.NewRows("version")
+	for _, v := range versions {
+		rows.AddRow(v)
+	}
+	d.ExpectQuery(`^SELECT version FROM schema_migrations$`).WillReturnRows(rows)
+}
+
+func versions(ms []*Migration) (vs []int64) {
+	for _, m := range ms {
+		vs = append(vs, m.Version)
+	}
+	return
+}
+
+func TestMigratorUp(t *testing.T) {
+	m, d := newTestMigrator(t)
+	expectLock(d, 1)
+	d.ExpectExec(`^CREATE TABLE b`)
+	d.ExpectExec(`^CREATE INDEX idx ON b`)
+	d.ExpectExec(`^INSERT INTO schema_migrations \(version, name\) VALUES \(\?, \?\)$`).WithArgs(2, "b")
+	d.ExpectExec(`^DO RELEASE_LOCK\(\?\)$`).WithArgs("tuba_migrate")
+
+	done, err := m.Up(context.Background(), 2)
+	if err != nil || !reflect.DeepEqual(versions(done), []int64{2}) {
+		t.Errorf("Up(2) = %v, %v, want [2]", versions(done), err)
+	}
+}
+
+func TestMigratorDown(t *testing.T) {
+	m, d := newTestMigrator(t)
+	expectLock(d, 1, 2, 3)
+	d.ExpectExec(`^DROP TABLE c$`)
+	d.ExpectExec(`^DELETE FROM schema_migrations WHERE version = \?$`).WithArgs(3)
+	d.ExpectExec(`^DROP TABLE b$`)
+	d.ExpectExec(`^DELETE FROM schema_migrations WHERE version = \?$`).WithArgs(2)
+	d.ExpectExec(`^DO RELEASE_LOCK`)
+
+	done, err := m.Down(context.Background(), 1)
+	if err != nil || !reflect.DeepEqual(versions(done), []int64{3, 2}) {
+		t.Errorf("Down(1) = %v, %v, want [3 2]", versions(done), err)
+	}
+}
+
+func TestMigratorLocked(t *testing.T) {
+	m, d := newTestMigrator(t)
+	d.ExpectQuery(`^SELECT GET_LOCK`).WillReturnRows(sqltest.NewRows("locked").AddRow(0))
+
+	if _, err := m.Up(context.Background(), 0); err != ErrMigrateLocked {
+		t.Errorf("Up() = %v, want ErrMigrateLocked", err)
+	}
+}
+
+func TestMigratorUpFailure(t *testing.T) {
+	m, d := newTestMigrator(t)
+	expectLock(d)
+	d.ExpectExec(`^CREATE TABLE a`)
+	d.ExpectExec(`^CREATE INDEX idx ON a`)
+	d.ExpectExec(`^INSERT INTO schema_migrations`).WithArgs(1, "a")
+	d.ExpectExec(`^CREATE TABLE b`)
+	d.ExpectExec(`^CREATE INDEX idx ON b`).WillReturnError(&mysql.MySQLError{Number: 1061, Message: "Duplicate key name 'idx'"})
+	// the lock is released and b isn't recorded, its table stays created.
+	d.ExpectExec(`^DO RELEASE_LOCK`)
+
+	done, err := m.Up(context.Background(), 0)
+	if err == nil || !strings.Contains(err.Error(), "migration 2_b") {
+		t.Errorf("Up() error = %v, want the failure of 2_b", err)
+	}
+	if !reflect.DeepEqual(versions(done), []int64{1}) {
+		t.Errorf("Up() applied %v, want [1]", versions(done))
+	}
+}
+
+func TestMigratorVersion(t *testing.T) {
+	m, d := newTestMigrator(t)
+	d.ExpectQuery(`^SELECT COALESCE\(MAX\(version\), 0\) FROM schema_migrations$`).WillReturnRows(sqltest.NewRows("version").AddRow(3))
+	d.ExpectQuery(`^SELECT COALESCE`).WillReturnError(&mysql.MySQLError{Number: _errNoSuchTable})
+
+	for _, want := range []int64{3, 0} {
+		if v, err := m.Version(context.Background()); err != nil || v != want {
+			t.Errorf("Version() = %d, %v, want %d", v, err, want)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package sql
 
 import (
+	"time"
+
 	"github.com/quan-xie/tuba/log"
 	"github.com/quan-xie/tuba/util/xtime"
 )
 
 type Config struct {
+	Driver       string         // registered driver name, "mysql" by default.
 	DSN          string         // write data source name.
 	ReadDSN      []string       // read data source name.
 	Active       int            // pool
@@ -14,25 +17,44 @@ type Config struct {
 	QueryTimeout xtime.Duration // query sql timeout
 	ExecTimeout  xtime.Duration // execute sql timeout
 	TranTimeout  xtime.Duration // transaction sql timeout
+	TranRetry    int            // retry times of a transaction aborted by deadlock or lock wait timeout, 3 by default, negative disables it.
+	TranBackoff  xtime.Duration // backoff interval between transaction retries, 10ms by default.
+	// SlowLogDuration statements slower than it are logged, 250ms by default.
+	SlowLogDuration xtime.Duration
+	// Dialect adapts the DB to a database other than mysql, mysql when nil.
+	Dialect *Dialect
+	// Breaker enables a circuit breaker per instance when it is set.
+	Breaker *Breaker
+	// ReadYourWrites sends the reads of a Session to the master for this
+	// window after its last write, disabled when zero.
+	ReadYourWrites xtime.Duration
+	// GTIDWait lets the reads of a Session within ReadYourWrites go to a
+	// replica which applies the GTID set of its last write within GTIDWait
+	// (WAIT_FOR_EXECUTED_GTID_SET), instead of the master, disabled when zero.
+	GTIDWait xtime.Duration
+	// MaxReplicaLag skips the replicas lagging more than it, disabled when zero.
+	MaxReplicaLag    xtime.Duration
+	LagQuery         string         // query returning the lag in seconds, SHOW REPLICA STATUS by default
+	LagCheckInterval xtime.Duration // interval of the lag checks, 5s by default
 }
 
 // NewMySQL new db instance .
 func NewMySQL(c *Config) (db *DB) {
 	if c.QueryTimeout == 0 {
-		log.Warn("NewMySQL QueryTimeout is c.QueryTimeout=%d", c.QueryTimeout)
-		c.QueryTimeout = 20000
+		log.Warnf("NewMySQL QueryTimeout is c.QueryTimeout=%d", c.QueryTimeout)
+		c.QueryTimeout = xtime.Duration(20 * time.Second)
 	}
 	if c.ExecTimeout == 0 {
-		log.Warn("NewMySQL ExecTimeout is c.ExecTimeout=%d", c.ExecTimeout)
-		c.ExecTimeout = 20000
+		log.Warnf("NewMySQL ExecTimeout is c.ExecTimeout=%d", c.ExecTimeout)
+		c.ExecTimeout = xtime.Duration(20 * time.Second)
 	}
 	if c.TranTimeout == 0 {
-		log.Warn("NewMySQL TranTimeout is c.TranTimeout=%d", c.TranTimeout)
-		c.TranTimeout = 2000
+		log.Warnf("NewMySQL TranTimeout is c.TranTimeout=%d", c.TranTimeout)
+		c.TranTimeout = xtime.Duration(2 * time.Second)
 	}
 	db, err := Open(c)
 	if err != nil {
-		log.Error("open mysql error(%v)", err)
+		log.Errorf("open mysql error(%v)", err)
 		panic(err)
 	}
 	return
@@ -1 +1,107 @@
 package sql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/database/sql/sqltest"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+// openTest opens a db on a fake driver, the master is "master" and the
+// replicas are "replica1" and "replica2".
+func openTest(t *testing.T, c *Config) (*DB, *sqltest.Driver) {
+	name, d := sqltest.New()
+	c.Driver = name
+	c.DSN = "master"
+	c.ReadDSN = []string{"replica1", "replica2"}
+	db, err := Open(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		if err := d.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return db, d
+}
+
+func TestRouting(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	c := context.Background()
+	d.ExpectExec(`^UPDATE user`).WithDSN("master").WillReturnResult(0, 1)
+	d.ExpectQuery(`^SELECT name`).WithDSN("replica2").WillReturnRows(sqltest.NewRows("name").AddRow("a"))
+	d.ExpectQuery(`^SELECT name`).WithDSN("replica1").WillReturnRows(sqltest.NewRows("name").AddRow("b"))
+	d.ExpectQuery(`^SELECT name`).WithDSN("master").WillReturnRows(sqltest.NewRows("name").AddRow("c"))
+	d.ExpectQuery(`^SELECT name`).WithDSN("master").WillReturnRows(sqltest.NewRows("name").AddRow("d"))
+
+	if _, err := db.Exec(c, "UPDATE user SET name = ?", "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a", "b"} {
+		var name string
+		if err := db.QueryRow(c, "SELECT name FROM user").Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if name != want {
+			t.Errorf("QueryRow() = %s, want %s", name, want)
+		}
+	}
+	var name string
+	if err := db.QueryRow(WithMaster(c), "SELECT name FROM user").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Master().QueryRow(c, "SELECT name FROM user").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoutingSession(t *testing.T) {
+	db, d := openTest(t, &Config{ReadYourWrites: xtime.Duration(time.Minute)})
+	c := NewSession(context.Background())
+	d.ExpectQuery(`^SELECT`).WithDSN("replica2")
+	d.ExpectExec(`^UPDATE`).WithDSN("master")
+	d.ExpectQuery(`^SELECT`).WithDSN("master")
+
+	for _, query := range []string{"SELECT 1", "UPDATE user SET name = ''", "SELECT 1"} {
+		var err error
+		if query[0] == 'U' {
+			_, err = db.Exec(c, query)
+		} else {
+			var rows *Rows
+			if rows, err = db.Query(c, query); err == nil {
+				rows.Close()
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	db, d := openTest(t, &Config{
+		QueryTimeout: xtime.Duration(10 * time.Millisecond),
+		ExecTimeout:  xtime.Duration(10 * time.Millisecond),
+	})
+	c := context.Background()
+	d.ExpectQuery(`^SELECT`).WillDelay(time.Second)
+	d.ExpectExec(`^UPDATE`).WillDelay(time.Second)
+	d.ExpectQuery(`^SELECT`).WillDelay(time.Second)
+
+	if _, err := db.Query(c, "SELECT 1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Query() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := db.Exec(c, "UPDATE user SET name = ''"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Exec() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	var n int
+	if err := db.QueryRow(c, "SELECT 1").Scan(&n); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("QueryRow() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,34 @@
+// Package nsqtopic relays the events of a database/sql outbox to nsq topics.
+package nsqtopic
+
+import (
+	"context"
+
+	"github.com/quan-xie/tuba/database/sql"
+)
+
+// Producer publishes a message body to a topic, such as a *nsq.Producer.
+type Producer interface {
+	Publish(topic string, body []byte) error
+}
+
+// Publisher publishes the payload of every message to the nsq topic named
+// after its topic. nsq has neither keys nor headers, the consumers must
+// tolerate duplicates and reordering.
+type Publisher struct {
+	p Producer
+}
+
+// NewPublisher returns a publisher publishing the messages with p.
+func NewPublisher(p Producer) *Publisher {
+	return &Publisher{p: p}
+}
+
+// Publish implements sql.Publisher. The nsq producer has its own timeouts
+// and doesn't take a context, c is only checked before publishing.
+func (p *Publisher) Publish(c context.Context, msg *sql.Message) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	return p.p.Publish(msg.Topic, msg.Payload)
+}
@@ -0,0 +1,264 @@
+package sql
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/retry"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+const (
+	_outboxTable        = "outbox"
+	_outboxBatch        = 100
+	_outboxPollInterval = time.Second
+	_outboxBackoff      = time.Second
+	_outboxMaxBackoff   = 10 * time.Minute
+	_outboxLease        = 30 * time.Second
+)
+
+// OutboxConfig is the config of an Outbox. The table is created with:
+//
+//	CREATE TABLE outbox (
+//		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+//		topic VARCHAR(255) NOT NULL,
+//		msg_key VARCHAR(255) NOT NULL DEFAULT '',
+//		payload MEDIUMBLOB NOT NULL,
+//		attempts INT NOT NULL DEFAULT 0,
+//		next_at DATETIME(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+//		sent_at DATETIME(3) NULL,
+//		ctime DATETIME(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+//		KEY idx_pending (sent_at, next_at)
+//	);
+type OutboxConfig struct {
+	Table        string         // outbox table, "outbox" by default.
+	BatchSize    int            // rows relayed per poll, 100 by default.
+	PollInterval xtime.Duration // interval between polls, 1s by default.
+	// Backoff is the first retry interval of a failed message, 1s by default,
+	// doubled on every attempt up to MaxBackoff, 10m by default.
+	Backoff    xtime.Duration
+	MaxBackoff xtime.Duration
+	// Lease delays the claimed events while they are published, they are
+	// relayed again after it when the relay dies, 30s by default.
+	Lease xtime.Duration
+}
+
+// Message is an event of the outbox.
+type Message struct {
+	ID       int64
+	Topic    string
+	Key      string
+	Payload  []byte
+	Attempts int
+}
+
+// Publisher publishes the messages relayed from the outbox, a message is
+// marked as sent once Publish returns nil so delivery is at least once.
+type Publisher interface {
+	Publish(c context.Context, msg *Message) error
+}
+
+// PublisherFunc is an adapter to allow the use of ordinary functions as a
+// Publisher, such as the producer of a message queue. The redis streams,
+// kafka and nsq publishers are in database/sql/redisstream, kafkatopic and
+// nsqtopic.
+type PublisherFunc func(c context.Context, msg *Message) error
+
+// Publish calls f(c, msg).
+func (f PublisherFunc) Publish(c context.Context, msg *Message) error {
+	return f(c, msg)
+}
+
+// Outbox stores events in the same transaction as the writes they describe
+// and relays them to a Publisher in the background.
+type Outbox struct {
+	db      *DB
+	conf    *OutboxConfig
+	retrier retry.Retriable
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+// NewOutbox returns the outbox of the db.
+func NewOutbox(db *DB, c *OutboxConfig) *Outbox {
+	if c == nil {
+		c = &OutboxConfig{}
+	}
+	if c.Table == "" {
+		c.Table = _outboxTable
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = _outboxBatch
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = xtime.Duration(_outboxPollInterval)
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = xtime.Duration(_outboxBackoff)
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = xtime.Duration(_outboxMaxBackoff)
+	}
+	if c.Lease <= 0 {
+		c.Lease = xtime.Duration(_outboxLease)
+	}
+	return &Outbox{
+		db:      db,
+		conf:    c,
+		retrier: retry.NewRetrierFunc(c.backoff),
+	}
+}
+
+// SetRetrier sets the retrier computing the delay before a failed message
+// is published again.
+func (o *Outbox) SetRetrier(retrier retry.Retriable) {
+	o.retrier = retrier
+}
+
+// Add inserts an event in the transaction, it is relayed only if the
+// transaction commits.
+func (o *Outbox) Add(tx *Tx, topic, key string, payload []byte) (err error) {
+	_, err = tx.ExecBuilder(NewInsert(o.conf.Table, "topic", "msg_key", "payload").Values(topic, key, payload))
+	return
+}
+
+// Start relays the pending events to p until Close is called. Several
+// instances may relay the same table, the rows are locked with SKIP LOCKED
+// which requires mysql 8.0.
+func (o *Outbox) Start(p Publisher) {
+	o.closed = make(chan struct{})
+	o.done = make(chan struct{})
+	go func() {
+		defer close(o.done)
+		ticker := time.NewTicker(time.Duration(o.conf.PollInterval))
+		defer ticker.Stop()
+		for {
+			n, err := o.Relay(context.Background(), p)
+			if err != nil {
+				log.Errorf("%s outbox relay error(%v)", _family, err)
+			}
+			if n == o.conf.BatchSize {
+				// more rows are likely pending.
+				select {
+				case <-o.closed:
+					return
+				default:
+					continue
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-o.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the relay started by Start.
+func (o *Outbox) Close() {
+	if o.closed == nil {
+		return
+	}
+	close(o.closed)
+	<-o.done
+}
+
+// Relay publishes one batch of due events and returns the number of rows
+// handled. The batch is claimed for Lease in a short transaction and then
+// published, sent rows are marked with sent_at and failed rows are delayed
+// by the retrier according to their attempts.
+func (o *Outbox) Relay(c context.Context, p Publisher) (n int, err error) {
+	msgs, err := o.claim(c)
+	if err != nil || len(msgs) == 0 {
+		return
+	}
+	n = len(msgs)
+	sent := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		if e := p.Publish(c, m); e != nil {
+			delay := o.retryDelay(m.Attempts + 1)
+			log.CtxWarnf(c, "%s outbox publish id:%d topic:%s attempts:%d error(%v) retry in %v", _family, m.ID, m.Topic, m.Attempts+1, e, delay)
+			if _, err = o.db.ExecBuilder(c, NewUpdate(o.conf.Table).
+				SetExpr("attempts", "attempts + 1").
+				SetExpr("next_at", "NOW(3) + INTERVAL ? MICROSECOND", delay.Microseconds()).
+				Where(Eq("id", m.ID))); err != nil {
+				return
+			}
+			continue
+		}
+		sent = append(sent, m.ID)
+	}
+	if len(sent) > 0 {
+		_, err = o.db.ExecBuilder(c, NewUpdate(o.conf.Table).SetExpr("sent_at", "NOW(3)").Where(In("id", sent)))
+	}
+	return
+}
+
+// claim locks a batch of due events, skipping the ones locked by another
+// relay, and pushes their next_at by Lease so that no other relay picks them.
+func (o *Outbox) claim(c context.Context) (msgs []*Message, err error) {
+	err = o.db.WithTx(c, nil, func(tx *Tx) error {
+		msgs = msgs[:0]
+		query, args, _ := NewSelect(o.conf.Table, "id", "topic", "msg_key", "payload", "attempts").
+			Where(IsNull("sent_at"), Expr("next_at <= NOW(3)")).
+			OrderBy("id").Limit(o.conf.BatchSize).ForUpdate().ToSQL()
+		rows, err := tx.Query(query+" SKIP LOCKED", args...)
+		if err != nil {
+			return err
+		}
+		ids := make([]int64, 0, o.conf.BatchSize)
+		for rows.Next() {
+			m := new(Message)
+			if err = rows.Scan(&m.ID, &m.Topic, &m.Key, &m.Payload, &m.Attempts); err != nil {
+				rows.Close()
+				return errors.WithStack(err)
+			}
+			msgs = append(msgs, m)
+			ids = append(ids, m.ID)
+		}
+		// the rows must be closed before the next statement of the transaction.
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		_, err = tx.ExecBuilder(NewUpdate(o.conf.Table).
+			SetExpr("next_at", "NOW(3) + INTERVAL ? MICROSECOND", time.Duration(o.conf.Lease).Microseconds()).
+			Where(In("id", ids)))
+		return err
+	})
+	return
+}
+
+// backoff waits Backoff before the first retry and doubles it on every
+// attempt after it, up to MaxBackoff.
+func (c *OutboxConfig) backoff(attempts int) time.Duration {
+	d := time.Duration(c.Backoff)
+	for i := 1; i < attempts && d < time.Duration(c.MaxBackoff); i++ {
+		d *= 2
+	}
+	return d
+}
+
+func (o *Outbox) retryDelay(attempts int) time.Duration {
+	d := o.retrier.NextInterval(attempts)
+	if max := time.Duration(o.conf.MaxBackoff); d > max || d <= 0 {
+		return max
+	}
+	return d
+}
+
+// Purge deletes the events sent before t, limit rows at most.
+func (o *Outbox) Purge(c context.Context, t time.Time, limit int) (n int64, err error) {
+	res, err := o.db.ExecBuilder(c, NewDelete(o.conf.Table).Where(IsNotNull("sent_at"), Lt("sent_at", t)).Limit(limit))
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,78 @@
+package sql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/database/sql/sqltest"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+const _claimQuery = `^SELECT id, topic, msg_key, payload, attempts FROM outbox WHERE sent_at IS NULL AND \(next_at <= NOW\(3\)\) ORDER BY id LIMIT 10 FOR UPDATE SKIP LOCKED$`
+
+func TestOutboxRetryDelay(t *testing.T) {
+	o := NewOutbox(&DB{}, &OutboxConfig{Backoff: xtime.Duration(time.Second), MaxBackoff: xtime.Duration(time.Minute)})
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		10: time.Minute,
+		80: time.Minute,
+	} {
+		if got := o.retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	o := NewOutbox(db, &OutboxConfig{BatchSize: 10, Backoff: xtime.Duration(time.Second)})
+	d.ExpectBegin()
+	d.ExpectQuery(_claimQuery).WillReturnRows(sqltest.NewRows("id", "topic", "msg_key", "payload", "attempts").
+		AddRow(1, "user", "1", []byte("a"), 0).
+		AddRow(2, "user", "2", []byte("b"), 2).
+		AddRow(3, "order", "3", []byte("c"), 0))
+	// the claimed rows are leased for 30s.
+	d.ExpectExec(`^UPDATE outbox SET next_at = NOW\(3\) \+ INTERVAL \? MICROSECOND WHERE id IN \(\?, \?, \?\)$`).
+		WithArgs(int64(30*time.Second/time.Microsecond), 1, 2, 3)
+	d.ExpectCommit()
+	// the third attempt of 2 is delayed by 1s*2^3.
+	d.ExpectExec(`^UPDATE outbox SET attempts = attempts \+ 1, next_at = NOW\(3\) \+ INTERVAL \? MICROSECOND WHERE id = \?$`).
+		WithArgs(int64(4*time.Second/time.Microsecond), 2)
+	d.ExpectExec(`^UPDATE outbox SET sent_at = NOW\(3\) WHERE id IN \(\?, \?\)$`).WithArgs(1, 3)
+
+	var published []string
+	n, err := o.Relay(context.Background(), PublisherFunc(func(c context.Context, msg *Message) error {
+		if msg.ID == 2 {
+			return errors.New("broker down")
+		}
+		published = append(published, msg.Topic+":"+msg.Key+":"+string(msg.Payload))
+		return nil
+	}))
+	if err != nil || n != 3 {
+		t.Fatalf("Relay() = %d, %v, want 3", n, err)
+	}
+	if len(published) != 2 || published[0] != "user:1:a" || published[1] != "order:3:c" {
+		t.Errorf("published %v", published)
+	}
+}
+
+func TestOutboxRelayEmpty(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	o := NewOutbox(db, &OutboxConfig{BatchSize: 10})
+	d.ExpectBegin()
+	d.ExpectQuery(_claimQuery).WillReturnRows(sqltest.NewRows("id", "topic", "msg_key", "payload", "attempts"))
+	d.ExpectCommit()
+
+	n, err := o.Relay(context.Background(), PublisherFunc(func(c context.Context, msg *Message) error {
+		t.Errorf("Publish(%d) without pending rows", msg.ID)
+		return nil
+	}))
+	if err != nil || n != 0 {
+		t.Errorf("Relay() = %d, %v, want 0", n, err)
+	}
+}
@@ -1,5 +1,63 @@
 package sql
 
-func init() {
+import (
+	"context"
+	"testing"
 
+	"github.com/quan-xie/tuba/database/sql/sqltest"
+)
+
+func TestQuery(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	d.ExpectQuery(`^SELECT id, name FROM user WHERE id > \?`).WithArgs(1).
+		WillReturnRows(sqltest.NewRows("id", "name").AddRow(2, "a").AddRow(3, "b"))
+
+	rows, err := db.Query(context.Background(), "SELECT id, name FROM user WHERE id > ?", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err = rows.Scan(&id, &name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("Query() = %v, want [a b]", names)
+	}
+}
+
+func TestQueryRowNoRows(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	d.ExpectQuery(`^SELECT name`).WillReturnRows(sqltest.NewRows("name"))
+
+	var name string
+	if err := db.QueryRow(context.Background(), "SELECT name FROM user WHERE id = ?", 1).Scan(&name); err != ErrNoRows {
+		t.Errorf("QueryRow() error = %v, want %v", err, ErrNoRows)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	d.ExpectQuery(`^SELECT`).
+		WillReturnRows(sqltest.NewRows("id", "user_id", "name", "age").AddRow(1, 10, "a", 18).AddRow(2, 20, "b", 20))
+	d.ExpectQuery(`^SELECT`).WillReturnRows(sqltest.NewRows("id"))
+
+	c := context.Background()
+	users, err := Select[scanUser](c, db, "SELECT id, user_id, name, age FROM user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[1].scanBase.ID != 2 || users[1].ID != 20 || users[1].Name != "b" || users[1].Age != 20 {
+		t.Errorf("Select() = %+v", users)
+	}
+	if _, err = Get[int64](c, db, "SELECT id FROM user WHERE id = ?", 3); err != ErrNoRows {
+		t.Errorf("Get() error = %v, want %v", err, ErrNoRows)
+	}
 }
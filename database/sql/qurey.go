@@ -3,24 +3,68 @@ package sql
 import (
 	"context"
 	"database/sql"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
 )
 
+// Rows rows.
+type Rows struct {
+	*sql.Rows
+	cancel func()
+}
+
+// Close closes the Rows, preventing further enumeration. If Next is called
+// and returns false and there are no further result sets,
+// the Rows are closed automatically and it will suffice to check the
+// result of Err. Close is idempotent and does not affect the result of Err.
+func (rs *Rows) Close() (err error) {
+	err = errors.WithStack(rs.Rows.Close())
+	if rs.cancel != nil {
+		rs.cancel()
+	}
+	return
+}
+
+// Row row.
+type Row struct {
+	err error
+	*sql.Row
+	db     *conn
+	query  string
+	cancel func()
+	span   *trace.Span
+}
+
+// Scan copies the columns from the matched row into the values pointed at by dest.
+func (r *Row) Scan(dest ...interface{}) (err error) {
+	if r.cancel != nil {
+		defer r.cancel()
+	}
+	defer func() { endSpan(r.span, err) }()
+	if r.err != nil {
+		return r.err
+	}
+	err = r.Row.Scan(dest...)
+	if r.db != nil {
+		r.db.done(err)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		err = errors.Wrapf(err, "query:%s", r.query)
+	}
+	return
+}
+
 // Qurey is wrap mysql qurey
+//
+// Deprecated: use Query, which also applies the configured QueryTimeout.
 func (db *DB) Qurey(c context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
-	idx := db.readIndex()
-	if len(db.read) > idx {
-		if rows, err = db.read[(idx)%len(db.read)].QueryContext(c, query, args); err != nil {
-			return
-		}
-	}
-	return db.write.QueryContext(c, query, args...)
+	return db.readConn(c).QueryContext(c, query, args...)
 }
 
 // QureyRow is wrap mysql qureyrow
+//
+// Deprecated: use QueryRow, which also applies the configured QueryTimeout.
 func (db *DB) QureyRow(c context.Context, query string, args ...interface{}) (row *sql.Row) {
-	idx := db.readIndex()
-	if len(db.read) > idx {
-		return db.read[(idx)%len(db.read)].QueryRowContext(c, query, args)
-	}
-	return db.write.QueryRowContext(c, query, args)
+	return db.readConn(c).QueryRowContext(c, query, args...)
 }
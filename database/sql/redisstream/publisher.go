@@ -0,0 +1,38 @@
+// Package redisstream relays the events of a database/sql outbox to redis
+// streams.
+package redisstream
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/quan-xie/tuba/database/sql"
+)
+
+// Publisher publishes every message to the redis stream named after its
+// topic.
+type Publisher struct {
+	client redis.Cmdable
+	maxLen int64
+}
+
+// NewPublisher returns a publisher adding the messages to redis streams
+// trimmed to about maxLen entries, not trimmed when maxLen is 0.
+func NewPublisher(client redis.Cmdable, maxLen int64) *Publisher {
+	return &Publisher{client: client, maxLen: maxLen}
+}
+
+// Publish implements sql.Publisher.
+func (p *Publisher) Publish(c context.Context, msg *sql.Message) error {
+	return p.client.XAdd(c, &redis.XAddArgs{
+		Stream: msg.Topic,
+		MaxLen: p.maxLen,
+		Approx: p.maxLen > 0,
+		Values: map[string]interface{}{
+			"id":      msg.ID,
+			"key":     msg.Key,
+			"payload": msg.Payload,
+		},
+	}).Err()
+}
@@ -0,0 +1,175 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	_scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	_timeType    = reflect.TypeOf(time.Time{})
+	_structs     sync.Map // reflect.Type -> *structMeta
+)
+
+// structMeta is the column to field mapping of a struct type.
+type structMeta struct {
+	fields map[string][]int // column name -> field index path.
+}
+
+// Select runs the query and scans every row into a T. When T is a struct
+// the columns are mapped to its fields by the `db` tag, falling back to the
+// lower cased field name, otherwise the query must return a single column.
+func Select[T any](c context.Context, db *DB, query string, args ...interface{}) (res []T, err error) {
+	rows, err := db.Query(c, query, args...)
+	if err != nil {
+		return
+	}
+	return ScanAll[T](rows)
+}
+
+// Get runs the query and scans the first row into a T, ErrNoRows is
+// returned when the query matches nothing.
+func Get[T any](c context.Context, db *DB, query string, args ...interface{}) (res T, err error) {
+	rows, err := db.Query(c, query, args...)
+	if err != nil {
+		return
+	}
+	return ScanOne[T](rows)
+}
+
+// ScanAll scans all the rows into a slice of T and closes them.
+func ScanAll[T any](rows *Rows) (res []T, err error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	for rows.Next() {
+		var v T
+		if err = scanRow(rows, columns, &v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	err = errors.WithStack(rows.Err())
+	return
+}
+
+// ScanOne scans the first row into a T and closes the rows, ErrNoRows is
+// returned when there is no row.
+func ScanOne[T any](rows *Rows) (res T, err error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err == nil {
+			err = ErrNoRows
+		}
+		return
+	}
+	err = scanRow(rows, columns, &res)
+	return
+}
+
+func scanRow(rows *Rows, columns []string, dest interface{}) (err error) {
+	v := reflect.ValueOf(dest).Elem()
+	if !isStruct(v.Type()) {
+		if len(columns) != 1 {
+			return errors.Errorf("sql: scan %d columns into non-struct type %s", len(columns), v.Type())
+		}
+		return errors.WithStack(rows.Scan(dest))
+	}
+	meta := structMetaOf(v.Type())
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		index, ok := meta.fields[strings.ToLower(column)]
+		if !ok {
+			return errors.Errorf("sql: missing destination field for column %q in %s", column, v.Type())
+		}
+		values[i] = fieldByIndex(v, index).Addr().Interface()
+	}
+	return errors.WithStack(rows.Scan(values...))
+}
+
+// isStruct reports whether t is a struct to be mapped field by field rather
+// than scanned as a whole.
+func isStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != _timeType && !reflect.PtrTo(t).Implements(_scannerType)
+}
+
+func structMetaOf(t reflect.Type) *structMeta {
+	if m, ok := _structs.Load(t); ok {
+		return m.(*structMeta)
+	}
+	m := &structMeta{fields: make(map[string][]int)}
+	walkFields(t, nil, m.fields)
+	actual, _ := _structs.LoadOrStore(t, m)
+	return actual.(*structMeta)
+}
+
+// walkFields collects the fields of t, embedded structs are flattened and
+// the fields of the outer struct take precedence.
+func walkFields(t reflect.Type, parent []int, fields map[string][]int) {
+	var embedded [][]int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("db")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		index := append(append([]int{}, parent...), i)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && isStruct(ft) {
+			// a nil pointer to an unexported struct can't be allocated.
+			if f.PkgPath == "" || f.Type.Kind() != reflect.Ptr {
+				embedded = append(embedded, index)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := tag
+		if name == "" {
+			name = f.Name
+		}
+		name = strings.ToLower(name)
+		if _, ok := fields[name]; !ok {
+			fields[name] = index
+		}
+	}
+	for _, index := range embedded {
+		ft := t.Field(index[len(index)-1]).Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		walkFields(ft, index, fields)
+	}
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex allocating nil embedded pointers.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
@@ -0,0 +1,71 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/quan-xie/tuba/database/sql/sqltest"
+	"github.com/quan-xie/tuba/util/xtime"
+)
+
+type scanBase struct {
+	ID    int64      `db:"id"`
+	Ctime xtime.Time `db:"ctime"`
+}
+
+type scanUser struct {
+	scanBase
+	*ScanExtra
+	ID      int64          `db:"user_id"`
+	Name    string         `db:"name"`
+	Email   sql.NullString `db:"email"`
+	Nick    *string
+	Ignored string `db:"-"`
+	secret  string
+}
+
+type ScanExtra struct {
+	Age int `db:"age"`
+}
+
+func TestStructMetaOf(t *testing.T) {
+	meta := structMetaOf(reflect.TypeOf(scanUser{}))
+	want := map[string][]int{
+		"user_id": {2},
+		"name":    {3},
+		"email":   {4},
+		"nick":    {5},
+		"id":      {0, 0},
+		"ctime":   {0, 1},
+		"age":     {1, 0},
+	}
+	if !reflect.DeepEqual(meta.fields, want) {
+		t.Errorf("structMetaOf() = %v, want %v", meta.fields, want)
+	}
+	if structMetaOf(reflect.TypeOf(scanUser{})) != meta {
+		t.Error("structMetaOf() should be cached per type")
+	}
+}
+
+func TestFieldByIndex(t *testing.T) {
+	var u scanUser
+	fieldByIndex(reflect.ValueOf(&u).Elem(), []int{1, 0}).SetInt(18)
+	if u.ScanExtra == nil || u.Age != 18 {
+		t.Errorf("fieldByIndex() should allocate the embedded pointer, got %+v", u.ScanExtra)
+	}
+}
+
+func TestScanAllDatetimeText(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	d.ExpectQuery(`^SELECT id, ctime`).WillReturnRows(sqltest.NewRows("id", "ctime").AddRow(1, []byte("2024-01-02 15:04:05")))
+	rows, err := db.Query(context.Background(), "SELECT id, ctime FROM user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ScanAll[scanBase](rows)
+	if err != nil || len(got) != 1 || got[0].Ctime != 1704207845 {
+		t.Errorf("ScanAll() = %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,355 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/quan-xie/tuba/log"
+)
+
+const (
+	RouterMod   = "mod"   // key modulo the number of tables.
+	RouterRange = "range" // key compared to ordered upper bounds.
+	RouterHash  = "hash"  // consistent hash ring of the tables.
+
+	_shardTableFormat  = "%s_%02d"
+	_shardVirtualNodes = 64
+	_scatterWorkers    = 8
+)
+
+// ShardConfig is the config of a ShardedDB, every cluster holds the same
+// number of tables and a shard key routes to one table of one cluster.
+type ShardConfig struct {
+	Clusters      []*Config // one config per cluster.
+	Tables        int       // tables per cluster, 1 by default.
+	TableFormat   string    // physical table name from the logical name and the table index, "%s_%02d" by default.
+	LogicalTables []string  // logical table names rewritten in the statements.
+	Router        string    // RouterMod (default), RouterRange or RouterHash.
+	// RangeBounds are the exclusive upper bounds of the keys of every table
+	// in ascending order for RouterRange, one per table of all the clusters.
+	RangeBounds  []int64
+	VirtualNodes int // virtual nodes of every table for RouterHash, 64 by default.
+	Workers      int // concurrent statements of a scatter-gather, 8 by default.
+}
+
+// Router routes a shard key to a table index within [0, clusters*tables).
+type Router interface {
+	Route(key int64) (int, error)
+}
+
+type modRouter int
+
+// NewModRouter routes keys by key modulo n.
+func NewModRouter(n int) Router {
+	return modRouter(n)
+}
+
+func (r modRouter) Route(key int64) (int, error) {
+	n := int64(r)
+	return int((key%n + n) % n), nil
+}
+
+type rangeRouter []int64
+
+// NewRangeRouter routes the keys below bounds[i] and above bounds[i-1] to i.
+func NewRangeRouter(bounds []int64) Router {
+	return rangeRouter(bounds)
+}
+
+func (r rangeRouter) Route(key int64) (int, error) {
+	i := sort.Search(len(r), func(i int) bool { return key < r[i] })
+	if i == len(r) {
+		return 0, errors.Errorf("sql: shard key %d out of range", key)
+	}
+	return i, nil
+}
+
+type hashRouter struct {
+	ring  []uint32
+	nodes map[uint32]int
+}
+
+// NewHashRouter routes keys over a consistent hash ring of n tables with
+// vnodes virtual nodes each.
+func NewHashRouter(n, vnodes int) Router {
+	r := &hashRouter{nodes: make(map[uint32]int, n*vnodes)}
+	for i := 0; i < n; i++ {
+		for v := 0; v < vnodes; v++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + strconv.Itoa(v)))
+			if _, ok := r.nodes[h]; ok {
+				continue
+			}
+			r.nodes[h] = i
+			r.ring = append(r.ring, h)
+		}
+	}
+	sort.Slice(r.ring, func(i, j int) bool { return r.ring[i] < r.ring[j] })
+	return r
+}
+
+func (r *hashRouter) Route(key int64) (int, error) {
+	h := crc32.ChecksumIEEE([]byte(strconv.FormatInt(key, 10)))
+	i := sort.Search(len(r.ring), func(i int) bool { return r.ring[i] >= h })
+	if i == len(r.ring) {
+		i = 0
+	}
+	return r.nodes[r.ring[i]], nil
+}
+
+// StringKey turns a string into a shard key.
+func StringKey(s string) int64 {
+	return int64(crc32.ChecksumIEEE([]byte(s)))
+}
+
+// ShardedDB routes statements to the clusters and tables of a shard key.
+type ShardedDB struct {
+	dbs    []*DB
+	shards []*Shard
+	router Router
+	conf   *ShardConfig
+}
+
+// Shard is a table of a cluster.
+type Shard struct {
+	db      *DB
+	Cluster int // cluster index.
+	Table   int // table index within the cluster.
+	tables  []tableRewrite
+}
+
+// tableRewrite replaces the matches of a logical table pattern by the
+// physical table of a shard.
+type tableRewrite struct {
+	p     *regexp.Regexp
+	table string
+}
+
+// tablePatterns returns the patterns of the logical table: the table after
+// FROM, JOIN, INTO, UPDATE or TABLE and the table qualifying a column.
+func tablePatterns(table string) []*regexp.Regexp {
+	name := regexp.QuoteMeta(table)
+	return []*regexp.Regexp{
+		regexp.MustCompile(`\b((?i:FROM|JOIN|INTO|UPDATE|TABLE)\s+` + "`?)" + name + `\b()`),
+		regexp.MustCompile(`(^|[^.\w])` + name + `(\.)`),
+	}
+}
+
+// OpenSharded opens every cluster of the config.
+func OpenSharded(c *ShardConfig) (s *ShardedDB, err error) {
+	if len(c.Clusters) == 0 {
+		return nil, errors.New("sql: no shard cluster")
+	}
+	if c.Tables <= 0 {
+		c.Tables = 1
+	}
+	if c.TableFormat == "" {
+		c.TableFormat = _shardTableFormat
+	}
+	if c.VirtualNodes <= 0 {
+		c.VirtualNodes = _shardVirtualNodes
+	}
+	if c.Workers <= 0 {
+		c.Workers = _scatterWorkers
+	}
+	n := len(c.Clusters) * c.Tables
+	s = &ShardedDB{conf: c}
+	switch c.Router {
+	case "", RouterMod:
+		s.router = NewModRouter(n)
+	case RouterRange:
+		if len(c.RangeBounds) != n {
+			return nil, errors.Errorf("sql: %d range bounds for %d tables", len(c.RangeBounds), n)
+		}
+		for i := 1; i < n; i++ {
+			if c.RangeBounds[i] <= c.RangeBounds[i-1] {
+				return nil, errors.Errorf("sql: range bounds %v aren't ascending", c.RangeBounds)
+			}
+		}
+		s.router = NewRangeRouter(c.RangeBounds)
+	case RouterHash:
+		s.router = NewHashRouter(n, c.VirtualNodes)
+	default:
+		return nil, errors.Errorf("sql: unknown shard router %q", c.Router)
+	}
+	patterns := make([][]*regexp.Regexp, len(c.LogicalTables))
+	for i, t := range c.LogicalTables {
+		patterns[i] = tablePatterns(t)
+	}
+	for i, cc := range c.Clusters {
+		db, err := Open(cc)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.dbs = append(s.dbs, db)
+		for t := 0; t < c.Tables; t++ {
+			shard := &Shard{db: db, Cluster: i, Table: t}
+			for j, ps := range patterns {
+				table := fmt.Sprintf(c.TableFormat, c.LogicalTables[j], t)
+				for _, p := range ps {
+					shard.tables = append(shard.tables, tableRewrite{p: p, table: table})
+				}
+			}
+			s.shards = append(s.shards, shard)
+		}
+	}
+	return
+}
+
+// NewSharded new a sharded db instance, it panics when a cluster fails to open.
+func NewSharded(c *ShardConfig) (s *ShardedDB) {
+	s, err := OpenSharded(c)
+	if err != nil {
+		log.Errorf("open sharded mysql error(%v)", err)
+		panic(err)
+	}
+	return
+}
+
+// Shard returns the shard of the key.
+func (s *ShardedDB) Shard(key int64) (*Shard, error) {
+	i, err := s.router.Route(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.shards[i], nil
+}
+
+// Shards returns all the shards.
+func (s *ShardedDB) Shards() []*Shard {
+	return s.shards
+}
+
+// Close closes all the clusters.
+func (s *ShardedDB) Close() (err error) {
+	for _, db := range s.dbs {
+		if e := db.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Exec rewrites the logical tables and executes the query on the shard of key.
+func (s *ShardedDB) Exec(c context.Context, key int64, query string, args ...interface{}) (res sql.Result, err error) {
+	shard, err := s.Shard(key)
+	if err != nil {
+		return
+	}
+	return shard.Exec(c, query, args...)
+}
+
+// Query rewrites the logical tables and runs the query on the shard of key.
+func (s *ShardedDB) Query(c context.Context, key int64, query string, args ...interface{}) (rows *Rows, err error) {
+	shard, err := s.Shard(key)
+	if err != nil {
+		return
+	}
+	return shard.Query(c, query, args...)
+}
+
+// Scatter calls fn with every shard concurrently, the first error cancels
+// the context of the calls still running and is returned.
+func (s *ShardedDB) Scatter(c context.Context, fn func(c context.Context, shard *Shard) error) (err error) {
+	c, cancel := context.WithCancel(c)
+	defer cancel()
+	var (
+		once sync.Once
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, s.conf.Workers)
+	)
+	for _, shard := range s.shards {
+		select {
+		case sem <- struct{}{}:
+		case <-c.Done():
+			wg.Wait()
+			if err == nil {
+				err = c.Err()
+			}
+			return
+		}
+		wg.Add(1)
+		go func(shard *Shard) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if e := fn(c, shard); e != nil {
+				once.Do(func() {
+					err = errors.Wrapf(e, "shard cluster:%d table:%d", shard.Cluster, shard.Table)
+					cancel()
+				})
+			}
+		}(shard)
+	}
+	wg.Wait()
+	return
+}
+
+// ScatterSelect runs the query on every shard and merges the rows scanned
+// into T, the merged rows are in no particular order.
+func ScatterSelect[T any](c context.Context, s *ShardedDB, query string, args ...interface{}) (res []T, err error) {
+	var mu sync.Mutex
+	err = s.Scatter(c, func(c context.Context, shard *Shard) error {
+		rows, err := shard.Query(c, query, args...)
+		if err != nil {
+			return err
+		}
+		vs, err := ScanAll[T](rows)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		res = append(res, vs...)
+		mu.Unlock()
+		return nil
+	})
+	return
+}
+
+// DB returns the cluster of the shard.
+func (s *Shard) DB() *DB {
+	return s.db
+}
+
+// Rewrite replaces the logical table names of query by the physical names
+// of the shard, in the order of ShardConfig.LogicalTables. Only the tables
+// following FROM, JOIN, INTO, UPDATE or TABLE and the tables qualifying a
+// column (table.column) are replaced, so a column or an alias named like a
+// table is kept, but so is the second table of FROM a, b.
+func (s *Shard) Rewrite(query string) string {
+	for _, r := range s.tables {
+		query = r.p.ReplaceAllString(query, "${1}"+strings.ReplaceAll(r.table, "$", "$$")+"${2}")
+	}
+	return query
+}
+
+// Exec rewrites the logical tables and executes the query on the master.
+func (s *Shard) Exec(c context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(c, s.Rewrite(query), args...)
+}
+
+// Query rewrites the logical tables and runs the query.
+func (s *Shard) Query(c context.Context, query string, args ...interface{}) (*Rows, error) {
+	return s.db.Query(c, s.Rewrite(query), args...)
+}
+
+// QueryRow rewrites the logical tables and runs the query.
+func (s *Shard) QueryRow(c context.Context, query string, args ...interface{}) *Row {
+	return s.db.QueryRow(c, s.Rewrite(query), args...)
+}
+
+// WithTx runs fn in a transaction of the cluster, statements run with the
+// Tx must be rewritten with Rewrite.
+func (s *Shard) WithTx(c context.Context, opts *sql.TxOptions, fn TxFunc) error {
+	return s.db.WithTx(c, opts, fn)
+}
@@ -0,0 +1,95 @@
+package sql
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRouter(t *testing.T) {
+	if i, _ := NewModRouter(8).Route(13); i != 5 {
+		t.Errorf("mod Route(13) = %d, want 5", i)
+	}
+	for _, key := range []int64{-13, math.MinInt64} {
+		if i, _ := NewModRouter(8).Route(key); i < 0 || i >= 8 {
+			t.Errorf("mod Route(%d) = %d, want within [0, 8)", key, i)
+		}
+	}
+	r := NewRangeRouter([]int64{100, 200, 300})
+	for key, want := range map[int64]int{0: 0, 99: 0, 100: 1, 299: 2} {
+		if i, err := r.Route(key); err != nil || i != want {
+			t.Errorf("range Route(%d) = %d, %v, want %d", key, i, err, want)
+		}
+	}
+	if _, err := r.Route(300); err == nil {
+		t.Error("range Route(300) should be out of range")
+	}
+	h := NewHashRouter(16, 64)
+	seen := make(map[int]bool)
+	for key := int64(0); key < 1000; key++ {
+		i, _ := h.Route(key)
+		if j, _ := h.Route(key); i != j || i < 0 || i >= 16 {
+			t.Fatalf("hash Route(%d) = %d then %d", key, i, j)
+		}
+		seen[i] = true
+	}
+	if len(seen) != 16 {
+		t.Errorf("hash Route() used %d tables, want 16", len(seen))
+	}
+}
+
+func TestShardRewrite(t *testing.T) {
+	s := &Shard{Table: 7}
+	for _, table := range []string{"order", "tag"} {
+		for _, p := range tablePatterns(table) {
+			s.tables = append(s.tables, tableRewrite{p: p, table: table + "_07"})
+		}
+	}
+	tests := map[string]string{
+		"SELECT order.id FROM order JOIN order_item WHERE order.uid = ?": "SELECT order_07.id FROM order_07 JOIN order_item WHERE order_07.uid = ?",
+		"SELECT tag FROM tag WHERE tag = ?":                              "SELECT tag FROM tag_07 WHERE tag = ?",
+		"SELECT t.tag FROM `tag` AS t join order o ON o.tag = t.tag":     "SELECT t.tag FROM `tag_07` AS t join order_07 o ON o.tag = t.tag",
+		"INSERT INTO tag (tag) VALUES (?)":                               "INSERT INTO tag_07 (tag) VALUES (?)",
+		"UPDATE order SET tag = ? WHERE id IN (SELECT oid FROM tag)":     "UPDATE order_07 SET tag = ? WHERE id IN (SELECT oid FROM tag_07)",
+		"SELECT * FROM order, tag WHERE order.id = tag.oid":              "SELECT * FROM order_07, tag WHERE order_07.id = tag_07.oid",
+	}
+	for query, want := range tests {
+		if got := s.Rewrite(query); got != want {
+			t.Errorf("Rewrite(%s) = %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestOpenShardedRangeBounds(t *testing.T) {
+	_, err := OpenSharded(&ShardConfig{Clusters: []*Config{{}}, Tables: 3, Router: RouterRange, RangeBounds: []int64{100, 300, 200}})
+	if err == nil {
+		t.Error("OpenSharded() should refuse bounds which aren't ascending")
+	}
+}
+
+func TestScatter(t *testing.T) {
+	s := &ShardedDB{conf: &ShardConfig{Workers: 2}}
+	for i := 0; i < 10; i++ {
+		s.shards = append(s.shards, &Shard{Table: i})
+	}
+	var n int64
+	err := s.Scatter(context.Background(), func(c context.Context, shard *Shard) error {
+		atomic.AddInt64(&n, 1)
+		return nil
+	})
+	if err != nil || n != 10 {
+		t.Errorf("Scatter() = %v, called %d times", err, n)
+	}
+	err = s.Scatter(context.Background(), func(c context.Context, shard *Shard) error {
+		if shard.Table == 3 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Error("Scatter() should return the shard error")
+	}
+}
@@ -1,64 +1,105 @@
 package sql
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/mercari/go-circuitbreaker"
 	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+
+	"github.com/quan-xie/tuba/backoff"
+	"github.com/quan-xie/tuba/log"
+	"github.com/quan-xie/tuba/retry"
+	"github.com/quan-xie/tuba/util/xtime"
 )
 
 const (
-// _family          = "sql_client"
-// _slowLogDuration = time.Millisecond * 250
+	_family          = "sql_client"
+	_slowLogDuration = time.Millisecond * 250
 )
 
 var (
 	ErrNoMaster = errors.New("sql: no master instance")
+	// ErrNoRows is returned by Scan when QueryRow doesn't return a row.
+	ErrNoRows = sql.ErrNoRows
+	// ErrTxDone transaction done.
+	ErrTxDone = sql.ErrTxDone
 )
 
 // DB database.
 type DB struct {
-	write  *conn
-	read   []*conn
-	idx    int64
-	master *DB
+	write   *conn
+	read    []*conn
+	idx     int64
+	master  *DB
+	retrier retry.Retriable
+	closed  chan struct{}
+	once    sync.Once
 }
 
 // conn database connection
 type conn struct {
 	*sql.DB
-	conf *Config
-	addr string
+	conf    *Config
+	addr    string
+	breaker *circuitbreaker.CircuitBreaker
+	lag     int64 // replication lag in nanoseconds.
 }
 
 // Open create a mysql databse .
 func Open(c *Config) (*DB, error) {
+	if c.TranRetry == 0 {
+		c.TranRetry = 3
+	}
+	if c.TranBackoff == 0 {
+		c.TranBackoff = xtime.Duration(10 * time.Millisecond)
+	}
 	db := new(DB)
 	d, err := connect(c, c.DSN)
 	if err != nil {
 		return nil, err
 	}
-	addr := parseDSN(c.DSN)
-	w := &conn{DB: d, conf: c, addr: addr}
+	w := newConn(c, d, addr(c, c.DSN))
 	rs := make([]*conn, 0, len(c.ReadDSN))
 	for _, rd := range c.ReadDSN {
 		d, err := connect(c, rd)
 		if err != nil {
 			return nil, err
 		}
-		r := &conn{DB: d, conf: c, addr: addr}
-		rs = append(rs, r)
+		rs = append(rs, newConn(c, d, addr(c, rd)))
 	}
 	db.write = w
 	db.read = rs
-	db.master = &DB{write: db.write}
+	db.retrier = retry.NewRetrier(backoff.NewConstantBackoff(c.TranBackoff))
+	db.master = &DB{write: db.write, retrier: db.retrier}
+	db.closed = make(chan struct{})
+	if c.MaxReplicaLag > 0 && len(rs) > 0 {
+		go db.checkLag()
+	}
 	return db, nil
 }
 
+func newConn(c *Config, d *sql.DB, addr string) *conn {
+	cn := &conn{DB: d, conf: c, addr: addr}
+	if c.Breaker != nil {
+		cn.breaker = newBreaker(c.Breaker, addr)
+	}
+	return cn
+}
+
 func connect(c *Config, dataSourceName string) (*sql.DB, error) {
-	d, err := sql.Open("mysql", dataSourceName)
+	driver := c.Driver
+	if driver == "" {
+		driver = "mysql"
+	}
+	d, err := sql.Open(driver, dataSourceName)
 	if err != nil {
 		err = errors.WithStack(err)
 		return nil, err
@@ -69,6 +110,16 @@ func connect(c *Config, dataSourceName string) (*sql.DB, error) {
 	return d, nil
 }
 
+// shrink bounds the context by the given timeout, a zero timeout keeps the
+// context untouched.
+func shrink(c context.Context, d xtime.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return c, func() {}
+	}
+	_, c, cancel := d.Shrink(c)
+	return c, cancel
+}
+
 // parseDSN parse dsn name and return addr.
 func parseDSN(dsn string) (addr string) {
 	cfg, err := mysql.ParseDSN(dsn)
@@ -86,8 +137,75 @@ func (db *DB) readIndex() int {
 	return int(v) % len(db.read)
 }
 
+// readConn picks the next replica, skipping the ones whose breaker is open
+// or whose replication lag is over Config.MaxReplicaLag. The master is used
+// when no replica is configured, when the context asks for it, after a
+// recent write of the session unless a replica applied its GTID set, and
+// when no replica is available, their breakers are open or they lag behind.
+func (db *DB) readConn(c context.Context) *conn {
+	if len(db.read) == 0 || forceMaster(c) {
+		return db.write
+	}
+	recent, gtid := db.lastWrite(c)
+	if recent && gtid == "" {
+		return db.write
+	}
+	idx := db.readIndex()
+	for i := range db.read {
+		r := db.read[(idx+i)%len(db.read)]
+		if !r.ready() || !r.fresh() {
+			continue
+		}
+		if recent && !r.waitGTID(c, gtid) {
+			continue
+		}
+		return r
+	}
+	return db.write
+}
+
+// SetRetrier sets the retrier used to back off between transaction retries.
+func (db *DB) SetRetrier(retrier retry.Retriable) {
+	db.retrier = retrier
+	if db.master != nil {
+		db.master.retrier = retrier
+	}
+}
+
+// Begin starts a transaction on the master instance.
+func (db *DB) Begin(c context.Context) (tx *Tx, err error) {
+	return db.write.begin(c, nil)
+}
+
+// BeginTx starts a transaction with the given options on the master instance.
+func (db *DB) BeginTx(c context.Context, opts *sql.TxOptions) (tx *Tx, err error) {
+	return db.write.begin(c, opts)
+}
+
+// Exec executes a query without returning any rows on the master instance.
+func (db *DB) Exec(c context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	return db.write.exec(c, query, args...)
+}
+
+// Query executes a query that returns rows, reads go to a replica when one
+// is configured.
+func (db *DB) Query(c context.Context, query string, args ...interface{}) (rows *Rows, err error) {
+	return db.readConn(c).query(c, query, args...)
+}
+
+// QueryRow executes a query that is expected to return at most one row,
+// reads go to a replica when one is configured.
+func (db *DB) QueryRow(c context.Context, query string, args ...interface{}) *Row {
+	return db.readConn(c).queryRow(c, query, args...)
+}
+
 // Close closes the write and read database, releasing any open resources.
 func (db *DB) Close() (err error) {
+	db.once.Do(func() {
+		if db.closed != nil {
+			close(db.closed)
+		}
+	})
 	if e := db.write.Close(); e != nil {
 		err = errors.WithStack(e)
 	}
@@ -106,3 +224,127 @@ func (db *DB) Master() *DB {
 	}
 	return db.master
 }
+
+func (db *conn) begin(c context.Context, opts *sql.TxOptions) (tx *Tx, err error) {
+	if err = db.allow(); err != nil {
+		return
+	}
+	c, span := db.startSpan(c, "Tx", "BEGIN")
+	c, cancel := shrink(c, db.conf.TranTimeout)
+	rtx, err := db.BeginTx(c, opts)
+	db.done(err)
+	if err != nil {
+		cancel()
+		endSpan(span, err)
+		err = errors.WithStack(err)
+		return
+	}
+	tx = &Tx{db: db, tx: rtx, c: c, cancel: cancel, span: span}
+	return
+}
+
+func (db *conn) exec(c context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	if err = db.allow(); err != nil {
+		return
+	}
+	query = db.rebind(query)
+	now := time.Now()
+	c, span := db.startSpan(c, "Exec", query)
+	c, cancel := shrink(c, db.conf.ExecTimeout)
+	res, err = db.ExecContext(c, query, args...)
+	cancel()
+	db.done(err)
+	db.slowLog(c, query, args, now)
+	endSpan(span, err)
+	if err != nil {
+		err = errors.Wrapf(err, "exec:%s", query)
+		return
+	}
+	db.markWrite(c)
+	return
+}
+
+func (db *conn) query(c context.Context, query string, args ...interface{}) (rows *Rows, err error) {
+	if err = db.allow(); err != nil {
+		return
+	}
+	query = db.rebind(query)
+	now := time.Now()
+	c, span := db.startSpan(c, "Query", query)
+	defer func() { endSpan(span, err) }()
+	c, cancel := shrink(c, db.conf.QueryTimeout)
+	rs, err := db.QueryContext(c, query, args...)
+	db.done(err)
+	db.slowLog(c, query, args, now)
+	if err != nil {
+		cancel()
+		err = errors.Wrapf(err, "query:%s", query)
+		return
+	}
+	rows = &Rows{Rows: rs, cancel: cancel}
+	return
+}
+
+func (db *conn) queryRow(c context.Context, query string, args ...interface{}) *Row {
+	if err := db.allow(); err != nil {
+		return &Row{err: err}
+	}
+	query = db.rebind(query)
+	now := time.Now()
+	c, span := db.startSpan(c, "QueryRow", query)
+	c, cancel := shrink(c, db.conf.QueryTimeout)
+	r := db.DB.QueryRowContext(c, query, args...)
+	db.slowLog(c, query, args, now)
+	return &Row{Row: r, db: db, query: query, cancel: cancel, span: span}
+}
+
+// startSpan starts a span tagged with the statement and the instance address.
+func (db *conn) startSpan(c context.Context, name, query string) (context.Context, *trace.Span) {
+	c, span := trace.StartSpan(c, _family+" "+name, trace.WithSpanKind(trace.SpanKindClient))
+	span.AddAttributes(
+		trace.StringAttribute("sql.statement", query),
+		trace.StringAttribute("sql.addr", db.addr),
+	)
+	return c, span
+}
+
+// endSpan records err on the span and ends it.
+func endSpan(span *trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil && err != sql.ErrNoRows {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
+
+// slowLog logs the statement when it took longer than Config.SlowLogDuration,
+// args are redacted to their types so that no user data reaches the log.
+func (db *conn) slowLog(c context.Context, query string, args []interface{}, start time.Time) {
+	threshold := time.Duration(db.conf.SlowLogDuration)
+	if threshold <= 0 {
+		threshold = _slowLogDuration
+	}
+	if took := time.Since(start); took > threshold {
+		log.CtxWarnf(c, "%s slow log addr:%s statement:%s args:%s time:%v", _family, db.addr, query, redact(args), took)
+	}
+}
+
+// redact replaces every arg by its type, strings and bytes keep their length.
+func redact(args []interface{}) string {
+	ss := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			ss = append(ss, "NULL")
+		case string:
+			ss = append(ss, fmt.Sprintf("string(%d)", len(v)))
+		case []byte:
+			ss = append(ss, fmt.Sprintf("[]byte(%d)", len(v)))
+		default:
+			ss = append(ss, fmt.Sprintf("%T", v))
+		}
+	}
+	return "[" + strings.Join(ss, ", ") + "]"
+}
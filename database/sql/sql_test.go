@@ -0,0 +1,40 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var errRetry = errors.New("retry")
+
+func TestRedact(t *testing.T) {
+	got := redact([]interface{}{int64(1), "secret", []byte("abc"), nil})
+	if want := "[int64, string(6), []byte(3), NULL]"; got != want {
+		t.Errorf("redact() = %s, want %s", got, want)
+	}
+}
+
+func TestDialect(t *testing.T) {
+	rebind := func(query string) string { return strings.ReplaceAll(query, "?", "$1") }
+	retryable := func(err error) bool { return errors.Is(err, errRetry) }
+	db, d := openTest(t, &Config{TranBackoff: 1, Dialect: &Dialect{Rebind: rebind, Retryable: retryable}})
+	d.ExpectExec(`^UPDATE user SET name = \$1$`).WithDSN("master").WillReturnResult(0, 1)
+	d.ExpectBegin()
+	d.ExpectExec(`^UPDATE user SET age = \$1$`).WillReturnError(errRetry)
+	d.ExpectRollback()
+	d.ExpectBegin()
+	d.ExpectExec(`^UPDATE user SET age = \$1$`).WillReturnResult(0, 1)
+	d.ExpectCommit()
+	if _, err := db.Exec(context.Background(), "UPDATE user SET name = ?", "a"); err != nil {
+		t.Fatal(err)
+	}
+	err := db.WithTx(context.Background(), nil, func(tx *Tx) error {
+		_, err := tx.Exec("UPDATE user SET age = ?", 18)
+		return err
+	})
+	if err != nil {
+		t.Errorf("WithTx() = %v, want the retry to succeed", err)
+	}
+}
@@ -0,0 +1,356 @@
+// Package sqltest provides a scripted database/sql driver to test code
+// built on database/sql without a real database.
+//
+//	name, d := sqltest.New()
+//	d.ExpectQuery(`SELECT id, name FROM user WHERE id = \?`).WithArgs(1).
+//		WillReturnRows(sqltest.NewRows("id", "name").AddRow(1, "tuba"))
+//	db, _ := sql.Open(name, "master")
+//	// run the code under test with db.
+//	if err := d.ExpectationsWereMet(); err != nil {
+//		t.Error(err)
+//	}
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var _seq int64
+
+const (
+	kindBegin    = "BEGIN"
+	kindCommit   = "COMMIT"
+	kindRollback = "ROLLBACK"
+	kindExec     = "EXEC"
+	kindQuery    = "QUERY"
+)
+
+// Driver is a scripted driver, every call must match the next expectation.
+type Driver struct {
+	mu      sync.Mutex
+	expects []*Expectation
+	next    int
+	errs    []error
+}
+
+// New registers a new Driver under a unique name to pass to sql.Open, the
+// data source name identifies the instance in WithDSN.
+func New() (name string, d *Driver) {
+	d = &Driver{}
+	name = fmt.Sprintf("sqltest_%d", atomic.AddInt64(&_seq, 1))
+	sql.Register(name, d)
+	return
+}
+
+// Expectation is an expected call and its scripted result.
+type Expectation struct {
+	kind     string
+	query    *regexp.Regexp
+	args     []driver.Value
+	checkArg bool
+	dsn      string
+	result   driver.Result
+	rows     *Rows
+	err      error
+	delay    time.Duration
+}
+
+// ExpectBegin expects a transaction to begin.
+func (d *Driver) ExpectBegin() *Expectation { return d.expect(kindBegin, "") }
+
+// ExpectCommit expects a transaction to commit.
+func (d *Driver) ExpectCommit() *Expectation { return d.expect(kindCommit, "") }
+
+// ExpectRollback expects a transaction to roll back.
+func (d *Driver) ExpectRollback() *Expectation { return d.expect(kindRollback, "") }
+
+// ExpectExec expects a statement matching the regular expression to be executed.
+func (d *Driver) ExpectExec(query string) *Expectation { return d.expect(kindExec, query) }
+
+// ExpectQuery expects a query matching the regular expression to be run.
+func (d *Driver) ExpectQuery(query string) *Expectation { return d.expect(kindQuery, query) }
+
+func (d *Driver) expect(kind, query string) *Expectation {
+	e := &Expectation{kind: kind}
+	if query != "" {
+		e.query = regexp.MustCompile(query)
+	}
+	d.mu.Lock()
+	d.expects = append(d.expects, e)
+	d.mu.Unlock()
+	return e
+}
+
+// WithArgs expects the call to be made with args, compared after their
+// conversion to driver values.
+func (e *Expectation) WithArgs(args ...interface{}) *Expectation {
+	e.checkArg = true
+	e.args = make([]driver.Value, len(args))
+	for i, arg := range args {
+		v, err := driver.DefaultParameterConverter.ConvertValue(arg)
+		if err != nil {
+			panic(fmt.Sprintf("sqltest: arg %d: %v", i, err))
+		}
+		e.args[i] = v
+	}
+	return e
+}
+
+// WithDSN expects the call to be made on the instance opened with dsn.
+func (e *Expectation) WithDSN(dsn string) *Expectation {
+	e.dsn = dsn
+	return e
+}
+
+// WillReturnResult sets the result of an exec.
+func (e *Expectation) WillReturnResult(lastInsertID, rowsAffected int64) *Expectation {
+	e.result = result{lastInsertID: lastInsertID, rowsAffected: rowsAffected}
+	return e
+}
+
+// WillReturnRows sets the rows of a query.
+func (e *Expectation) WillReturnRows(rows *Rows) *Expectation {
+	e.rows = rows
+	return e
+}
+
+// WillReturnError makes the call fail with err.
+func (e *Expectation) WillReturnError(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+// WillDelay makes the call take d, or until its context is done.
+func (e *Expectation) WillDelay(d time.Duration) *Expectation {
+	e.delay = d
+	return e
+}
+
+func (e *Expectation) String() string {
+	var b strings.Builder
+	b.WriteString(e.kind)
+	if e.query != nil {
+		b.WriteString(" " + e.query.String())
+	}
+	if e.checkArg {
+		fmt.Fprintf(&b, " args %v", e.args)
+	}
+	if e.dsn != "" {
+		b.WriteString(" on " + e.dsn)
+	}
+	return b.String()
+}
+
+// ExpectationsWereMet returns an error when an expectation was not met or a
+// call was not expected.
+func (d *Driver) ExpectationsWereMet() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.errs) > 0 {
+		return d.errs[0]
+	}
+	if d.next < len(d.expects) {
+		return errors.Errorf("sqltest: expectation not met: %s", d.expects[d.next])
+	}
+	return nil
+}
+
+// match consumes the next expectation if it matches the call.
+func (d *Driver) match(c context.Context, dsn, kind, query string, args []driver.NamedValue) (e *Expectation, err error) {
+	d.mu.Lock()
+	if d.next >= len(d.expects) {
+		err = errors.Errorf("sqltest: unexpected %s %s on %s", kind, query, dsn)
+	} else if e = d.expects[d.next]; !e.matches(dsn, kind, query, args) {
+		err = errors.Errorf("sqltest: %s %s %v on %s, want %s", kind, query, values(args), dsn, e)
+	}
+	if err != nil {
+		d.errs = append(d.errs, err)
+		d.mu.Unlock()
+		return nil, err
+	}
+	d.next++
+	d.mu.Unlock()
+	if e.delay > 0 {
+		select {
+		case <-time.After(e.delay):
+		case <-c.Done():
+			return nil, c.Err()
+		}
+	}
+	return e, e.err
+}
+
+func (e *Expectation) matches(dsn, kind, query string, args []driver.NamedValue) bool {
+	if e.kind != kind || (e.dsn != "" && e.dsn != dsn) {
+		return false
+	}
+	if e.query != nil && !e.query.MatchString(query) {
+		return false
+	}
+	return !e.checkArg || reflect.DeepEqual(e.args, values(args))
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	vs := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vs[i] = arg.Value
+	}
+	return vs
+}
+
+// Open implements driver.Driver.
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	return &conn{d: d, dsn: dsn}, nil
+}
+
+type conn struct {
+	d   *Driver
+	dsn string
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{c: c, query: query}, nil
+}
+
+func (c *conn) Close() error { return nil }
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if _, err := c.d.match(ctx, c.dsn, kindBegin, "", nil); err != nil {
+		return nil, err
+	}
+	return &tx{c: c}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, err := c.d.match(ctx, c.dsn, kindExec, query, args)
+	if err != nil {
+		return nil, err
+	}
+	if e.result == nil {
+		return driver.ResultNoRows, nil
+	}
+	return e.result, nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	e, err := c.d.match(ctx, c.dsn, kindQuery, query, args)
+	if err != nil {
+		return nil, err
+	}
+	if e.rows == nil {
+		return &rows{}, nil
+	}
+	return &rows{Rows: e.rows}, nil
+}
+
+type stmt struct {
+	c     *conn
+	query string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.c.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.c.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	nvs := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		nvs[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return nvs
+}
+
+type tx struct {
+	c *conn
+}
+
+func (t *tx) Commit() error {
+	_, err := t.c.d.match(context.Background(), t.c.dsn, kindCommit, "", nil)
+	return err
+}
+
+func (t *tx) Rollback() error {
+	_, err := t.c.d.match(context.Background(), t.c.dsn, kindRollback, "", nil)
+	return err
+}
+
+type result struct {
+	lastInsertID, rowsAffected int64
+}
+
+func (r result) LastInsertId() (int64, error) { return r.lastInsertID, nil }
+func (r result) RowsAffected() (int64, error) { return r.rowsAffected, nil }
+
+// Rows are the scripted rows of a query.
+type Rows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+// NewRows returns empty rows with the columns.
+func NewRows(columns ...string) *Rows {
+	return &Rows{columns: columns}
+}
+
+// AddRow adds a row, values are in the order of the columns.
+func (r *Rows) AddRow(values ...interface{}) *Rows {
+	if len(values) != len(r.columns) {
+		panic(fmt.Sprintf("sqltest: %d values for %d columns", len(values), len(r.columns)))
+	}
+	row := make([]driver.Value, len(values))
+	for i, v := range values {
+		dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+		if err != nil {
+			panic(fmt.Sprintf("sqltest: value %d: %v", i, err))
+		}
+		row[i] = dv
+	}
+	r.values = append(r.values, row)
+	return r
+}
+
+type rows struct {
+	*Rows
+	pos int
+}
+
+func (r *rows) Columns() []string {
+	if r.Rows == nil {
+		return nil
+	}
+	return r.columns
+}
+
+func (r *rows) Close() error { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.Rows == nil || r.pos >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.pos])
+	r.pos++
+	return nil
+}
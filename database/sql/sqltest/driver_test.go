@@ -0,0 +1,87 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestDriver(t *testing.T) {
+	name, d := New()
+	db, err := sql.Open(name, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d.ExpectExec(`^INSERT INTO user`).WithArgs(1, "tuba").WillReturnResult(7, 1)
+	d.ExpectQuery(`^SELECT id, name FROM user`).WithArgs(1).WithDSN("master").
+		WillReturnRows(NewRows("id", "name").AddRow(1, "tuba"))
+
+	res, err := db.Exec("INSERT INTO user (id, name) VALUES (?, ?)", 1, "tuba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := res.LastInsertId(); id != 7 {
+		t.Errorf("LastInsertId() = %d, want 7", id)
+	}
+	var (
+		id   int64
+		user string
+	)
+	if err = db.QueryRow("SELECT id, name FROM user WHERE id = ?", 1).Scan(&id, &user); err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 || user != "tuba" {
+		t.Errorf("Scan() = %d %s, want 1 tuba", id, user)
+	}
+	if err = d.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDriverMismatch(t *testing.T) {
+	name, d := New()
+	db, _ := sql.Open(name, "master")
+	defer db.Close()
+	d.ExpectExec(`^UPDATE user`).WithArgs(1)
+	d.ExpectExec(`^DELETE FROM user`)
+
+	if _, err := db.Exec("UPDATE user SET name = ?", 2); err == nil {
+		t.Error("Exec() with unexpected args should fail")
+	}
+	if err := d.ExpectationsWereMet(); err == nil {
+		t.Error("ExpectationsWereMet() should report the mismatch")
+	}
+}
+
+func TestDriverUnmet(t *testing.T) {
+	_, d := New()
+	d.ExpectBegin()
+	if err := d.ExpectationsWereMet(); err == nil {
+		t.Error("ExpectationsWereMet() should report the pending expectation")
+	}
+}
+
+func TestDriverErrorAndDelay(t *testing.T) {
+	name, d := New()
+	db, _ := sql.Open(name, "master")
+	defer db.Close()
+	want := errors.New("boom")
+	d.ExpectQuery(`SELECT 1`).WillReturnError(want)
+	d.ExpectQuery(`SELECT 2`).WillDelay(time.Second)
+
+	if _, err := db.Query("SELECT 1"); !errors.Is(err, want) {
+		t.Errorf("Query() error = %v, want %v", err, want)
+	}
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.QueryContext(c, "SELECT 2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("QueryContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := d.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
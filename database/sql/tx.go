@@ -0,0 +1,193 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// mysql error numbers that abort a transaction and are safe to retry.
+	_errDeadlock        = 1213
+	_errLockWaitTimeout = 1205
+)
+
+type txKey struct{}
+
+// Tx transaction.
+type Tx struct {
+	db     *conn
+	tx     *sql.Tx
+	c      context.Context
+	cancel func()
+	span   *trace.Span
+	depth  int // savepoint nesting depth.
+}
+
+// TxFunc is the function run inside a transaction by WithTx.
+type TxFunc func(tx *Tx) error
+
+// Context returns the transaction context, it carries the transaction so
+// that a nested WithTx called with it runs inside a savepoint.
+func (tx *Tx) Context() context.Context {
+	return context.WithValue(tx.c, txKey{}, tx)
+}
+
+// Commit commits the transaction.
+func (tx *Tx) Commit() (err error) {
+	err = tx.tx.Commit()
+	tx.cancel()
+	tx.db.done(err)
+	tx.span.Annotate(nil, "COMMIT")
+	endSpan(tx.span, err)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	tx.db.markWrite(tx.c)
+	return
+}
+
+// Rollback aborts the transaction.
+func (tx *Tx) Rollback() (err error) {
+	err = tx.tx.Rollback()
+	tx.cancel()
+	tx.span.Annotate(nil, "ROLLBACK")
+	endSpan(tx.span, err)
+	if err != nil {
+		err = errors.WithStack(err)
+	}
+	return
+}
+
+// Exec executes a query that doesn't return rows.
+// For example: an INSERT and UPDATE.
+func (tx *Tx) Exec(query string, args ...interface{}) (res sql.Result, err error) {
+	query = tx.db.rebind(query)
+	now := time.Now()
+	c, span := tx.db.startSpan(tx.c, "Tx Exec", query)
+	res, err = tx.tx.ExecContext(c, query, args...)
+	tx.db.done(err)
+	tx.db.slowLog(c, query, args, now)
+	endSpan(span, err)
+	if err != nil {
+		err = errors.Wrapf(err, "exec:%s", query)
+	}
+	return
+}
+
+// Query executes a query that returns rows, typically a SELECT.
+func (tx *Tx) Query(query string, args ...interface{}) (rows *Rows, err error) {
+	query = tx.db.rebind(query)
+	now := time.Now()
+	c, span := tx.db.startSpan(tx.c, "Tx Query", query)
+	rs, err := tx.tx.QueryContext(c, query, args...)
+	tx.db.done(err)
+	tx.db.slowLog(c, query, args, now)
+	endSpan(span, err)
+	if err != nil {
+		err = errors.Wrapf(err, "query:%s", query)
+		return
+	}
+	rows = &Rows{Rows: rs}
+	return
+}
+
+// QueryRow executes a query that is expected to return at most one row.
+// QueryRow always returns a non-nil value. Errors are deferred until
+// Row's Scan method is called.
+func (tx *Tx) QueryRow(query string, args ...interface{}) *Row {
+	query = tx.db.rebind(query)
+	now := time.Now()
+	c, span := tx.db.startSpan(tx.c, "Tx QueryRow", query)
+	r := tx.tx.QueryRowContext(c, query, args...)
+	tx.db.slowLog(c, query, args, now)
+	return &Row{Row: r, db: tx.db, query: query, span: span}
+}
+
+// WithTx runs fn inside a savepoint of the transaction. The savepoint is
+// released when fn succeeds and rolled back when fn returns an error or
+// panics, leaving the enclosing transaction usable.
+func (tx *Tx) WithTx(fn TxFunc) (err error) {
+	tx.depth++
+	name := fmt.Sprintf("tuba_sp_%d", tx.depth)
+	defer func() { tx.depth-- }()
+	if _, err = tx.Exec("SAVEPOINT " + name); err != nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Exec("ROLLBACK TO SAVEPOINT " + name)
+			panic(p)
+		}
+		if err != nil {
+			if _, e := tx.Exec("ROLLBACK TO SAVEPOINT " + name); e != nil {
+				err = errors.Wrapf(err, "rollback savepoint error(%v)", e)
+			}
+			return
+		}
+		_, err = tx.Exec("RELEASE SAVEPOINT " + name)
+	}()
+	return fn(tx)
+}
+
+// WithTx runs fn inside a transaction on the master instance. The
+// transaction is committed when fn returns nil and rolled back when fn
+// returns an error or panics.
+//
+// When c was obtained from Tx.Context the call is nested and fn runs inside
+// a savepoint of that transaction instead of a new one.
+//
+// A transaction aborted by a deadlock or a lock wait timeout is retried up to
+// Config.TranRetry times, so fn must be safe to run more than once.
+func (db *DB) WithTx(c context.Context, opts *sql.TxOptions, fn TxFunc) (err error) {
+	if tx, ok := c.Value(txKey{}).(*Tx); ok {
+		return tx.WithTx(fn)
+	}
+	for i := 0; ; i++ {
+		if err = db.withTx(c, opts, fn); err == nil || i >= db.write.conf.TranRetry || !db.write.retryable(err) {
+			return
+		}
+		select {
+		case <-time.After(db.retrier.NextInterval(i + 1)):
+		case <-c.Done():
+			return
+		}
+	}
+}
+
+func (db *DB) withTx(c context.Context, opts *sql.TxOptions, fn TxFunc) (err error) {
+	tx, err := db.write.begin(c, opts)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				err = errors.Wrapf(err, "rollback error(%v)", e)
+			}
+			return
+		}
+		err = tx.Commit()
+	}()
+	return fn(tx)
+}
+
+// isRetryableTx reports whether err aborted the transaction because of a
+// deadlock or a lock wait timeout.
+func isRetryableTx(err error) bool {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) {
+		return false
+	}
+	return me.Number == _errDeadlock || me.Number == _errLockWaitTimeout
+}
@@ -0,0 +1,141 @@
+package sql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+func TestIsRetryableTx(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: _errDeadlock}, true},
+		{&mysql.MySQLError{Number: _errLockWaitTimeout}, true},
+		{errors.Wrap(&mysql.MySQLError{Number: _errDeadlock}, "exec:UPDATE t"), true},
+		{&mysql.MySQLError{Number: 1062}, false},
+		{errors.New("bad connection"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableTx(tt.err); got != tt.want {
+			t.Errorf("isRetryableTx(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	c := context.Background()
+	d.ExpectBegin().WithDSN("master")
+	d.ExpectExec(`^UPDATE user`).WithDSN("master").WithArgs("a", 1)
+	d.ExpectCommit()
+
+	err := db.WithTx(c, nil, func(tx *Tx) error {
+		_, err := tx.Exec("UPDATE user SET name = ? WHERE id = ?", "a", 1)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithTxRollback(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	c := context.Background()
+	want := errors.New("abort")
+	d.ExpectBegin()
+	d.ExpectExec(`^UPDATE user`)
+	d.ExpectRollback()
+	d.ExpectBegin()
+	d.ExpectRollback()
+
+	err := db.WithTx(c, nil, func(tx *Tx) error {
+		if _, err := tx.Exec("UPDATE user SET name = ''"); err != nil {
+			return err
+		}
+		return want
+	})
+	if err != want {
+		t.Errorf("WithTx() error = %v, want %v", err, want)
+	}
+	func() {
+		defer func() {
+			if p := recover(); p == nil {
+				t.Error("WithTx() should propagate the panic")
+			}
+		}()
+		db.WithTx(c, nil, func(tx *Tx) error { panic("boom") })
+	}()
+}
+
+func TestWithTxSavepoint(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	c := context.Background()
+	d.ExpectBegin()
+	d.ExpectExec(`^SAVEPOINT tuba_sp_1$`)
+	d.ExpectExec(`^INSERT INTO log`)
+	d.ExpectExec(`^ROLLBACK TO SAVEPOINT tuba_sp_1$`)
+	d.ExpectExec(`^SAVEPOINT tuba_sp_1$`)
+	d.ExpectExec(`^RELEASE SAVEPOINT tuba_sp_1$`)
+	d.ExpectCommit()
+
+	err := db.WithTx(c, nil, func(tx *Tx) error {
+		err := db.WithTx(tx.Context(), nil, func(tx *Tx) error {
+			tx.Exec("INSERT INTO log (msg) VALUES ('')")
+			return errors.New("abort")
+		})
+		if err == nil {
+			t.Error("nested WithTx() should return the error of fn")
+		}
+		return tx.WithTx(func(tx *Tx) error { return nil })
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithTxRetry(t *testing.T) {
+	db, d := openTest(t, &Config{TranRetry: 1})
+	c := context.Background()
+	d.ExpectBegin()
+	d.ExpectExec(`^UPDATE user`).WillReturnError(&mysql.MySQLError{Number: _errDeadlock})
+	d.ExpectRollback()
+	d.ExpectBegin()
+	d.ExpectExec(`^UPDATE user`)
+	d.ExpectCommit()
+
+	calls := 0
+	err := db.WithTx(c, nil, func(tx *Tx) error {
+		calls++
+		_, err := tx.Exec("UPDATE user SET name = ''")
+		return err
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("WithTx() = %v after %d calls, want nil after 2", err, calls)
+	}
+}
+
+func TestOpenTranRetry(t *testing.T) {
+	db, d := openTest(t, &Config{})
+	if conf := db.write.conf; conf.TranRetry != 3 || conf.TranBackoff == 0 {
+		t.Errorf("TranRetry = %d, TranBackoff = %v, want the defaults", conf.TranRetry, conf.TranBackoff)
+	}
+	for i := 0; i < 3; i++ {
+		d.ExpectBegin()
+		d.ExpectExec(`^UPDATE user`).WillReturnError(&mysql.MySQLError{Number: _errLockWaitTimeout})
+		d.ExpectRollback()
+	}
+	d.ExpectBegin()
+	d.ExpectExec(`^UPDATE user`)
+	d.ExpectCommit()
+	err := db.WithTx(context.Background(), nil, func(tx *Tx) error {
+		_, err := tx.Exec("UPDATE user SET name = ''")
+		return err
+	})
+	if err != nil {
+		t.Errorf("WithTx() = %v, want nil after 3 retries", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql/driver"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,13 +15,32 @@ func (t *Time) Scan(i interface{}) (err error) {
 	case time.Time:
 		*t = Time(it.Unix())
 	case string:
-		var v int64
-		v, err = strconv.ParseInt(it, 10, 64)
-		*t = Time(v)
+		*t, err = parseText(it)
+	case []byte:
+		*t, err = parseText(string(it))
+	case int64:
+		*t = Time(it)
 	}
 	return
 }
 
+// _datetime is the text of a mysql DATETIME or TIMESTAMP, sent when the
+// driver doesn't parse the times, fractional seconds are optional.
+const _datetime = "2006-01-02 15:04:05.999999"
+
+// parseText parses a DATETIME in UTC, the location of the mysql driver by
+// default, or else a unix timestamp. The zero DATETIME is 0.
+func parseText(s string) (Time, error) {
+	if strings.HasPrefix(s, "0000-00-00") {
+		return 0, nil
+	}
+	if tm, err := time.ParseInLocation(_datetime, s, time.UTC); err == nil {
+		return Time(tm.Unix()), nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	return Time(v), err
+}
+
 // Value get time value.
 func (t Time) Value() (driver.Value, error) {
 	return time.Unix(int64(t), 0), nil
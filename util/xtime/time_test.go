@@ -7,7 +7,27 @@ func TestDuration_UnmarshalText(t *testing.T) {
 }
 
 func TestTime_Scan(t *testing.T) {
-	t.Log(nil)
+	tests := []struct {
+		src  interface{}
+		want Time
+	}{
+		{int64(1704207845), 1704207845},
+		{"1704207845", 1704207845},
+		{[]byte("1704207845"), 1704207845},
+		{[]byte("2024-01-02 15:04:05"), 1704207845},
+		{[]byte("2024-01-02 15:04:05.123"), 1704207845},
+		{"0000-00-00 00:00:00", 0},
+	}
+	for _, tt := range tests {
+		var got Time
+		if err := got.Scan(tt.src); err != nil || got != tt.want {
+			t.Errorf("Scan(%v) = %d, %v, want %d", tt.src, got, err, tt.want)
+		}
+	}
+	var got Time
+	if err := got.Scan([]byte("yesterday")); err == nil {
+		t.Error("Scan(yesterday) should fail")
+	}
 }
 
 func TestTime_Value(t *testing.T) {